@@ -1,16 +1,38 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
+	"math"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
 
 	"github.com/atotto/clipboard"
 )
@@ -25,19 +47,80 @@ const (
 	filenameLabel        = "filename: "
 	executableLabel      = "executable: "
 	trailingNewlineLabel = "trailing_newline: "
+	languageLabel        = "language: "
+	symlinkLabel         = "symlink: "
+	bomLabel             = "bom: "
+	modtimeLabel         = "modtime: "
+	sizeLabel            = "size: "
+	formatVersionLabel   = "format_version: " // Header line naming the v1 delimiter set, see knownDelimiters
 	contentLabel         = "content:\n"
+	compactMetaLabel     = "meta: "        // --compact-metadata: all metadata as key=value pairs separated by ';', content follows
+	objectLabel          = "object: "      // --store: '<algorithm>:<hex digest> <size>' of the content, kept in the store instead of the block
+	tempDirEnv           = "PAKTXT_TMPDIR" // Directory for 'pack --output-to-temp' (default: the system temp dir)
 	mdExtension          = ".md"
+	gzipExtension        = ".gz"
 	paktxtExtension      = ".paktxt"
+	blockSeparator       = "\n" // Terminates the end delimiter line; readers skip any further blank lines between blocks
+	markdownExportMarker = "<!-- paktxt markdown export: presentation only, not restorable with 'paktxt unpack' -->"
+	signaturePrefix      = "PAKTXT-SIGNATURE ed25519 " // Trailer line of signed archives, followed by the base64 signature
+	baseRefPrefix        = "PAKTXT-BASE "              // Trailer line of --since-archive archives, followed by the base identity
+	strippedMarker       = "PAKTXT-STRIPPED: "         // First line of --strip-comments/--trim-whitespace output, followed by what was removed
+	base64Marker         = "PAKTXT-BASE64"             // First line of '--output-encoding base64' archives, followed by the encoded archive
 )
 
-const paktxtHeader = `PAKTXT
-This document contains a collection of text-based files from a directory,
+// Archive encodings selectable with 'pack --output-encoding'; readers detect them.
+const (
+	encodingUTF8    = "utf8"
+	encodingUTF8BOM = "utf8-bom"
+	encodingBase64  = "base64"
+)
+
+// hashAlgos are the digests selectable with 'pack --hash-algo' for --store objects. Each
+// reference records its algorithm as a prefix ('sha256:<hex>'), which readers dispatch on.
+// Only SHA-256 is offered until a faster algorithm can be added: SHA-1 has practical
+// collisions and hashes no faster here.
+var hashAlgos = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+}
+
+const defaultHashAlgo = "sha256"
+
+// Archive formats selectable with 'pack --format'.
+const (
+	formatV1 = "v1" // Delimiter-based blocks with labeled metadata (default)
+	formatV2 = "v2" // Length-prefixed blocks with a JSON header
+	v2Magic  = "PAKTXT2\n"
+)
+
+// delimiterSet is a pair of v1 block delimiters, identified by the format_version that
+// introduced it.
+type delimiterSet struct {
+	version    int
+	start, end string
+}
+
+// knownDelimiters lists every delimiter set v1 archives have been written with, oldest first.
+// pack writes the last one; readers detect which one an archive uses, so a future change of
+// delimiters only needs a new entry here. The set has not changed since the format was
+// introduced, so archives without a format_version line use version 1.
+var knownDelimiters = []delimiterSet{
+	{version: 1, start: startBlockDelimiter, end: endBlockDelimiter},
+}
+
+const paktxtHeader = "PAKTXT\n" + formatVersionLabel + "1\n" + `This document contains a collection of text-based files from a directory,
 concatenated into a single .paktxt file by the 'paktxt' Go program.
 
 Each file's content is embedded within distinct blocks, defined by unique start and end delimiters.
 The original file path is specified by a 'filename:' label,
 its executable status by an 'executable:' label, and the content follows a 'content:' label.
 A 'trailing_newline:' label indicates if the original file ended with a newline.
+An optional 'language:' label carries an informational language hint.
+An optional 'symlink:' label marks a relative symbolic link that is recreated on restore.
+A 'bom: true' label records that the original file started with a UTF-8 byte order mark.
+An optional 'modtime:' label records the file's modification time (RFC 3339, UTC).
+A 'size:' label, written when the content would otherwise be ambiguous, gives its exact length in bytes.
+An 'object: <algorithm>:<digest> <size>' label replaces the content of a file kept in a store.
+The 'format_version:' line above names the set of delimiters used by the blocks below.
 
 File Block Structure (conceptual example, not parsable as content):
 ---PAKTXT_FILE_START-...---
@@ -53,9 +136,123 @@ content:
 var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
 
 var (
-	workingDirPath string
-	versionFlag    bool
-	helpFlag       bool
+	workingDirPath   string
+	versionFlag      bool
+	helpFlag         bool
+	clipboardTimeout time.Duration
+	summaryFlag      bool
+	strictParse      bool
+	profileFlag      bool
+	storeDir         string // --store: absolute path of the content-addressable object store; "" keeps content inline
+	reportFile       string // --report: where the run report is written; "" records no events
+	reportFormat     string // --report-format: reportJSON or reportCSV, inferred from the --report extension if empty
+)
+
+// Pack options shared across the pack pipeline.
+var (
+	packFormat            = formatV1
+	packLanguageHints     bool
+	packExcludePercentile float64
+	packResolveSymlinks   bool
+	packMarkdown          bool
+	packStripBOM          bool
+	packHashAlgo          string // --store: algorithm of new object digests, a key of hashAlgos
+	packContentRegex      *regexp.Regexp
+	packSplitByDir        bool
+	packGitSelection      string // "", gitSelectUntracked, gitSelectModified or gitSelectTracked
+	packRedactor          *pathRedactor
+	packRedactMapFile     string
+	packAppend            bool
+	packModTime           bool
+	packBinaryExtOnly     bool
+	packAbsolutePaths     bool
+	packStripComments     bool
+	packTrimWhitespace    bool
+	packReplacements      []replacement // From --replace, applied to stored content
+	packOutputEncoding    = encodingUTF8
+	packOnlyExts          map[string]bool // Lower-case extensions without the dot, from --only-ext
+	packDryRun            bool
+	packSelect            bool
+	packMaxTotalBytes     int
+	packFollowGitignore   bool
+	packCompactMetadata   bool
+	packReadRetries       int
+	packReadRetryDelay    = 100 * time.Millisecond // Before the first retry; doubles for each further one
+	packOutputMode        = fs.FileMode(0644)      // Permissions of the written archive, from --output-mode (else 0644 less the umask)
+	packSignKey           ed25519.PrivateKey
+	packDiffBase          map[string]baseEntry // Blocks of the --diff-with/--since-archive archive by slash path
+	packBaseRef           string               // Identity of the --since-archive base; enables the stat pre-filter
+	packGitAttributes     bool
+	packExcludeEmpty      bool
+	packExcludeTests      bool
+	packOnlyTests         bool
+	packTestPatterns      = defaultTestPatterns // From --test-patterns
+	packMinFileSize       int64                 // --min-file-size; 0 disables
+	packMaxFileSize       int64                 // --max-file-size; 0 disables
+	packPathPrefix        string                // --path-prefix, cleaned slash path; "" packs the whole root
+	packIncludePaktxt     bool
+	packMaxLineLength     int
+	packTextFiles         map[string]bool // Slash paths from --text-file, packed regardless of extension or signature
+	packCompress          bool
+	packTimestamp         time.Time // From --timestamp: every recorded modtime
+	packClampTime         time.Time // From SOURCE_DATE_EPOCH: later modtimes are clamped to it
+	packOutputPath        string    // Absolute path of the archive being written, never packed itself
+	packClipboardViaTemp  bool
+)
+
+// Git file selections for pack.
+const (
+	gitSelectUntracked = "untracked"
+	gitSelectModified  = "modified"
+	gitSelectTracked   = "tracked"
+)
+
+// Unpack options shared across the restore pipeline.
+var (
+	unpackGitAdd        bool
+	unpackGitCommitMsg  string
+	unpackStripBOM      bool
+	unpackAutoExec      bool
+	unpackRedactMap     map[string]string // redacted path -> original path
+	unpackOnConflict    = conflictOverwrite
+	unpackPostCmd       string
+	unpackAllowAbsolute bool
+	unpackTouchOnly     bool
+	unpackRelocate      bool
+	unpackVerifyKey     ed25519.PublicKey
+	unpackRequire       []string // Glob patterns that must each match at least one block
+	unpackPruneEmpty    bool
+	unpackExecGlobs     []string // Restored files matching these are made executable
+	unpackContentFilter string
+	unpackFilterTimeout = 30 * time.Second
+	unpackForce         bool
+	unpackLowerNames    bool
+	unpackDirMode       fs.FileMode = 0755 // For directories created by the restore
+	unpackUmask         fs.FileMode        // Permission bits the restore never grants: the process umask plus --umask
+	unpackSkipUnchanged bool
+	unpackReplacements  []replacement // From --replace, applied to restored content
+	unpackReverse       bool          // --reverse-restore: write blocks from last to first
+	unpackJobs          = 1           // --jobs: number of files written concurrently
+	unpackTarOutput     io.Writer     // --to-tar: receives the tar stream instead of restoring to disk
+	unpackLineEnding    = lineEndingPreserve
+	unpackPathPrefix    string // --path-prefix, cleaned slash path; "" restores every block
+)
+
+// Modes for 'unpack --line-ending'.
+const (
+	lineEndingPreserve = "preserve" // Restore the stored bytes (default)
+	lineEndingLF       = "lf"
+	lineEndingCRLF     = "crlf"
+)
+
+// Policies for 'unpack --on-conflict', applied when a restored file already exists.
+const (
+	conflictOverwrite = "overwrite" // Always replace the file on disk (default)
+	conflictNewer     = "newer"     // Replace it only if the archived modtime is more recent
+	conflictSkip      = "skip"      // Never replace it (--no-clobber)
+
+	conflictArchiveWins = "archive-wins" // Alias of conflictOverwrite
+	conflictDiskWins    = "disk-wins"    // Alias of conflictSkip
 )
 
 var excludedDirs = map[string]bool{
@@ -64,11 +261,116 @@ var excludedDirs = map[string]bool{
 	".vscode": true, ".cache": true, "tmp": true,
 }
 
+// textExtensions lists lower-cased extensions that are always treated as text, skipping the
+// binary signature check. Extended with 'pack --text-ext'. '.ts' is not listed: it is also the
+// extension of MPEG transport streams, which the signature check recognises.
+var textExtensions = map[string]bool{
+	".go": true, ".md": true, ".txt": true, ".json": true, ".yaml": true, ".yml": true,
+	".toml": true, ".xml": true, ".html": true, ".css": true, ".js": true,
+	".py": true, ".rs": true, ".java": true, ".c": true, ".h": true, ".cpp": true,
+	".sh": true, ".rb": true, ".sql": true, ".csv": true, ".ini": true, ".cfg": true,
+}
+
+// FileBlock is a single file entry of an archive. Its JSON form is the v2 block header.
 type FileBlock struct {
-	Filename           string
-	IsExecutable       bool
-	HasTrailingNewline bool
-	Content            []byte
+	Filename           string `json:"filename"`
+	IsExecutable       bool   `json:"executable"`
+	HasTrailingNewline bool   `json:"trailing_newline"`
+	Size               int    `json:"size"`
+	Language           string `json:"language,omitempty"`
+	Symlink            string `json:"symlink,omitempty"`
+	HasBOM             bool   `json:"bom,omitempty"`
+	ModTime            string `json:"modtime,omitempty"`
+	Object             string `json:"object,omitempty"`
+	ObjectSize         int    `json:"object_size,omitempty"` // Bytes of the Object, as Size is 0 for a store block
+	Content            []byte `json:"-"`
+
+	raw     []byte // Exact archive bytes of the block, including its separator (set by the parsers)
+	compact bool   // The block's metadata was a single compactMetaLabel line (set by the v1 parser)
+}
+
+// Warning is a non-fatal problem encountered during a run.
+type Warning struct {
+	Kind    string `json:"kind"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+// Warning kinds.
+const (
+	warnUnreadable  = "unreadable"
+	warnInvalidGlob = "invalid-glob"
+	warnBinarySkip  = "binary-skip"
+	warnSpecialFile = "special-file"
+	warnMetadata    = "metadata"
+	warnSymlink     = "symlink"
+	warnPermission  = "permission"
+	warnPath        = "path"
+	warnOutput      = "output"
+	warnSkipped     = "skipped"
+	warnOption      = "option"
+)
+
+// RunResult accumulates the outcome of a pack or unpack run.
+type RunResult struct {
+	Warnings []Warning
+	Events   []RunEvent // Only recorded with --report
+	Started  time.Time
+}
+
+// RunEvent is one entry of the --report run log: what happened to a file, and why.
+type RunEvent struct {
+	Time   string `json:"time"`
+	Action string `json:"action"`
+	Path   string `json:"path,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Event actions recorded for --report. Warnings whose message starts with "Skipping" are
+// recorded as eventSkipped, the others as eventWarning.
+const (
+	eventPacked      = "packed"
+	eventRestored    = "restored"
+	eventOverwritten = "overwritten"
+	eventUnchanged   = "unchanged"
+	eventKept        = "kept"
+	eventRenamed     = "renamed"
+	eventSkipped     = "skipped"
+	eventWarning     = "warning"
+	eventFailed      = "failed"
+)
+
+// Formats accepted by --report-format.
+const (
+	reportJSON = "json"
+	reportCSV  = "csv"
+)
+
+// currentRun collects the results of the command being executed.
+var currentRun RunResult
+
+// languageByExtension maps lower-cased file extensions to the language hint stored with
+// 'pack --language'. Entries can be added or overridden with --language-map.
+var languageByExtension = map[string]string{
+	".go": "go", ".py": "python", ".js": "javascript", ".mjs": "javascript", ".cjs": "javascript",
+	".jsx": "javascript", ".ts": "typescript", ".tsx": "typescript", ".java": "java", ".kt": "kotlin",
+	".c": "c", ".h": "c", ".cc": "cpp", ".cpp": "cpp", ".hpp": "cpp", ".cs": "csharp",
+	".rs": "rust", ".rb": "ruby", ".php": "php", ".swift": "swift", ".scala": "scala",
+	".sh": "shell", ".bash": "shell", ".zsh": "shell", ".ps1": "powershell", ".bat": "batch",
+	".lua": "lua", ".pl": "perl", ".r": "r", ".sql": "sql", ".html": "html", ".htm": "html",
+	".css": "css", ".scss": "scss", ".md": "markdown", ".json": "json", ".yaml": "yaml",
+	".yml": "yaml", ".toml": "toml", ".xml": "xml", ".ini": "ini", ".txt": "text",
+}
+
+// languageByFilename maps lower-cased base names without a telling extension to a language hint.
+var languageByFilename = map[string]string{
+	"makefile": "makefile", "dockerfile": "dockerfile", "go.mod": "go-mod", "go.sum": "go-sum",
+}
+
+// languageByInterpreter maps shebang interpreters to a language hint.
+var languageByInterpreter = map[string]string{
+	"sh": "shell", "bash": "shell", "zsh": "shell", "dash": "shell", "python": "python",
+	"python3": "python", "node": "javascript", "ruby": "ruby", "perl": "perl", "pwsh": "powershell",
 }
 
 func main() {
@@ -88,14 +390,97 @@ func main() {
 	packCmd.BoolVar(&packToClipboard, "b", false, "Short for --clipboard.")
 	packCmd.StringVar(&packOutputFile, "output-file", "", "Output filename for concatenation.")
 	packCmd.StringVar(&packOutputFile, "o", "", "Short for --output-file.")
+	var packOutputToTemp bool
+	packCmd.BoolVar(&packOutputToTemp, "output-to-temp", false, "Write to a new temporary file and print only its path to stdout (progress goes to stderr). The directory can be set with $"+tempDirEnv+".")
+	packCmd.BoolVar(&packSelect, "select", false, "Show the files that would be packed as a checklist on the terminal and pack only those left selected. Requires an interactive terminal.")
+	packCmd.BoolVar(&packDryRun, "dry-run", false, "Print the ordered list of files that would be packed, with their sizes, without packing or writing anything.")
+	packCmd.BoolVar(&packFollowGitignore, "follow-gitignore-in-subdirs", false, "Outside a git repository, honor .gitignore files at every level of the scanned tree, with git's negation and directory scoping rules.")
 	packCmd.StringVar(&packExcludePatterns, "exclude", "", "Comma-separated glob patterns for files/paths to exclude (e.g., '*.md,temp/*').")
 	packCmd.StringVar(&packExcludePatterns, "e", "", "Short for --exclude.")
 	packCmd.StringVar(&packFilterPatterns, "filter", "", "Comma-separated glob patterns to include; only files matching these patterns will be considered.")
 	packCmd.StringVar(&packFilterPatterns, "f", "", "Short for --filter.")
+	var packOnlyExt string
+	packCmd.StringVar(&packOnlyExt, "only-ext", "", "Comma-separated file extensions to include, matched case-insensitively (e.g., 'go,md,ts'). Adds to --filter: files matching either are considered.")
 	// packCmd.StringVar(&packIncludePatterns, "include", "", "Comma-separated glob patterns to force inclusion. Files matching these patterns will bypass most other exclusion rules (e.g., common binary extensions, byte-signature checks). Use with caution!") // REMOVED
 	// packCmd.StringVar(&packIncludePatterns, "i", "", "Short for --include.") // REMOVED
 	packCmd.StringVar(&workingDirPath, "working-dir", "", "Specify the directory to operate within instead of the current directory.")
 	packCmd.StringVar(&workingDirPath, "w", "", "Short for --working-dir.")
+	var packWalkRoot string
+	var packPathPrefixStr string
+	packCmd.StringVar(&packPathPrefixStr, "path-prefix", "", "Pack only files under this directory, relative to the root (e.g., 'services/api'). Stored paths keep the prefix; use --walk-root to store them relative to the directory instead.")
+	var packFromTar, packFromZip string
+	packCmd.StringVar(&packFromTar, "from-tar", "", "Pack the entries of this tar archive (optionally gzip-compressed) instead of the filesystem, with the same filters and binary detection; paths and executable bits come from its headers.")
+	packCmd.StringVar(&packFromZip, "from-zip", "", "Pack the entries of this zip archive instead of the filesystem, like --from-tar.")
+	packCmd.StringVar(&packWalkRoot, "walk-root", "", "Directory to scan, relative to --working-dir if given; stored paths are relative to it. Unlike --working-dir alone, --split-by-dir's default outputs stay in the current (or --working-dir) directory.")
+	packCmd.BoolVar(&summaryFlag, "summary", false, "Print every warning again in a consolidated summary at the end of the run.")
+	packCmd.StringVar(&reportFile, "report", "", "Write a log of the run to this file for auditing: every file packed, skipped (with the reason) or failed, plus totals and timing.")
+	packCmd.StringVar(&reportFormat, "report-format", "", "Format of --report: 'json' or 'csv' (default: 'csv' for a .csv file, 'json' otherwise).")
+	packCmd.BoolVar(&profileFlag, "profile", false, "Print the time spent walking, sniffing, reading, encoding and writing at the end of the run.")
+	packCmd.DurationVar(&clipboardTimeout, "clipboard-timeout", 0, "Abort if the clipboard backend does not respond within this duration (e.g., 30s). 0 waits indefinitely.")
+	packCmd.BoolVar(&packClipboardViaTemp, "clipboard-via-temp", false, "With --clipboard/-b, stream the archive to a temporary file and copy that file to the clipboard, instead of building it in memory. The directory can be set with $"+tempDirEnv+".")
+	packCmd.BoolVar(&packCompress, "compress", false, "Gzip the output file (named '.paktxt.gz'). unpack, list and info read compressed archives transparently.")
+	packCmd.StringVar(&packOutputEncoding, "output-encoding", encodingUTF8, "Encoding of the whole archive: 'utf8', 'utf8-bom' (prepend a byte order mark for Windows editors) or 'base64' (for channels that mangle text). unpack, list and info detect it.")
+	packCmd.StringVar(&packFormat, "format", formatV1, "Archive format: 'v1' (delimited blocks) or 'v2' (length-prefixed blocks with JSON headers).")
+	packCmd.StringVar(&storeDir, "store", "", "Write file contents to this content-addressable store directory (objects named by their digest) and only reference them from the archive, so snapshots share unchanged files. Unpack with the same --store.")
+	packCmd.StringVar(&packHashAlgo, "hash-algo", defaultHashAlgo, "Digest naming --store objects; only 'sha256' for now. It is recorded with each reference, so unpack verifies each object with the algorithm it names.")
+	packCmd.BoolVar(&packCompactMetadata, "compact-metadata", false, "In the v1 format, write each block's metadata as a single 'meta: key=value;...' line instead of one labeled line per field.")
+	var packLanguageMap string
+	packCmd.BoolVar(&packLanguageHints, "language", false, "Store a 'language:' hint for each file, inferred from its extension or shebang.")
+	packCmd.StringVar(&packLanguageMap, "language-map", "", "Comma-separated ext=language pairs extending the --language map (e.g., '.tpl=html,.jsonc=json').")
+	packCmd.BoolVar(&packResolveSymlinks, "resolve-relative-symlinks", false, "Store symlinks pointing inside the packed tree as relative links (recreated on unpack); embed the content of symlinks pointing outside it.")
+	packCmd.BoolVar(&packMarkdown, "markdown", false, "Produce a read-only markdown document with one fenced code block per file instead of an archive (cannot be unpacked).")
+	packCmd.BoolVar(&packModTime, "modtime", false, "Store each file's modification time with a 'modtime:' label; unpack restores it.")
+	var packTimestampStr string
+	packCmd.StringVar(&packTimestampStr, "timestamp", "", "With --modtime, record this time (Unix seconds or RFC 3339) for every file, for reproducible archives. Overrides SOURCE_DATE_EPOCH.")
+	packCmd.BoolVar(&packTrimWhitespace, "trim-whitespace", false, "Remove trailing spaces and tabs from every line and collapse runs of 3 or more blank lines into one, to save tokens when sharing with an LLM. The output is marked as not restorable.")
+	packCmd.Func("replace", "Literal 'OLD=NEW' substitution in the stored content of every file, split at the first '=' (repeatable; applied in order).", func(spec string) error {
+		r, err := parseReplacement(spec)
+		packReplacements = append(packReplacements, r)
+		return err
+	})
+	packCmd.BoolVar(&packStripComments, "strip-comments", false, "Best effort: remove comments from Go, JavaScript/TypeScript, Python and shell files to save space when sharing with an LLM. The output is marked as not restorable.")
+	var packPreserveBOM bool
+	packCmd.BoolVar(&packPreserveBOM, "preserve-bom", false, "Record UTF-8 byte order marks with a 'bom: true' label so unpack restores them (default behavior).")
+	packCmd.BoolVar(&packStripBOM, "strip-bom", false, "Drop UTF-8 byte order marks instead of recording them with a 'bom: true' label.")
+	packCmd.BoolVar(&packSplitByDir, "split-by-dir", false, "Write one archive per immediate subdirectory of the working directory. --output-file becomes a template where '{dir}' is replaced by the subdirectory name (default '{dir}.paktxt').")
+	var packUntrackedOnly, packModifiedOnly, packTrackedOnly bool
+	packCmd.BoolVar(&packUntrackedOnly, "untracked-only", false, "Inside a git repository, pack only untracked files that are not ignored.")
+	packCmd.BoolVar(&packModifiedOnly, "modified-only", false, "Inside a git repository, pack only files with staged or unstaged modifications.")
+	packCmd.BoolVar(&packTrackedOnly, "tracked-only", false, "Inside a git repository, pack only files known to git (committed or staged), leaving out untracked files.")
+	packCmd.BoolVar(&packGitAttributes, "respect-gitattributes", false, "Inside a git repository, leave out paths marked 'export-ignore' in .gitattributes, like 'git archive'.")
+	var packRedactPaths bool
+	packCmd.BoolVar(&packRedactPaths, "redact-paths", false, "Replace directory and file names with generic ones (dir1/file1.go), keeping extensions.")
+	packCmd.StringVar(&packRedactMapFile, "redact-map", "", "With --redact-paths, write the redacted-to-original path mapping to this JSON file.")
+	packCmd.BoolVar(&packAppend, "append", false, "Append new blocks to an existing --output-file instead of overwriting it. Files already in the archive are skipped.")
+	packCmd.BoolVar(&packBinaryExtOnly, "exclude-binary-ext-only", false, "Detect binary files by extension only, skipping the per-file signature read. Faster on very large trees, but extension-less binaries may be included.")
+	packCmd.BoolVar(&packAbsolutePaths, "absolute-paths", false, "Store absolute paths in 'filename:' instead of paths relative to the working directory (restore with 'unpack --allow-absolute').")
+	var packDiffWith string
+	packCmd.StringVar(&packDiffWith, "diff-with", "", "Only pack files that are new or differ from their block in this base archive, producing a delta archive.")
+	var packSinceArchive string
+	packCmd.StringVar(&packSinceArchive, "since-archive", "", "Like --diff-with for backup chains: files whose size and modtime match the base (packed with --modtime) are skipped without being read, and the base's identity is recorded in the archive.")
+	var packSignKeyFile string
+	packCmd.StringVar(&packSignKeyFile, "sign", "", "Append an ed25519 signature trailer using this private key file (see 'paktxt keygen').")
+	var packTextExt string
+	packCmd.StringVar(&packTextExt, "text-ext", "", "Comma-separated extensions to always treat as text, skipping the binary signature check (e.g., '.tpl,.jsonc').")
+	var packTextFile string
+	packCmd.StringVar(&packTextFile, "text-file", "", "Comma-separated exact relative paths to always treat as text, bypassing both the extension blocklist and the signature check (e.g., 'testdata/fixture.bin').")
+	var packContentRegexStr string
+	packCmd.StringVar(&packContentRegexStr, "exclude-content-regex", "", "Exclude files whose content matches this regular expression (e.g., '@generated'). Reads every candidate file in full, so it is slower on large trees.")
+	packCmd.BoolVar(&packIncludePaktxt, "include-paktxt", false, "Pack other .paktxt archives (and files starting with a paktxt header) as regular files instead of skipping them. The output file itself is still left out.")
+	packCmd.IntVar(&packMaxLineLength, "max-line-length", 0, "Skip files with a line longer than this many bytes, such as minified assets. 0 disables.")
+	var packOutputModeStr string
+	packCmd.StringVar(&packOutputModeStr, "output-mode", "", "Octal permissions for the written archive (e.g., 0600 for archives with secrets), instead of 0644 less the umask. Applied regardless of the umask.")
+	packCmd.IntVar(&packReadRetries, "read-retries", 0, "Retry a file that fails to read up to this many times before skipping it with a warning, for network mounts or busy disks.")
+	packCmd.DurationVar(&packReadRetryDelay, "read-retry-delay", packReadRetryDelay, "Wait before the first --read-retries attempt; the wait doubles for each further attempt.")
+	packCmd.IntVar(&packMaxTotalBytes, "max-total-bytes", 0, "Exact size limit for the archive in bytes: files are added in pack order until the next one would not fit, and the rest are listed as omitted. 0 disables.")
+	packCmd.Int64Var(&packMinFileSize, "min-file-size", 0, "Skip files smaller than this many bytes, such as stubs and placeholders. 0 disables.")
+	packCmd.Int64Var(&packMaxFileSize, "max-file-size", 0, "Skip files larger than this many bytes. Combine with --min-file-size to select a size band. 0 disables.")
+	packCmd.BoolVar(&packExcludeEmpty, "exclude-if-empty", false, "Exclude zero-byte files such as '.gitkeep' placeholders or empty '__init__.py' files.")
+	packCmd.BoolVar(&packExcludeTests, "exclude-test-files", false, "Leave out test files, as recognized by --test-patterns, for an archive of production code only.")
+	packCmd.BoolVar(&packOnlyTests, "only-test-files", false, "Pack only test files, as recognized by --test-patterns.")
+	var packTestPatternsStr string
+	packCmd.StringVar(&packTestPatternsStr, "test-patterns", "", "Comma-separated rules that replace the built-in test file conventions for --exclude-test-files and --only-test-files: globs as for --exclude, and directory names ending in '/' that match at any depth (default '"+strings.Join(defaultTestPatterns, ",")+"').")
+	packCmd.Float64Var(&packExcludePercentile, "exclude-above-percentile", 0, "Exclude files larger than the given size percentile of the collected files (e.g., 99). 0 disables.")
 	packCmd.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s pack [flags]\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Packs files and outputs to clipboard or a specified file.\n\n")
@@ -106,11 +491,60 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  %s pack -b                   # Short form of the above.\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s pack --output-file my_project.paktxt # Pack files and write to my_project.paktxt.\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s pack -o my_project.paktxt  # Short form of the above.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --output-to-temp       # Write to a temp file and print its path (for editor plugins).\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack -b --clipboard-via-temp # Stream through a temp file to copy a large tree with less memory.\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s pack -e '*.log,*.tmp' -o my_project.paktxt # Exclude log/tmp files.\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s pack -f '*.go,*.md' -o my_project.paktxt # Only include Go and Markdown files.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --only-ext go,md -o my_project.paktxt # The same, without glob syntax.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --dry-run -e 'testdata/*' # Check which files a pack would include.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --select -b              # Pick the files to pack from a checklist.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --max-total-bytes 1000000 -b # Stay under a 1 MB payload limit.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --output-mode 0600 -o secrets.paktxt # Keep an archive of config files private.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --read-retries 3 -o share.paktxt # Ride out transient read errors on a network mount.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --follow-gitignore-in-subdirs -o src.paktxt # Skip ignored files in an exported tree without .git.\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s pack -e 'node_modules/*' -f '*.js,*.ts' -b # Exclude node_modules but only pack JS/TS files.\n", os.Args[0])
 		// fmt.Fprintf(os.Stderr, "  %s pack -i 'my_binary_script' -b # Force inclusion of a specific binary script.\n", os.Args[0]) // REMOVED
 		fmt.Fprintf(os.Stderr, "  %s pack -w /path/to/project -b  # Operate in a specific directory.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --walk-root /some/project -o project.paktxt # Scan another directory, writing here.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --path-prefix services/api -o api.paktxt # Only one module of a larger repo, paths unchanged.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --store ~/snapshots/store -o ~/snapshots/$(date +%%F).paktxt # Snapshot, storing each distinct file once.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --format v2 -o my_project.paktxt # Use the length-prefixed v2 format.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --compact-metadata -o my_project.paktxt # One metadata line per block, for many small files.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --compress -o snapshot   # Write a gzip-compressed snapshot.paktxt.gz.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --output-encoding base64 -b # Survive chat or mail systems that rewrite whitespace.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --language -o my_project.paktxt # Record a language hint per file.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --modtime -o backup.paktxt # Record modification times for 'unpack --on-conflict newer'.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --modtime --timestamp 2024-01-01T00:00:00Z -o release.paktxt # Pin every modtime for reproducible output.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --exclude-above-percentile 99 -b # Drop the largest 1%% of files.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --resolve-relative-symlinks -o my_project.paktxt # Keep internal symlinks as links.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --markdown -o overview.md # Write a browsable markdown overview (not restorable).\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --exclude-binary-ext-only -o huge.paktxt # Skip signature sniffing on a very large tree.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --text-ext '.tpl,.dat' -b # Never sniff these extensions for binary content.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --text-file testdata/golden.bin -b # Pack one misclassified file.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --profile -o huge.paktxt # Show how long walking, sniffing, reading and writing took.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --from-tar release.tar.gz -o release.paktxt # Convert a tarball, keeping only its text files.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack -o release.paktxt --report audit/pack.json # Log every packed and skipped file for auditing.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --strip-comments -b    # Share code without comments (not restorable).\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --trim-whitespace -b   # Drop trailing spaces and long blank runs (not restorable).\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --exclude-content-regex '@generated' -b # Skip generated files.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --exclude-if-empty -b    # Leave out placeholders like .gitkeep.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --exclude-test-files -b  # Production code only, for a review of the app logic.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --only-test-files --test-patterns '*_test.go,it/' -b # Just the tests, by custom rules.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --min-file-size 200 --max-file-size 100000 -b # Only files between 200 B and 100 kB.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --max-line-length 2000 -b # Skip minified files with very long lines.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --include-paktxt -w examples -o examples.paktxt # Pack a directory of example archives.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --untracked-only -b      # Share new, not yet committed files.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --modified-only -b       # Share files changed since the last commit.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --tracked-only -o repo.paktxt # Pack what is in the repository, without local scratch files.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --respect-gitattributes -o release.paktxt # Match 'git archive' contents.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --redact-paths --redact-map map.json -o shared.paktxt # Anonymize file names.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --absolute-paths -w ~/.config -o config-backup.paktxt # Record exact file locations.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --diff-with base.paktxt -o delta.paktxt # Pack only what changed since base.paktxt.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --since-archive full.paktxt -o incr.paktxt # Incremental backup against a --modtime snapshot.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --sign release.key -o release.paktxt # Sign the archive for 'unpack --verify-sig'.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --append -f 'docs/*' -o my_project.paktxt # Add more files to an existing archive.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --split-by-dir -w ~/workspace # Write one <subdir>.paktxt per project.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s pack --split-by-dir -o 'snapshots/{dir}.paktxt' # Choose where per-directory archives go.\n", os.Args[0])
 	}
 
 	unpackCmd := flag.NewFlagSet("unpack", flag.ExitOnError)
@@ -127,10 +561,64 @@ func main() {
 	unpackCmd.StringVar(&unpackExcludePatterns, "e", "", "Short for --exclude.")
 	unpackCmd.StringVar(&unpackFilterPatterns, "filter", "", "Comma-separated glob patterns to include; only files matching these patterns will be restored.")
 	unpackCmd.StringVar(&unpackFilterPatterns, "f", "", "Short for --filter.")
+	var unpackPathPrefixStr string
+	unpackCmd.StringVar(&unpackPathPrefixStr, "path-prefix", "", "Restore only blocks whose filename is under this directory (e.g., 'services/api'), keeping their full paths.")
 	// unpackCmd.StringVar(&unpackIncludePatterns, "include", "", "Comma-separated glob patterns to force inclusion during restoration. Files matching these patterns will bypass user-defined --exclude patterns. Use with caution!") // REMOVED
 	// unpackCmd.StringVar(&unpackIncludePatterns, "j", "", "Short for --include.") // REMOVED (re-used 'j' from previous change)
 	unpackCmd.StringVar(&workingDirPath, "working-dir", "", "Specify the directory to operate within instead of the current directory.")
 	unpackCmd.StringVar(&workingDirPath, "w", "", "Short for --working-dir.")
+	unpackCmd.BoolVar(&strictParse, "strict-parse", false, "Treat unexpected metadata lines, missing required labels and malformed framing as errors (reporting the byte offset) instead of warnings.")
+	unpackCmd.BoolVar(&summaryFlag, "summary", false, "Print every warning again in a consolidated summary at the end of the run.")
+	unpackCmd.StringVar(&reportFile, "report", "", "Write a log of the run to this file for auditing: every file restored, overwritten, kept, skipped (with the reason) or failed, plus totals and timing.")
+	unpackCmd.StringVar(&reportFormat, "report-format", "", "Format of --report: 'json' or 'csv' (default: 'csv' for a .csv file, 'json' otherwise).")
+	unpackCmd.BoolVar(&profileFlag, "profile", false, "Print the time spent parsing the archive and writing files at the end of the run.")
+	unpackCmd.DurationVar(&clipboardTimeout, "clipboard-timeout", 0, "Abort if the clipboard backend does not respond within this duration (e.g., 30s). 0 waits indefinitely.")
+	var unpackPreserveBOM bool
+	unpackCmd.BoolVar(&unpackPreserveBOM, "preserve-bom", false, "Re-prepend the UTF-8 byte order mark to files recorded with 'bom: true' (default behavior).")
+	unpackCmd.BoolVar(&unpackStripBOM, "strip-bom", false, "Restore files without their recorded UTF-8 byte order mark.")
+	unpackCmd.BoolVar(&unpackRelocate, "relocate-on-collision", false, "Restore into 'name (1).ext', 'name (2).ext', ... instead of overwriting existing files or earlier blocks with the same name.")
+	unpackCmd.StringVar(&unpackOnConflict, "on-conflict", conflictOverwrite, "What to do when a restored file already exists: 'overwrite' (or 'archive-wins'), 'skip' (or 'disk-wins'), or 'newer' to replace it only if the archived 'modtime:' is more recent (blocks without one are compared by content).")
+	var unpackNoClobber bool
+	unpackCmd.BoolVar(&unpackNoClobber, "no-clobber", false, "Never overwrite existing files, like 'cp -n' (same as --on-conflict skip).")
+	unpackCmd.BoolVar(&unpackNoClobber, "n", false, "Short for --no-clobber.")
+	unpackCmd.BoolVar(&unpackSkipUnchanged, "skip-unchanged", false, "Leave existing files whose content already matches the archive completely untouched, whatever the --on-conflict policy. Needs no metadata in the archive.")
+	unpackCmd.BoolVar(&unpackReverse, "reverse-restore", false, "Write files in reverse archive order (last block first). For duplicate names, the first block then wins.")
+	unpackCmd.IntVar(&unpackJobs, "jobs", 1, "Number of files to write concurrently. Values above 1 can speed up archives of many small files on fast storage, but files are no longer written in archive order.")
+	unpackCmd.IntVar(&unpackJobs, "j", 1, "Short for --jobs.")
+	unpackCmd.StringVar(&unpackLineEnding, "line-ending", lineEndingPreserve, "Line endings of restored text files: 'preserve' the stored bytes, or convert all to 'lf' or 'crlf'. Files containing NUL bytes are left alone.")
+	unpackCmd.BoolVar(&unpackAutoExec, "auto-exec", false, "Set the executable bit on restored files that start with a shebang ('#!'), regardless of the stored 'executable:' value.")
+	var unpackExecGlob string
+	unpackCmd.StringVar(&unpackExecGlob, "executable-glob", "", "Comma-separated glob patterns of restored files to mark executable, in addition to the stored 'executable:' value (e.g., '*.sh,bin/*').")
+	var unpackRedactMapFile string
+	unpackCmd.StringVar(&unpackRedactMapFile, "redact-map", "", "Restore original paths of a --redact-paths archive using the JSON mapping written by 'pack --redact-map'.")
+	var unpackToTar bool
+	unpackCmd.StringVar(&storeDir, "store", "", "Content store holding the file contents of an archive packed with --store.")
+	unpackCmd.BoolVar(&unpackToTar, "to-tar", false, "Write the archive's files as a tar stream to stdout instead of restoring them (progress goes to stderr), e.g. to pipe into 'tar -x'.")
+	unpackCmd.BoolVar(&unpackGitAdd, "git-add", false, "Inside a git repository, run 'git add' on each restored file.")
+	unpackCmd.StringVar(&unpackGitCommitMsg, "git-commit", "", "Inside a git repository, stage and commit the restored files with the given message (implies --git-add).")
+	unpackCmd.BoolVar(&unpackAllowAbsolute, "allow-absolute", false, "Restore blocks with absolute filenames (from 'pack --absolute-paths') to those exact locations instead of skipping them.")
+	var unpackDirModeStr string
+	var unpackUmaskStr string
+	unpackCmd.StringVar(&unpackUmaskStr, "umask", "", "Octal mask (e.g., 077) removed from the permissions of restored files and directories, in addition to the process umask, which is always applied.")
+	unpackCmd.StringVar(&unpackDirModeStr, "dir-mode", "", "Octal permissions for directories created by the restore (e.g., 0700), instead of 0755. Existing directories are left alone.")
+	unpackCmd.BoolVar(&unpackLowerNames, "ignore-case-filenames", false, "Restore every relative path (and symlink target) in lower case, reporting each renamed file. Useful when importing into a case-insensitive filesystem.")
+	unpackCmd.BoolVar(&unpackForce, "force", false, "Overwrite read-only files by making them writable for the write; their previous permissions are put back afterwards.")
+	unpackCmd.BoolVar(&unpackPruneEmpty, "prune-empty", false, "After restoring, remove directories created by this run that ended up without any files (e.g., after a failed write).")
+	unpackCmd.BoolVar(&unpackTouchOnly, "touch-only", false, "Leave files whose content already matches the archive untouched, only syncing their modification time to the archived 'modtime:' and their executable bit.")
+	unpackCmd.Func("require", "Glob pattern that at least one archived file must match, or nothing is restored (repeatable, e.g., --require go.mod --require 'cmd/*').", func(pattern string) error {
+		unpackRequire = append(unpackRequire, pattern)
+		return nil
+	})
+	var unpackVerifyKeyFile string
+	unpackCmd.StringVar(&unpackVerifyKeyFile, "verify-sig", "", "Require a valid ed25519 signature trailer made with the private key matching this public key file; nothing is restored otherwise.")
+	unpackCmd.Func("replace", "Literal 'OLD=NEW' substitution in the content of every restored file, split at the first '=' (repeatable; applied in order, after --content-filter).", func(spec string) error {
+		r, err := parseReplacement(spec)
+		unpackReplacements = append(unpackReplacements, r)
+		return err
+	})
+	unpackCmd.StringVar(&unpackContentFilter, "content-filter", "", "Shell command each restored file's content is piped through before writing (e.g., 'envsubst'). Runs arbitrary code on archive content; the file name is in $PAKTXT_FILENAME.")
+	unpackCmd.DurationVar(&unpackFilterTimeout, "content-filter-timeout", unpackFilterTimeout, "Abort if --content-filter takes longer than this for a single file. 0 waits indefinitely.")
+	unpackCmd.StringVar(&unpackPostCmd, "post-unpack", "", "Shell command to run in the working directory after a successful restore (e.g., 'npm install'). Runs arbitrary code; the unpack fails if it exits non-zero.")
 	unpackCmd.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s unpack [flags]\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Restores files from clipboard or a specified .paktxt file.\n\n")
@@ -144,15 +632,165 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  %s unpack -e 'my_secrets.txt,temp_config/*' -b # Unpack from clipboard, excluding sensitive files.\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s unpack -f '*.html,*.css' -b  # Only restore HTML and CSS files.\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s unpack -w /new/location -b  # Operate in a specific directory.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i generated.paktxt --strict-parse # Fail on any non-conformant block.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i config-backup.paktxt --allow-absolute # Restore files to their recorded absolute paths.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i big.paktxt -f 'docs/*' --prune-empty # Restore a subset without leaving empty directories.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i deploy.paktxt --require go.mod --require 'cmd/*' # Refuse incomplete archives.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i release.paktxt --verify-sig release.pub # Refuse tampered or unsigned archives.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i huge.paktxt --profile # Show how long parsing and writing took.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i release.paktxt --report audit/unpack.csv # Log every restored, overwritten and skipped file as CSV.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i template.paktxt -n # Only add missing files; keep every existing one.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i theirs.paktxt --relocate-on-collision # Keep both versions of clashing files.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i linux.paktxt --ignore-case-filenames # Restore all names in lower case.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i build.paktxt --touch-only # Avoid rewriting identical files; just sync mtimes.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i generated.paktxt --force # Overwrite files that were made read-only (0444).\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i secrets.paktxt -w ~/.config/app --dir-mode 0700 # Keep created directories private.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i backup.paktxt --on-conflict newer # Keep local files edited after the archive was packed.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i old.paktxt --skip-unchanged # Only rewrite files whose content differs.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i linux.paktxt --line-ending crlf # Restore with Windows line endings.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i my_project.paktxt --to-tar | tar -x -C out # Convert to a tar stream.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i my_project.paktxt --reverse-restore # Write the last archived file first.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i my_project.paktxt --path-prefix services/api # Restore one subtree only.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i ~/snapshots/2024-05-01.paktxt --store ~/snapshots/store # Restore a store-backed snapshot.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i many_files.paktxt -j 8 # Write up to 8 files at a time.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i windows.paktxt --auto-exec # Make restored shebang scripts executable.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i windows.paktxt --executable-glob '*.sh,bin/*' # Make matching files executable.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i patch.paktxt --git-add # Restore and stage the restored files.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i patch.paktxt --git-commit 'Apply patch' # Restore, stage and commit.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i template.paktxt -w app --post-unpack 'npm install' # Bootstrap a project template.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i config.paktxt --content-filter envsubst # Fill in ${VARS} while restoring.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s unpack -i template.paktxt --replace __NAME__=myapp # Fill in a placeholder while restoring.\n", os.Args[0])
 		// fmt.Fprintf(os.Stderr, "  %s unpack -j 'important_backup.bak' -b # Force restoration of a file that would normally be excluded.\n", os.Args[0]) // REMOVED
 	}
 
+	infoCmd := flag.NewFlagSet("info", flag.ExitOnError)
+	var infoFromClipboard bool
+	var infoPaktxtFile string
+	var infoFile string
+	infoCmd.BoolVar(&infoFromClipboard, "clipboard", false, "Read the archive from clipboard.")
+	infoCmd.BoolVar(&infoFromClipboard, "b", false, "Short for --clipboard.")
+	infoCmd.StringVar(&infoPaktxtFile, "paktxt-file", "", "Input .paktxt filename to inspect.")
+	infoCmd.StringVar(&infoPaktxtFile, "i", "", "Short for --paktxt-file.")
+	infoCmd.DurationVar(&clipboardTimeout, "clipboard-timeout", 0, "Abort if the clipboard backend does not respond within this duration (e.g., 30s). 0 waits indefinitely.")
+	infoCmd.BoolVar(&strictParse, "strict-parse", false, "Treat any non-conformant archive content as an error, reporting the byte offset.")
+	infoCmd.StringVar(&infoFile, "file", "", "Path of the archived file whose metadata should be printed.")
+	var infoTokens bool
+	var infoTokenizer string
+	var infoTop int
+	infoCmd.BoolVar(&infoTokens, "tokens", false, "Instead of --file, estimate the LLM tokens of the whole archive and list the files that use the most.")
+	infoCmd.StringVar(&infoTokenizer, "tokenizer", tokenizerEstimate, "With --tokens: 'estimate' (a heuristic of about 4 characters per token, no dependencies), 'tiktoken' (exact cl100k_base counts through python3 and its tiktoken package), or a shell command that reads text on stdin and prints its token count.")
+	infoCmd.IntVar(&infoTop, "top", 10, "With --tokens, the number of files listed, biggest first. 0 lists all.")
+	infoCmd.StringVar(&storeDir, "store", "", "Content store of an archive packed with --store, so that --tokens counts the files kept there.")
+	infoCmd.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s info [flags]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Prints the metadata of a single archived file as JSON, without extracting it.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		infoCmd.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  %s info -i my_archive.paktxt --file src/main.go # Show metadata for src/main.go.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s info -b --file README.md   # Inspect an archive held in the clipboard.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s info -i my_archive.paktxt --tokens # Will it fit a model's context window?\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s info -b --tokens --tokenizer tiktoken --top 0 # Exact counts for every file.\n", os.Args[0])
+	}
+
+	updateCmd := flag.NewFlagSet("update", flag.ExitOnError)
+	var updatePaktxtFile string
+	var updateOutputFile string
+	var updateExcludePatterns string
+	var updateFilterPatterns string
+	var updateSignKeyFile string
+	updateCmd.StringVar(&updatePaktxtFile, "paktxt-file", "", "Existing .paktxt archive to update.")
+	updateCmd.StringVar(&updatePaktxtFile, "i", "", "Short for --paktxt-file.")
+	updateCmd.StringVar(&updateOutputFile, "output-file", "", "Write the updated archive here instead of rewriting the input in place.")
+	updateCmd.StringVar(&updateOutputFile, "o", "", "Short for --output-file.")
+	updateCmd.StringVar(&updateExcludePatterns, "exclude", "", "Comma-separated glob patterns for files/paths to exclude (e.g., '*.md,temp/*').")
+	updateCmd.StringVar(&updateExcludePatterns, "e", "", "Short for --exclude.")
+	updateCmd.StringVar(&updateFilterPatterns, "filter", "", "Comma-separated glob patterns to include; only files matching these patterns will be considered.")
+	updateCmd.StringVar(&updateFilterPatterns, "f", "", "Short for --filter.")
+	updateCmd.StringVar(&updateSignKeyFile, "sign", "", "Sign the updated archive with this ed25519 private key file; an existing signature is removed otherwise.")
+	updateCmd.StringVar(&workingDirPath, "working-dir", "", "Specify the directory to operate within instead of the current directory.")
+	updateCmd.StringVar(&workingDirPath, "w", "", "Short for --working-dir.")
+	updateCmd.BoolVar(&summaryFlag, "summary", false, "Print every warning again in a consolidated summary at the end of the run.")
+	updateCmd.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s update [flags]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Re-scans the working directory and rewrites only the blocks of an existing archive whose files changed.\n")
+		fmt.Fprintf(os.Stderr, "Unchanged blocks stay byte-identical, blocks of deleted files are removed and new files are appended.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		updateCmd.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  %s update -i my_project.paktxt   # Refresh the archive from the current directory.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s update -i old.paktxt -o new.paktxt -w /path/to/project # Write the refreshed archive elsewhere.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s update -i release.paktxt --sign release.key # Keep a signed archive signed.\n", os.Args[0])
+	}
+
+	listCmd := flag.NewFlagSet("list", flag.ExitOnError)
+	listCmd.BoolVar(&strictParse, "strict-parse", false, "Treat any non-conformant archive content as an error, reporting the byte offset.")
+	var listPreview int
+	var listLong bool
+	var listByExt bool
+	var listFilterPatterns, listExcludePatterns string
+	listCmd.IntVar(&listPreview, "preview", 0, "After the table, print the first N lines of each file in the archives.")
+	listCmd.BoolVar(&listLong, "long", false, "After the table, list each file with its size, mode, trailing newline and a short SHA-256 of its content.")
+	listCmd.BoolVar(&listLong, "l", false, "Short for --long.")
+	listCmd.BoolVar(&listByExt, "by-ext", false, "After the table, print the file count and total size per file extension of each archive, largest first.")
+	listCmd.StringVar(&listFilterPatterns, "filter", "", "Comma-separated glob patterns; only preview or list files matching these patterns.")
+	listCmd.StringVar(&listFilterPatterns, "f", "", "Short for --filter.")
+	listCmd.StringVar(&listExcludePatterns, "exclude", "", "Comma-separated glob patterns of files not to preview or list.")
+	listCmd.StringVar(&listExcludePatterns, "e", "", "Short for --exclude.")
+	listCmd.StringVar(&storeDir, "store", "", "Content store of archives packed with --store, so that --preview and --long read the files kept there. Sizes are recorded in the archive and shown without it.")
+	listCmd.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s list [flags] <archive>...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Prints a table with the format, file count and total content size of each archive.\n")
+		fmt.Fprintf(os.Stderr, "Arguments may be glob patterns; invalid archives are reported per file.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		listCmd.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  %s list snapshots/*.paktxt     # Overview of a folder of snapshots.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s list 'snapshots/2024-*.paktxt' # Let paktxt expand the pattern (e.g., on Windows).\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s list --preview 10 -f '*.go' received.paktxt # Skim the Go files of a code dump.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s list --long a.paktxt > a.txt  # Per-file hashes, to diff against another archive's listing.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s list --by-ext received.paktxt # What kinds of files an archive holds.\n", os.Args[0])
+	}
+
+	keygenCmd := flag.NewFlagSet("keygen", flag.ExitOnError)
+	var keygenOutput string
+	keygenCmd.StringVar(&keygenOutput, "output", "", "Path prefix for the key pair; writes <prefix>.key (private) and <prefix>.pub (public).")
+	keygenCmd.StringVar(&keygenOutput, "o", "", "Short for --output.")
+	keygenCmd.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s keygen [flags]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Generates an ed25519 key pair for 'pack --sign' and 'unpack --verify-sig'.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		keygenCmd.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  %s keygen -o release          # Writes release.key and release.pub.\n", os.Args[0])
+	}
+
+	storeGCCmd := flag.NewFlagSet("store-gc", flag.ExitOnError)
+	var storeGCDryRun bool
+	storeGCCmd.StringVar(&storeDir, "store", "", "Content store directory to prune.")
+	storeGCCmd.BoolVar(&storeGCDryRun, "dry-run", false, "List the unreferenced objects without removing them.")
+	storeGCCmd.BoolVar(&storeGCDryRun, "n", false, "Short for --dry-run.")
+	storeGCCmd.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s store-gc --store DIR [flags] <archive>...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Removes objects of a 'pack --store' content store that none of the given archives (or glob patterns) reference.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		storeGCCmd.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  %s store-gc --store store 'snapshots/*.paktxt' # Keep only what the remaining snapshots use.\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s store-gc --store store -n 'snapshots/*.paktxt' # Show what would be removed.\n", os.Args[0])
+	}
+
 	defaultUsage := func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "paktxt is a versatile command-line tool to consolidate and restore text-based files.\n\n")
 		fmt.Fprintf(os.Stderr, "Commands:\n")
-		fmt.Fprintf(os.Stderr, "  pack    Consolidate files and output (to clipboard or file).\n")
-		fmt.Fprintf(os.Stderr, "  unpack  Restore files from input (from clipboard or .paktxt file).\n\n")
+		fmt.Fprintf(os.Stderr, "  pack      Consolidate files and output (to clipboard or file).\n")
+		fmt.Fprintf(os.Stderr, "  unpack    Restore files from input (from clipboard or .paktxt file).\n")
+		fmt.Fprintf(os.Stderr, "  update    Refresh an existing archive with changes from the working directory.\n")
+		fmt.Fprintf(os.Stderr, "  info      Print an archived file's metadata as JSON.\n")
+		fmt.Fprintf(os.Stderr, "  list      Summarize one or more archives in a table.\n")
+		fmt.Fprintf(os.Stderr, "  keygen    Generate an ed25519 key pair for signing archives.\n")
+		fmt.Fprintf(os.Stderr, "  store-gc  Remove content store objects no archive references.\n\n")
 		fmt.Fprintf(os.Stderr, "Global Flags:\n")
 		rootFlags.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nRun '%s <command> --help' for more information on a command.\n", os.Args[0])
@@ -182,800 +820,6331 @@ func main() {
 	switch cmd {
 	case "pack":
 		packCmd.Parse(os.Args[2:])
+		if err := expandPathFlags(&packOutputFile, &workingDirPath, &packWalkRoot); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+			packCmd.Usage()
+			os.Exit(1)
+		}
 		if packToClipboard && packOutputFile != "" {
 			fmt.Fprintf(os.Stderr, "Error: Cannot use --clipboard/-b and --output-file/-o simultaneously with 'pack' command.\n\n")
 			packCmd.Usage()
 			os.Exit(1)
 		}
-		if !packToClipboard && packOutputFile == "" {
+		if packSplitByDir && packToClipboard {
+			fmt.Fprintf(os.Stderr, "Error: --split-by-dir writes one file per directory and cannot be used with --clipboard/-b.\n\n")
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if packOutputToTemp && (packToClipboard || packOutputFile != "" || packSplitByDir || packAppend) {
+			fmt.Fprintf(os.Stderr, "Error: --output-to-temp cannot be combined with --clipboard/-b, --output-file/-o, --split-by-dir or --append.\n\n")
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if packCompress && (packToClipboard || packOutputToTemp || packAppend) {
+			fmt.Fprintf(os.Stderr, "Error: --compress writes a gzip file and cannot be combined with --clipboard/-b, --output-to-temp or --append.\n\n")
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if packClipboardViaTemp && !packToClipboard {
+			fmt.Fprintf(os.Stderr, "Error: --clipboard-via-temp requires --clipboard/-b.\n\n")
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if packMaxTotalBytes < 0 {
+			fmt.Fprintf(os.Stderr, "Error: --max-total-bytes must not be negative.\n\n")
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if packOutputModeStr != "" {
+			mode, err := strconv.ParseUint(packOutputModeStr, 8, 32)
+			if err != nil || mode > 0777 {
+				fmt.Fprintf(os.Stderr, "Error: Invalid --output-mode '%s'; expected octal permissions such as 0600 or 0644.\n\n", packOutputModeStr)
+				packCmd.Usage()
+				os.Exit(1)
+			}
+			packOutputMode = fs.FileMode(mode)
+		} else {
+			packOutputMode = defaultFileMode()
+		}
+		if prefix, err := normalizePathPrefix(packPathPrefixStr); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+			packCmd.Usage()
+			os.Exit(1)
+		} else {
+			packPathPrefix = prefix
+		}
+		if _, ok := hashAlgos[packHashAlgo]; !ok {
+			fmt.Fprintf(os.Stderr, "Error: Unknown --hash-algo '%s'; expected 'sha256'.\n\n", packHashAlgo)
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if packHashAlgo != defaultHashAlgo && storeDir == "" {
+			fmt.Fprintf(os.Stderr, "Error: --hash-algo names the objects of --store and needs it.\n\n")
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if storeDir != "" && packMarkdown {
+			fmt.Fprintf(os.Stderr, "Error: --store cannot be combined with --markdown, which is not an archive.\n\n")
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if err := absStoreDir(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := loadReportOptions(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if packPathPrefix != "" && packSplitByDir {
+			fmt.Fprintf(os.Stderr, "Error: --path-prefix cannot be combined with --split-by-dir, which packs each subdirectory on its own.\n\n")
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if packPreserveBOM && packStripBOM {
+			fmt.Fprintf(os.Stderr, "Error: Cannot use --preserve-bom and --strip-bom simultaneously.\n\n")
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if packExcludeTests && packOnlyTests {
+			fmt.Fprintf(os.Stderr, "Error: Cannot use --exclude-test-files and --only-test-files simultaneously.\n\n")
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if packTestPatternsStr != "" {
+			packTestPatterns = parsePatterns(packTestPatternsStr)
+		}
+		if packMinFileSize < 0 || packMaxFileSize < 0 || (packMaxFileSize > 0 && packMinFileSize > packMaxFileSize) {
+			fmt.Fprintf(os.Stderr, "Error: --min-file-size and --max-file-size must not be negative, and the minimum must not exceed the maximum.\n\n")
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if packReadRetries < 0 || packReadRetryDelay < 0 {
+			fmt.Fprintf(os.Stderr, "Error: --read-retries and --read-retry-delay must not be negative.\n\n")
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if packMaxTotalBytes > 0 && (packAppend || packMarkdown || packCompress || packOutputEncoding != encodingUTF8) {
+			fmt.Fprintf(os.Stderr, "Error: --max-total-bytes limits a plain archive and cannot be combined with --append, --markdown, --compress or --output-encoding.\n\n")
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if packSelect && packSplitByDir {
+			fmt.Fprintf(os.Stderr, "Error: --select cannot be combined with --split-by-dir.\n\n")
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if packSelect && (!isTerminal(os.Stdin) || !isTerminal(os.Stderr)) {
+			fmt.Fprintf(os.Stderr, "Error: --select needs an interactive terminal; use --filter, --exclude or --only-ext in scripts.\n\n")
+			os.Exit(1)
+		}
+		if packDryRun && (packSplitByDir || packOutputToTemp) {
+			fmt.Fprintf(os.Stderr, "Error: --dry-run cannot be combined with --split-by-dir or --output-to-temp.\n\n")
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if !packToClipboard && packOutputFile == "" && !packSplitByDir && !packOutputToTemp && !packDryRun {
 			fmt.Fprintf(os.Stderr, "Error: 'pack' command requires either --clipboard/-b or --output-file/-o.\n\n")
 			packCmd.Usage()
 			os.Exit(1)
 		}
-		// Resolve absolute path for output file before changing working directory
-		var absPackOutputFile string
-		if packOutputFile != "" {
-			var err error
-			absPackOutputFile, err = filepath.Abs(packOutputFile)
+		if packAppend && (packOutputFile == "" || packSplitByDir || packMarkdown || packRedactPaths) {
+			fmt.Fprintf(os.Stderr, "Error: --append requires --output-file/-o and cannot be combined with --split-by-dir, --markdown or --redact-paths.\n\n")
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if packAppend && (packStripComments || packTrimWhitespace) {
+			fmt.Fprintf(os.Stderr, "Error: --strip-comments and --trim-whitespace output is not restorable and cannot be appended to an archive.\n\n")
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if packStripComments {
+			warnf(warnOption, "", "--strip-comments: comments are removed and the output is NOT restorable with 'paktxt unpack'.")
+		}
+		if packTrimWhitespace {
+			warnf(warnOption, "", "--trim-whitespace: whitespace is removed and the output is NOT restorable with 'paktxt unpack'.")
+		}
+		if packIncludePaktxt {
+			warnf(warnOption, "", "--include-paktxt: packed archives are stored as plain files; 'unpack' restores them as files and does not unpack their contents.")
+		}
+		if packDiffWith != "" {
+			if packSplitByDir {
+				fmt.Fprintf(os.Stderr, "Error: --diff-with cannot be combined with --split-by-dir.\n\n")
+				packCmd.Usage()
+				os.Exit(1)
+			}
+			base, _, err := loadDiffBase(packDiffWith, "--diff-with")
 			if err != nil {
-				fmt.Printf("Error resolving absolute path for output file: %v\n", err)
+				fmt.Printf("Error: %v\n", err)
 				os.Exit(1)
 			}
+			packDiffBase = base
 		}
-
-		if workingDirPath != "" {
-			if err := changeWorkingDir(workingDirPath); err != nil {
+		if packSinceArchive != "" {
+			if packDiffWith != "" || packSplitByDir || packAppend || packMarkdown || packStripComments || packTrimWhitespace {
+				fmt.Fprintf(os.Stderr, "Error: --since-archive cannot be combined with --diff-with, --split-by-dir, --append, --markdown, --strip-comments or --trim-whitespace.\n\n")
+				packCmd.Usage()
 				os.Exit(1)
 			}
+			base, digest, err := loadDiffBase(packSinceArchive, "--since-archive")
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			packDiffBase = base
+			packBaseRef = fmt.Sprintf("sha256:%x %s", digest, filepath.Base(packSinceArchive))
 		}
-		excludePatternsSlice := parsePatterns(packExcludePatterns)
-		filterPatternsSlice := parsePatterns(packFilterPatterns)
-		// includePatternsSlice := parsePatterns(packIncludePatterns) // REMOVED
-		if err := concatenateAndOutput(packToClipboard, absPackOutputFile, excludePatternsSlice, filterPatternsSlice, nil); err != nil { // Pass nil for includePatterns
-			fmt.Printf("Error during pack operation: %v\n", err)
-			os.Exit(1)
-		}
-	case "unpack":
-		unpackCmd.Parse(os.Args[2:])
-		if unpackFromClipboard && unpackPaktxtFile != "" {
-			fmt.Fprintf(os.Stderr, "Error: Cannot use --clipboard/-b and --paktxt-file/-i simultaneously with 'unpack' command.\n\n")
-			unpackCmd.Usage()
+		if packTimestampStr != "" && !packModTime {
+			fmt.Fprintf(os.Stderr, "Error: --timestamp only applies to the modtimes recorded with --modtime.\n\n")
+			packCmd.Usage()
 			os.Exit(1)
 		}
-		if !unpackFromClipboard && unpackPaktxtFile == "" {
-			fmt.Fprintf(os.Stderr, "Error: 'unpack' command requires either --clipboard/-b or --paktxt-file/-i.\n\n")
-			unpackCmd.Usage()
+		if err := loadTimestampOptions(packTimestampStr); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+			packCmd.Usage()
 			os.Exit(1)
 		}
-		// Resolve absolute path of input file before changing working directory
-		if unpackPaktxtFile != "" && !filepath.IsAbs(unpackPaktxtFile) {
-			absPath, err := filepath.Abs(unpackPaktxtFile)
+		if packSignKeyFile != "" {
+			if packMarkdown || packStripComments || packTrimWhitespace || packClipboardViaTemp {
+				fmt.Fprintf(os.Stderr, "Error: --sign cannot be combined with --markdown, --strip-comments, --trim-whitespace or --clipboard-via-temp.\n\n")
+				packCmd.Usage()
+				os.Exit(1)
+			}
+			seed, err := readKeyFile(packSignKeyFile, ed25519.SeedSize)
 			if err != nil {
-				fmt.Printf("Error resolving absolute path for input file: %v\n", err)
+				fmt.Printf("Error: %v\n", err)
 				os.Exit(1)
 			}
-			unpackPaktxtFile = absPath
+			packSignKey = ed25519.NewKeyFromSeed(seed)
 		}
-		if workingDirPath != "" {
-			if err := changeWorkingDir(workingDirPath); err != nil {
+		if packOutputEncoding != encodingUTF8 && packOutputEncoding != encodingUTF8BOM && packOutputEncoding != encodingBase64 {
+			fmt.Fprintf(os.Stderr, "Error: Unknown --output-encoding '%s'; expected '%s', '%s' or '%s'.\n\n", packOutputEncoding, encodingUTF8, encodingUTF8BOM, encodingBase64)
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if packOutputEncoding != encodingUTF8 && (packAppend || packClipboardViaTemp) {
+			fmt.Fprintf(os.Stderr, "Error: --output-encoding %s cannot be combined with --append or --clipboard-via-temp.\n\n", packOutputEncoding)
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if packFormat != formatV1 && packFormat != formatV2 {
+			fmt.Fprintf(os.Stderr, "Error: Unknown --format '%s'; expected '%s' or '%s'.\n\n", packFormat, formatV1, formatV2)
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if packCompactMetadata && (packFormat != formatV1 || packMarkdown) {
+			fmt.Fprintf(os.Stderr, "Error: --compact-metadata only applies to the v1 format and cannot be combined with --format v2 or --markdown.\n\n")
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if packMarkdown && packFormat != formatV1 {
+			fmt.Fprintf(os.Stderr, "Error: --markdown produces its own presentation format and cannot be combined with --format.\n\n")
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if packRedactMapFile != "" && !packRedactPaths {
+			fmt.Fprintf(os.Stderr, "Error: --redact-map requires --redact-paths.\n\n")
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if packRedactPaths {
+			packRedactor = newPathRedactor()
+			if packRedactMapFile != "" {
+				absMap, err := filepath.Abs(packRedactMapFile)
+				if err != nil {
+					fmt.Printf("Error resolving absolute path for redaction map: %v\n", err)
+					os.Exit(1)
+				}
+				packRedactMapFile = absMap
+			}
+		}
+		if packUntrackedOnly && (packModifiedOnly || packTrackedOnly) {
+			fmt.Fprintf(os.Stderr, "Error: Cannot combine --untracked-only with --modified-only or --tracked-only.\n\n")
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		if packUntrackedOnly {
+			packGitSelection = gitSelectUntracked
+		} else if packModifiedOnly {
+			// Modified files are tracked, so this also covers --tracked-only --modified-only.
+			packGitSelection = gitSelectModified
+		} else if packTrackedOnly {
+			packGitSelection = gitSelectTracked
+		}
+		packInputArchive := packFromTar
+		if packFromZip != "" {
+			packInputArchive = packFromZip
+		}
+		if packInputArchive != "" {
+			if packFromTar != "" && packFromZip != "" {
+				fmt.Fprintf(os.Stderr, "Error: Cannot use --from-tar and --from-zip simultaneously.\n\n")
+				packCmd.Usage()
+				os.Exit(1)
+			}
+			if workingDirPath != "" || packWalkRoot != "" || packSplitByDir || packGitSelection != "" {
+				fmt.Fprintf(os.Stderr, "Error: --from-tar and --from-zip pack an archive instead of a directory and cannot be combined with --working-dir, --walk-root, --split-by-dir or the git selections.\n\n")
+				packCmd.Usage()
+				os.Exit(1)
+			}
+			if err := expandPathFlags(&packInputArchive); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+				packCmd.Usage()
 				os.Exit(1)
 			}
 		}
-		excludePatternsSlice := parsePatterns(unpackExcludePatterns)
-		filterPatternsSlice := parsePatterns(unpackFilterPatterns)
-		// includePatternsSlice := parsePatterns(unpackIncludePatterns) // REMOVED
-		if err := restoreFiles(unpackFromClipboard, unpackPaktxtFile, excludePatternsSlice, filterPatternsSlice, nil); err != nil { // Pass nil for includePatterns
-			fmt.Printf("Error restoring files: %v\n", err)
+		if packExcludePercentile < 0 || packExcludePercentile > 100 {
+			fmt.Fprintf(os.Stderr, "Error: --exclude-above-percentile must be between 0 and 100.\n\n")
+			packCmd.Usage()
 			os.Exit(1)
 		}
-		fmt.Println("Files restored successfully.")
-	default:
-		if !strings.HasPrefix(cmd, "-") {
-			fmt.Fprintf(os.Stderr, "Error: Unknown command '%s'.\n\n", cmd)
-		} else {
-			fmt.Fprintf(os.Stderr, "Error: Invalid flags without a command. Use 'paktxt <command> --help' or 'paktxt --help'.\n\n")
+		for _, ext := range parsePatterns(packTextExt) {
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			textExtensions[strings.ToLower(ext)] = true
 		}
-		defaultUsage()
-		os.Exit(1)
-	}
-}
-
-// Renamed from parseExcludePatterns to be more generic for any pattern list
-func parsePatterns(patterns string) []string {
-	if patterns == "" {
-		return nil
-	}
-	split := strings.Split(patterns, ",")
-	var result []string
-	for _, p := range split {
-		trimmedP := strings.TrimSpace(p)
-		if trimmedP != "" {
-			result = append(result, trimmedP)
+		for _, ext := range parsePatterns(packOnlyExt) {
+			if packOnlyExts == nil {
+				packOnlyExts = make(map[string]bool)
+			}
+			packOnlyExts[strings.ToLower(strings.TrimPrefix(ext, "."))] = true
 		}
-	}
-	return result
-}
+		for _, file := range parsePatterns(packTextFile) {
+			if packTextFiles == nil {
+				packTextFiles = make(map[string]bool)
+			}
+			packTextFiles[path.Clean(filepath.ToSlash(file))] = true
+		}
+		if packBinaryExtOnly {
+			warnf(warnOption, "", "--exclude-binary-ext-only: binary files are detected by extension only; extension-less binaries may be included.")
+		}
+		if packContentRegexStr != "" {
+			re, err := regexp.Compile(packContentRegexStr)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: Invalid --exclude-content-regex: %v\n\n", err)
+				packCmd.Usage()
+				os.Exit(1)
+			}
+			packContentRegex = re
+		}
+		if err := extendLanguageMap(packLanguageMap); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+			packCmd.Usage()
+			os.Exit(1)
+		}
+		// Resolve absolute path for output file before changing working directory
+		var absPackOutputFile string
+		if packOutputFile != "" {
+			var err error
+			absPackOutputFile, err = filepath.Abs(packOutputFile)
+			if err != nil {
+				fmt.Printf("Error resolving absolute path for output file: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		// With --output-to-temp, stdout carries only the resulting path.
+		pathOutput := os.Stdout
+		tempDir := os.Getenv(tempDirEnv)
+		if packOutputToTemp {
+			os.Stdout = os.Stderr
+			if tempDir != "" {
+				tempDir, _ = filepath.Abs(tempDir)
+			}
+		}
+
+		if workingDirPath != "" {
+			if err := changeWorkingDir(workingDirPath); err != nil {
+				os.Exit(1)
+			}
+		}
+		if packWalkRoot != "" {
+			if packSplitByDir && absPackOutputFile == "" {
+				// Keep the per-directory archives out of the scanned tree.
+				outputDir, err := os.Getwd()
+				if err != nil {
+					fmt.Printf("Error determining the output directory: %v\n", err)
+					os.Exit(1)
+				}
+				absPackOutputFile = filepath.Join(outputDir, "{dir}"+paktxtExtension)
+			}
+			if err := changeWorkingDir(packWalkRoot); err != nil {
+				os.Exit(1)
+			}
+		}
+		var packInputDir string // Where --from-tar or --from-zip was extracted
+		if packInputArchive != "" {
+			fmt.Printf("Extracting %s...\n", packInputArchive)
+			dir, err := extractPackInput(packInputArchive, packFromZip != "")
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			packInputDir = dir
+			if err := changeWorkingDir(packInputDir); err != nil {
+				removePackInput(packInputDir)
+				os.Exit(1)
+			}
+		}
+		if packPathPrefix != "" {
+			if info, err := os.Stat(packPathPrefix); err != nil || !info.IsDir() {
+				fmt.Fprintf(os.Stderr, "Error: --path-prefix '%s' is not a directory under the root.\n", packPathPrefix)
+				removePackInput(packInputDir)
+				os.Exit(1)
+			}
+		}
+		if packOutputToTemp {
+			extension := paktxtExtension
+			if packMarkdown {
+				extension = mdExtension
+			}
+			tempFile, err := os.CreateTemp(tempDir, "paktxt-*"+extension)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error creating temporary output file: %v\n", err)
+				removePackInput(packInputDir)
+				os.Exit(1)
+			}
+			tempFile.Close()
+			absPackOutputFile = tempFile.Name()
+		}
+		excludePatternsSlice := parsePatterns(packExcludePatterns)
+		filterPatternsSlice := parsePatterns(packFilterPatterns)
+		// includePatternsSlice := parsePatterns(packIncludePatterns) // REMOVED
+		if packSplitByDir {
+			if err := packEachSubdir(absPackOutputFile, excludePatternsSlice, filterPatternsSlice); err != nil {
+				printRunSummary(summaryFlag)
+				writeRunReport("pack", err)
+				fmt.Printf("Error during pack operation: %v\n", err)
+				os.Exit(1)
+			}
+			printRunSummary(summaryFlag)
+			writeRunReport("pack", nil)
+			printProfile(packProfilePhases)
+			break
+		}
+		err := concatenateAndOutput(packToClipboard, absPackOutputFile, excludePatternsSlice, filterPatternsSlice, nil) // Pass nil for includePatterns
+		removePackInput(packInputDir)
+		if err != nil {
+			printRunSummary(summaryFlag)
+			writeRunReport("pack", err)
+			fmt.Printf("Error during pack operation: %v\n", err)
+			if packOutputToTemp {
+				os.Remove(absPackOutputFile)
+			}
+			os.Exit(1)
+		}
+		printRunSummary(summaryFlag)
+		writeRunReport("pack", nil)
+		printProfile(packProfilePhases)
+		if packOutputToTemp {
+			fmt.Fprintln(pathOutput, absPackOutputFile)
+		}
+	case "unpack":
+		unpackCmd.Parse(os.Args[2:])
+		if err := expandPathFlags(&unpackPaktxtFile, &workingDirPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+			unpackCmd.Usage()
+			os.Exit(1)
+		}
+		if unpackFromClipboard && unpackPaktxtFile != "" {
+			fmt.Fprintf(os.Stderr, "Error: Cannot use --clipboard/-b and --paktxt-file/-i simultaneously with 'unpack' command.\n\n")
+			unpackCmd.Usage()
+			os.Exit(1)
+		}
+		if !unpackFromClipboard && unpackPaktxtFile == "" {
+			fmt.Fprintf(os.Stderr, "Error: 'unpack' command requires either --clipboard/-b or --paktxt-file/-i.\n\n")
+			unpackCmd.Usage()
+			os.Exit(1)
+		}
+		if unpackRedactMapFile != "" {
+			mapping, err := loadRedactionMap(unpackRedactMapFile)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			unpackRedactMap = mapping
+		}
+		if unpackVerifyKeyFile != "" {
+			key, err := readKeyFile(unpackVerifyKeyFile, ed25519.PublicKeySize)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			unpackVerifyKey = key
+		}
+		switch unpackOnConflict {
+		case conflictArchiveWins:
+			unpackOnConflict = conflictOverwrite
+		case conflictDiskWins:
+			unpackOnConflict = conflictSkip
+		}
+		if unpackNoClobber {
+			if unpackOnConflict != conflictOverwrite && unpackOnConflict != conflictSkip {
+				fmt.Fprintf(os.Stderr, "Error: Cannot use --no-clobber/-n with --on-conflict %s.\n\n", unpackOnConflict)
+				unpackCmd.Usage()
+				os.Exit(1)
+			}
+			unpackOnConflict = conflictSkip
+		}
+		if unpackOnConflict != conflictOverwrite && unpackOnConflict != conflictSkip && unpackOnConflict != conflictNewer {
+			fmt.Fprintf(os.Stderr, "Error: Unknown --on-conflict '%s'; expected '%s', '%s', '%s', '%s' or '%s'.\n\n", unpackOnConflict, conflictOverwrite, conflictArchiveWins, conflictSkip, conflictDiskWins, conflictNewer)
+			unpackCmd.Usage()
+			os.Exit(1)
+		}
+		if unpackJobs < 1 {
+			fmt.Fprintf(os.Stderr, "Error: --jobs must be at least 1.\n\n")
+			unpackCmd.Usage()
+			os.Exit(1)
+		}
+		if unpackJobs > 1 && unpackReverse {
+			fmt.Fprintf(os.Stderr, "Error: --reverse-restore writes files in a fixed order and cannot be combined with --jobs above 1.\n\n")
+			unpackCmd.Usage()
+			os.Exit(1)
+		}
+		if prefix, err := normalizePathPrefix(unpackPathPrefixStr); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+			unpackCmd.Usage()
+			os.Exit(1)
+		} else {
+			unpackPathPrefix = prefix
+		}
+		if err := absStoreDir(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := loadReportOptions(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+			unpackCmd.Usage()
+			os.Exit(1)
+		}
+		if unpackLineEnding != lineEndingPreserve && unpackLineEnding != lineEndingLF && unpackLineEnding != lineEndingCRLF {
+			fmt.Fprintf(os.Stderr, "Error: Unknown --line-ending '%s'; expected '%s', '%s' or '%s'.\n\n", unpackLineEnding, lineEndingPreserve, lineEndingLF, lineEndingCRLF)
+			unpackCmd.Usage()
+			os.Exit(1)
+		}
+		if unpackSkipUnchanged && (unpackContentFilter != "" || len(unpackReplacements) > 0 || unpackLineEnding != lineEndingPreserve) {
+			fmt.Fprintf(os.Stderr, "Error: --skip-unchanged compares the archived content and cannot be combined with --content-filter, --replace or --line-ending.\n\n")
+			unpackCmd.Usage()
+			os.Exit(1)
+		}
+		if unpackDirModeStr != "" {
+			mode, err := strconv.ParseUint(unpackDirModeStr, 8, 32)
+			if err != nil || mode > 0777 {
+				fmt.Fprintf(os.Stderr, "Error: Invalid --dir-mode '%s'; expected octal permissions such as 0700 or 0755.\n\n", unpackDirModeStr)
+				unpackCmd.Usage()
+				os.Exit(1)
+			}
+			unpackDirMode = fs.FileMode(mode)
+		}
+		unpackUmask = processUmask()
+		if unpackUmaskStr != "" {
+			mask, err := strconv.ParseUint(unpackUmaskStr, 8, 32)
+			if err != nil || mask > 0777 {
+				fmt.Fprintf(os.Stderr, "Error: Invalid --umask '%s'; expected an octal mask such as 022 or 077.\n\n", unpackUmaskStr)
+				unpackCmd.Usage()
+				os.Exit(1)
+			}
+			unpackUmask |= fs.FileMode(mask)
+		}
+		if unpackPreserveBOM && unpackStripBOM {
+			fmt.Fprintf(os.Stderr, "Error: Cannot use --preserve-bom and --strip-bom simultaneously.\n\n")
+			unpackCmd.Usage()
+			os.Exit(1)
+		}
+		if unpackToTar {
+			if unpackGitAdd || unpackGitCommitMsg != "" || unpackPostCmd != "" {
+				fmt.Fprintf(os.Stderr, "Error: --to-tar writes nothing to disk and cannot be combined with --git-add, --git-commit or --post-unpack.\n\n")
+				unpackCmd.Usage()
+				os.Exit(1)
+			}
+			if unpackRelocate || unpackOnConflict != conflictOverwrite || unpackSkipUnchanged || unpackTouchOnly || unpackForce || unpackPruneEmpty || unpackJobs > 1 {
+				fmt.Fprintf(os.Stderr, "Error: --to-tar does not look at existing files and cannot be combined with --relocate-on-collision, --on-conflict, --no-clobber/-n, --skip-unchanged, --touch-only, --force, --prune-empty or --jobs.\n\n")
+				unpackCmd.Usage()
+				os.Exit(1)
+			}
+			if isTerminal(os.Stdout) {
+				fmt.Fprintf(os.Stderr, "Error: --to-tar refuses to write a tar stream to a terminal; redirect or pipe stdout.\n")
+				os.Exit(1)
+			}
+			// stdout carries only the tar stream.
+			unpackTarOutput = os.Stdout
+			os.Stdout = os.Stderr
+		}
+		// Resolve absolute path of input file before changing working directory
+		if unpackPaktxtFile != "" && !filepath.IsAbs(unpackPaktxtFile) {
+			absPath, err := filepath.Abs(unpackPaktxtFile)
+			if err != nil {
+				fmt.Printf("Error resolving absolute path for input file: %v\n", err)
+				os.Exit(1)
+			}
+			unpackPaktxtFile = absPath
+		}
+		if workingDirPath != "" {
+			if err := changeWorkingDir(workingDirPath); err != nil {
+				os.Exit(1)
+			}
+		}
+		excludePatternsSlice := parsePatterns(unpackExcludePatterns)
+		filterPatternsSlice := parsePatterns(unpackFilterPatterns)
+		unpackExecGlobs = parsePatterns(unpackExecGlob)
+		// includePatternsSlice := parsePatterns(unpackIncludePatterns) // REMOVED
+		restoredFiles, err := restoreFiles(unpackFromClipboard, unpackPaktxtFile, excludePatternsSlice, filterPatternsSlice, nil) // Pass nil for includePatterns
+		if err != nil {
+			printRunSummary(summaryFlag)
+			writeRunReport("unpack", err)
+			fmt.Printf("Error restoring files: %v\n", err)
+			os.Exit(1)
+		}
+		if unpackTarOutput != nil {
+			fmt.Println("Tar stream written successfully.")
+		} else {
+			fmt.Println("Files restored successfully.")
+		}
+		if unpackGitAdd || unpackGitCommitMsg != "" {
+			if err := stageRestoredFiles(restoredFiles, unpackGitCommitMsg); err != nil {
+				writeRunReport("unpack", err)
+				fmt.Printf("Error staging restored files: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if unpackPostCmd != "" {
+			if err := runPostUnpack(unpackPostCmd); err != nil {
+				printRunSummary(summaryFlag)
+				writeRunReport("unpack", err)
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		printRunSummary(summaryFlag)
+		writeRunReport("unpack", nil)
+		printProfile(unpackProfilePhases)
+	case "update":
+		updateCmd.Parse(os.Args[2:])
+		if err := expandPathFlags(&updatePaktxtFile, &updateOutputFile, &workingDirPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+			updateCmd.Usage()
+			os.Exit(1)
+		}
+		if err := loadTimestampOptions(""); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+			updateCmd.Usage()
+			os.Exit(1)
+		}
+		if updatePaktxtFile == "" {
+			fmt.Fprintf(os.Stderr, "Error: 'update' command requires --paktxt-file/-i.\n\n")
+			updateCmd.Usage()
+			os.Exit(1)
+		}
+		if updateSignKeyFile != "" {
+			seed, err := readKeyFile(updateSignKeyFile, ed25519.SeedSize)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			packSignKey = ed25519.NewKeyFromSeed(seed)
+		}
+		absArchive, err := filepath.Abs(updatePaktxtFile)
+		if err != nil {
+			fmt.Printf("Error resolving absolute path for input file: %v\n", err)
+			os.Exit(1)
+		}
+		absOutput := absArchive
+		if updateOutputFile != "" {
+			if absOutput, err = filepath.Abs(updateOutputFile); err != nil {
+				fmt.Printf("Error resolving absolute path for output file: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if workingDirPath != "" {
+			if err := changeWorkingDir(workingDirPath); err != nil {
+				os.Exit(1)
+			}
+		}
+		if err := updateArchive(absArchive, absOutput, parsePatterns(updateExcludePatterns), parsePatterns(updateFilterPatterns)); err != nil {
+			printRunSummary(summaryFlag)
+			fmt.Printf("Error during update operation: %v\n", err)
+			os.Exit(1)
+		}
+		printRunSummary(summaryFlag)
+	case "info":
+		infoCmd.Parse(os.Args[2:])
+		if err := expandPathFlags(&infoPaktxtFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+			infoCmd.Usage()
+			os.Exit(1)
+		}
+		if infoFromClipboard && infoPaktxtFile != "" {
+			fmt.Fprintf(os.Stderr, "Error: Cannot use --clipboard/-b and --paktxt-file/-i simultaneously with 'info' command.\n\n")
+			infoCmd.Usage()
+			os.Exit(1)
+		}
+		if !infoFromClipboard && infoPaktxtFile == "" {
+			fmt.Fprintf(os.Stderr, "Error: 'info' command requires either --clipboard/-b or --paktxt-file/-i.\n\n")
+			infoCmd.Usage()
+			os.Exit(1)
+		}
+		if err := absStoreDir(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if infoTokens {
+			if infoFile != "" {
+				fmt.Fprintf(os.Stderr, "Error: Cannot use --file and --tokens simultaneously with 'info' command.\n\n")
+				infoCmd.Usage()
+				os.Exit(1)
+			}
+			if infoTop < 0 {
+				fmt.Fprintf(os.Stderr, "Error: --top must not be negative.\n\n")
+				infoCmd.Usage()
+				os.Exit(1)
+			}
+			if err := printTokenReport(infoFromClipboard, infoPaktxtFile, infoTokenizer, infoTop); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			break
+		}
+		if infoFile == "" {
+			fmt.Fprintf(os.Stderr, "Error: 'info' command requires --file or --tokens.\n\n")
+			infoCmd.Usage()
+			os.Exit(1)
+		}
+		if err := printBlockInfo(infoFromClipboard, infoPaktxtFile, infoFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "list":
+		listCmd.Parse(os.Args[2:])
+		if listCmd.NArg() == 0 {
+			fmt.Fprintf(os.Stderr, "Error: 'list' command requires at least one archive.\n\n")
+			listCmd.Usage()
+			os.Exit(1)
+		}
+		if listPreview < 0 {
+			fmt.Fprintf(os.Stderr, "Error: --preview must not be negative.\n\n")
+			listCmd.Usage()
+			os.Exit(1)
+		}
+		if err := absStoreDir(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := listArchives(listCmd.Args(), listPreview, listLong, listByExt, parsePatterns(listFilterPatterns), parsePatterns(listExcludePatterns)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "keygen":
+		keygenCmd.Parse(os.Args[2:])
+		if keygenOutput == "" {
+			fmt.Fprintf(os.Stderr, "Error: 'keygen' command requires --output/-o.\n\n")
+			keygenCmd.Usage()
+			os.Exit(1)
+		}
+		if err := generateKeyPair(keygenOutput); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "store-gc":
+		storeGCCmd.Parse(os.Args[2:])
+		if storeDir == "" {
+			fmt.Fprintf(os.Stderr, "Error: 'store-gc' command requires --store.\n\n")
+			storeGCCmd.Usage()
+			os.Exit(1)
+		}
+		if storeGCCmd.NArg() == 0 {
+			fmt.Fprintf(os.Stderr, "Error: 'store-gc' command requires at least one archive whose objects are kept.\n\n")
+			storeGCCmd.Usage()
+			os.Exit(1)
+		}
+		if err := absStoreDir(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := collectStoreGarbage(storeGCCmd.Args(), storeGCDryRun); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	default:
+		if !strings.HasPrefix(cmd, "-") {
+			fmt.Fprintf(os.Stderr, "Error: Unknown command '%s'.\n\n", cmd)
+		} else {
+			fmt.Fprintf(os.Stderr, "Error: Invalid flags without a command. Use 'paktxt <command> --help' or 'paktxt --help'.\n\n")
+		}
+		defaultUsage()
+		os.Exit(1)
+	}
+}
+
+// warnf prints a warning and records it in currentRun for the end-of-run summary.
+func warnf(kind, path, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	warnMu.Lock() // 'unpack --jobs' restores files concurrently
+	defer warnMu.Unlock()
+	fmt.Printf("Warning: %s\n", msg)
+	currentRun.Warnings = append(currentRun.Warnings, Warning{Kind: kind, Path: path, Message: msg})
+	action := eventWarning
+	if strings.HasPrefix(msg, "Skipping") {
+		action = eventSkipped
+	}
+	appendEvent(action, path, kind+": "+msg)
+}
+
+var warnMu sync.Mutex
+
+// recordEvent adds an entry to the --report run log. It is a no-op without --report.
+func recordEvent(action, path, format string, args ...any) {
+	warnMu.Lock()
+	defer warnMu.Unlock()
+	appendEvent(action, path, fmt.Sprintf(format, args...))
+}
+
+// appendEvent is recordEvent for callers that hold warnMu.
+func appendEvent(action, path, detail string) {
+	if reportFile == "" {
+		return
+	}
+	currentRun.Events = append(currentRun.Events, RunEvent{
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+		Action: action,
+		Path:   filepath.ToSlash(path),
+		Detail: detail,
+	})
+}
+
+// loadReportOptions validates --report-format, inferring it from the --report extension when
+// it is not given, and resolves --report before the working directory changes. It also marks
+// the start of the run for the reported duration.
+func loadReportOptions() error {
+	currentRun.Started = time.Now()
+	if reportFile == "" {
+		if reportFormat != "" {
+			return errors.New("--report-format requires --report")
+		}
+		return nil
+	}
+	if reportFormat == "" {
+		reportFormat = reportJSON
+		if strings.EqualFold(filepath.Ext(reportFile), ".csv") {
+			reportFormat = reportCSV
+		}
+	}
+	if reportFormat != reportJSON && reportFormat != reportCSV {
+		return fmt.Errorf("unknown --report-format '%s'; expected '%s' or '%s'", reportFormat, reportJSON, reportCSV)
+	}
+	if err := expandPathFlags(&reportFile); err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(reportFile)
+	if err != nil {
+		return fmt.Errorf("failed to resolve --report '%s': %w", reportFile, err)
+	}
+	reportFile = abs
+	return nil
+}
+
+// writeRunReport writes the --report run log for command: every recorded event, the totals
+// per action and the duration, and whether the run failed with runErr. A report that cannot
+// be written is a warning, so it does not mask the outcome of the run itself.
+func writeRunReport(command string, runErr error) {
+	if reportFile == "" {
+		return
+	}
+	finished := time.Now()
+	status := "ok"
+	if runErr != nil {
+		status = "failed"
+		recordEvent(eventFailed, "", "%v", runErr)
+	}
+	totals := make(map[string]int)
+	for _, event := range currentRun.Events {
+		totals[event.Action]++
+	}
+	report := struct {
+		Command    string         `json:"command"`
+		Status     string         `json:"status"`
+		Started    string         `json:"started"`
+		Finished   string         `json:"finished"`
+		DurationMS int64          `json:"duration_ms"`
+		Totals     map[string]int `json:"totals"`
+		Events     []RunEvent     `json:"events"`
+	}{
+		Command:    command,
+		Status:     status,
+		Started:    currentRun.Started.UTC().Format(time.RFC3339Nano),
+		Finished:   finished.UTC().Format(time.RFC3339Nano),
+		DurationMS: finished.Sub(currentRun.Started).Milliseconds(),
+		Totals:     totals,
+		Events:     currentRun.Events,
+	}
+	if report.Events == nil {
+		report.Events = []RunEvent{}
+	}
+
+	var buf bytes.Buffer
+	if reportFormat == reportCSV {
+		// One event per row; the run itself is described by trailing "total" and "run" rows.
+		w := csv.NewWriter(&buf)
+		w.Write([]string{"time", "action", "path", "detail"})
+		for _, event := range report.Events {
+			w.Write([]string{event.Time, event.Action, event.Path, event.Detail})
+		}
+		actions := make([]string, 0, len(totals))
+		for action := range totals {
+			actions = append(actions, action)
+		}
+		sort.Strings(actions)
+		for _, action := range actions {
+			w.Write([]string{report.Finished, "total", action, strconv.Itoa(totals[action])})
+		}
+		w.Write([]string{report.Finished, "run", command, fmt.Sprintf("%s in %dms", status, report.DurationMS)})
+		w.Flush()
+	} else {
+		encoder := json.NewEncoder(&buf)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	}
+	if err := writeFileAtomic(reportFile, buf.Bytes(), defaultFileMode()); err != nil {
+		fmt.Printf("Warning: failed to write the run report: %v\n", err)
+		return
+	}
+	fmt.Printf("Run report written to %s.\n", reportFile)
+}
+
+// printRunSummary prints the number of warnings collected during the run and,
+// when detailed is set, lists them grouped by kind.
+func printRunSummary(detailed bool) {
+	warnings := currentRun.Warnings
+	if len(warnings) == 0 {
+		if detailed {
+			fmt.Println("Summary: no warnings.")
+		}
+		return
+	}
+	fmt.Printf("Summary: %d warning(s).\n", len(warnings))
+	if !detailed {
+		return
+	}
+	byKind := make(map[string][]Warning)
+	var kinds []string
+	for _, w := range warnings {
+		if _, ok := byKind[w.Kind]; !ok {
+			kinds = append(kinds, w.Kind)
+		}
+		byKind[w.Kind] = append(byKind[w.Kind], w)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Printf("  %s (%d):\n", kind, len(byKind[kind]))
+		for _, w := range byKind[kind] {
+			fmt.Printf("    - %s\n", w.Message)
+		}
+	}
+}
+
+// Phase names recorded by --profile, in the order they are printed.
+var (
+	packProfilePhases   = []string{"walk", "sniff", "read", "encode", "write"}
+	unpackProfilePhases = []string{"parse", "write"}
+)
+
+// profileTimes accumulates the time spent in each phase when --profile is set.
+var profileTimes = make(map[string]time.Duration)
+
+// profileStart returns the start time of a phase, or the zero time when --profile is off
+// so that profileAdd becomes a no-op.
+func profileStart() time.Time {
+	if !profileFlag {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// profileAdd adds the time elapsed since start to the given phase.
+func profileAdd(phase string, start time.Time) {
+	if start.IsZero() {
+		return
+	}
+	profileTimes[phase] += time.Since(start)
+}
+
+// printProfile prints the accumulated phase timings when --profile is set.
+func printProfile(phases []string) {
+	if !profileFlag {
+		return
+	}
+	var total time.Duration
+	for _, phase := range phases {
+		total += profileTimes[phase]
+	}
+	fmt.Println("Profile:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	for _, phase := range phases {
+		d := profileTimes[phase]
+		percent := 0.0
+		if total > 0 {
+			percent = 100 * float64(d) / float64(total)
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%.1f%%\t\n", phase, d.Round(time.Microsecond), percent)
+	}
+	w.Flush()
+}
+
+// Renamed from parseExcludePatterns to be more generic for any pattern list
+func parsePatterns(patterns string) []string {
+	if patterns == "" {
+		return nil
+	}
+	split := strings.Split(patterns, ",")
+	var result []string
+	for _, p := range split {
+		trimmedP := strings.TrimSpace(p)
+		if trimmedP != "" {
+			result = append(result, trimmedP)
+		}
+	}
+	return result
+}
+
+// expandPathFlags expands each non-empty path in place with expandPath.
+func expandPathFlags(paths ...*string) error {
+	for _, p := range paths {
+		if *p == "" {
+			continue
+		}
+		expanded, err := expandPath(*p)
+		if err != nil {
+			return err
+		}
+		*p = expanded
+	}
+	return nil
+}
+
+// expandPath expands a leading '~' to the user's home directory and $VAR or ${VAR}
+// references, as a shell would for an unquoted argument. Referencing an undefined variable
+// is an error, since expanding it to "" would silently turn '$OUT/a.paktxt' into '/a.paktxt'.
+func expandPath(p string) (string, error) {
+	original, home := p, ""
+	if p == "~" || strings.HasPrefix(p, "~/") || strings.HasPrefix(p, "~"+string(filepath.Separator)) {
+		dir, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("cannot expand '~' in '%s': %w", p, err)
+		}
+		home, p = dir, p[1:]
+	}
+	var undefined []string
+	expanded := os.Expand(p, func(name string) string {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			undefined = append(undefined, "$"+name)
+		}
+		return value
+	})
+	if len(undefined) > 0 {
+		return "", fmt.Errorf("undefined environment variable(s) %s in path '%s'", strings.Join(undefined, ", "), original)
+	}
+	return home + expanded, nil
+}
+
+func changeWorkingDir(path string) error {
+	absWorkingDir, err := filepath.Abs(path)
+	if err != nil {
+		fmt.Printf("Error resolving working directory '%s': %v\n", path, err)
+		return err
+	}
+	if err := os.Chdir(absWorkingDir); err != nil {
+		fmt.Printf("Error changing working directory to '%s': %v\n", absWorkingDir, err)
+		return err
+	}
+	fmt.Printf("Changed working directory to: %s\n", absWorkingDir)
+	return nil
+}
+
+func concatenateAndOutput(toClipboard bool, outputFile string, excludePatterns, filterPatterns, includePatterns []string) error {
+	if !toClipboard {
+		outputFile = withOutputExtension(outputFile)
+		if info, err := os.Stat(outputFile); err == nil && info.IsDir() {
+			return fmt.Errorf("output file '%s' is an existing directory; pass a file path to --output-file", outputFile)
+		}
+		packOutputPath, _ = filepath.Abs(outputFile)
+	}
+
+	fmt.Println("Scanning files for concatenation...")
+
+	walkStart, sniffBefore := profileStart(), profileTimes["sniff"]
+	files, err := collectFiles(excludePatterns, filterPatterns)
+	if err != nil {
+		return err
+	}
+	profileAdd("walk", walkStart)
+	// Sniffing happens during the walk; report the walk without the sniffing it did.
+	profileTimes["walk"] -= profileTimes["sniff"] - sniffBefore
+
+	if packDiffBase != nil {
+		files = filesChangedSinceBase(files)
+		if len(files) == 0 {
+			return errors.New("no files differ from the base archive")
+		}
+	}
+
+	var existing []byte
+	if packAppend {
+		var archived map[string]bool
+		existing, archived, err = loadAppendTarget(outputFile)
+		if err != nil {
+			return err
+		}
+		files = skipForAppend(files, outputFile, archived)
+	}
+	if packSelect {
+		if files, err = selectFiles(files, os.Stdin, os.Stderr); err != nil {
+			return err
+		}
+	}
+	if packDryRun {
+		return printDryRun(files)
+	}
+
+	if toClipboard && packClipboardViaTemp {
+		return copyToClipboardViaTemp(files)
+	}
+
+	paktxtContent, err := buildPaktxtContent(files, existing == nil)
+	if err != nil {
+		return fmt.Errorf("failed to build paktxt content: %w", err)
+	}
+	// Files of a removed tree all fail to read; do not write an archive of what was left.
+	if err := checkRootStillExists(); err != nil {
+		return err
+	}
+	if existing != nil {
+		paktxtContent = string(existing) + paktxtContent
+	}
+	if packBaseRef != "" {
+		paktxtContent += baseRefPrefix + packBaseRef + "\n"
+	}
+	if packSignKey != nil {
+		paktxtContent = signArchive(paktxtContent, packSignKey)
+		fmt.Println("Archive signed.")
+	}
+
+	if err := writeRedactionMap(); err != nil {
+		return err
+	}
+	if packMaxTotalBytes > 0 {
+		fmt.Printf("Archive size: %d of %d bytes allowed by --max-total-bytes.\n", len(paktxtContent), packMaxTotalBytes)
+	}
+	paktxtContent = encodeArchive(paktxtContent, packOutputEncoding)
+
+	writeStart := profileStart()
+	defer profileAdd("write", writeStart)
+	if toClipboard {
+		fmt.Printf("Attempting to copy content to clipboard (%s)...\n", formatByteSize(len(paktxtContent)))
+		err := runClipboardOp("Copying to clipboard", func(ctx context.Context) error {
+			return copyToClipboard(ctx, strings.NewReader(paktxtContent))
+		})
+		if err != nil {
+			fmt.Printf("Error: Failed to copy to clipboard: %v\n", err)
+			fmt.Println("This might be due to system restrictions or lack of clipboard support.")
+			return fmt.Errorf("clipboard copy failed: %w", err)
+		}
+		fmt.Println("Content successfully copied to clipboard.")
+	} else {
+		fmt.Printf("Writing content to %s...\n", outputFile)
+		data := []byte(paktxtContent)
+		if packCompress {
+			if data, err = gzipBytes(data); err != nil {
+				return fmt.Errorf("failed to compress output: %w", err)
+			}
+			fmt.Printf("Compressed %s to %s.\n", formatByteSize(len(paktxtContent)), formatByteSize(len(data)))
+		}
+		if err := writeFileAtomic(outputFile, data, packOutputMode); err != nil {
+			return fmt.Errorf("failed to write to file %s: %w", outputFile, err)
+		}
+		fmt.Printf("Content successfully written to %s.\n", outputFile)
+	}
+	return nil
+}
+
+// writeRedactionMap saves the --redact-paths mapping to --redact-map, if requested.
+func writeRedactionMap() error {
+	if packRedactor == nil || packRedactMapFile == "" {
+		return nil
+	}
+	if err := packRedactor.writeMap(packRedactMapFile); err != nil {
+		return fmt.Errorf("failed to write redaction map: %w", err)
+	}
+	fmt.Printf("Redaction map written to %s.\n", packRedactMapFile)
+	return nil
+}
+
+// copyToClipboardViaTemp streams the archive for files into a temporary file and copies that
+// file to the clipboard, so generation holds one file in memory at a time rather than the
+// whole archive. The temporary file is removed afterwards.
+func copyToClipboardViaTemp(files []string) error {
+	tempFile, err := os.CreateTemp(os.Getenv(tempDirEnv), "paktxt-clipboard-*"+paktxtExtension)
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	writer := bufio.NewWriter(tempFile)
+	if err := writePaktxtContent(writer, files, true); err != nil {
+		return fmt.Errorf("failed to build paktxt content: %w", err)
+	}
+	if packBaseRef != "" {
+		if _, err := writer.WriteString(baseRefPrefix + packBaseRef + "\n"); err != nil {
+			return fmt.Errorf("failed to write to temporary file %s: %w", tempFile.Name(), err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write to temporary file %s: %w", tempFile.Name(), err)
+	}
+	if err := writeRedactionMap(); err != nil {
+		return err
+	}
+
+	writeStart := profileStart()
+	defer profileAdd("write", writeStart)
+	size, err := tempFile.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = tempFile.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to rewind temporary file %s: %w", tempFile.Name(), err)
+	}
+	if packMaxTotalBytes > 0 {
+		fmt.Printf("Archive size: %d of %d bytes allowed by --max-total-bytes.\n", size, packMaxTotalBytes)
+	}
+	fmt.Printf("Attempting to copy content to clipboard (%s, via %s)...\n", formatByteSize(int(size)), tempFile.Name())
+	err = runClipboardOp("Copying to clipboard", func(ctx context.Context) error {
+		return copyToClipboard(ctx, tempFile)
+	})
+	if err != nil {
+		fmt.Printf("Error: Failed to copy to clipboard: %v\n", err)
+		fmt.Println("This might be due to system restrictions or lack of clipboard support.")
+		return fmt.Errorf("clipboard copy failed: %w", err)
+	}
+	fmt.Println("Content successfully copied to clipboard.")
+	return nil
+}
+
+// copyToClipboard feeds r to the platform's clipboard command when one is installed, which is
+// killed when ctx is cancelled, and otherwise reads it for the clipboard library.
+func copyToClipboard(ctx context.Context, r io.Reader) error {
+	if cmd := clipboardCopyCommand(ctx); cmd != nil {
+		// Output is not captured: xclip and xsel leave a child holding it to serve the selection.
+		cmd.Stdin = r
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s: %w", cmd.Path, err)
+		}
+		return nil
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return clipboard.WriteAll(string(data))
+}
+
+// clipboardCopyCommand returns a command that copies its standard input to the clipboard, or
+// nil if none is available. Windows always uses the clipboard library, as clip.exe does not
+// read UTF-8 reliably.
+func clipboardCopyCommand(ctx context.Context) *exec.Cmd {
+	var candidates [][]string
+	switch runtime.GOOS {
+	case "windows":
+		return nil
+	case "darwin":
+		candidates = [][]string{{"pbcopy"}}
+	default:
+		if os.Getenv("WAYLAND_DISPLAY") != "" {
+			candidates = append(candidates, []string{"wl-copy"})
+		}
+		candidates = append(candidates, []string{"xclip", "-in", "-selection", "clipboard"}, []string{"xsel", "--input", "--clipboard"})
+	}
+	for _, candidate := range candidates {
+		if _, err := exec.LookPath(candidate[0]); err == nil {
+			return exec.CommandContext(ctx, candidate[0], candidate[1:]...)
+		}
+	}
+	return nil
+}
+
+// selectFiles shows files as a numbered checklist on out, all selected, and applies the
+// commands read from in until an empty line accepts the selection, for --select. It returns
+// the selected files in their original order.
+func selectFiles(files []string, in io.Reader, out io.Writer) ([]string, error) {
+	selected := make([]bool, len(files))
+	for i := range selected {
+		selected[i] = true
+	}
+	reader := bufio.NewReader(in)
+	for {
+		count := 0
+		writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		for i, file := range files {
+			mark := " "
+			if selected[i] {
+				mark = "x"
+				count++
+			}
+			size := 0
+			if info, err := os.Stat(file); err == nil {
+				size = int(info.Size())
+			}
+			fmt.Fprintf(writer, "  [%s] %d\t%s\t%s\n", mark, i+1, filepath.ToSlash(file), formatByteSize(size))
+		}
+		if err := writer.Flush(); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(out, "%d of %d file(s) selected. Toggle numbers or ranges (e.g., 2,5-7), 'a' all, 'n' none,\n", count, len(files))
+		fmt.Fprintf(out, "'q' to abort; press Enter to pack the selection.\n> ")
+
+		line, err := reader.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return nil, errors.New("--select: no selection was made (input closed)")
+		}
+		switch command := strings.TrimSpace(line); command {
+		case "":
+			var kept []string
+			for i, file := range files {
+				if selected[i] {
+					kept = append(kept, file)
+				}
+			}
+			if len(kept) == 0 {
+				return nil, errors.New("--select: no files selected")
+			}
+			fmt.Fprintf(out, "Packing %d selected file(s).\n", len(kept))
+			return kept, nil
+		case "q":
+			return nil, errors.New("--select: aborted")
+		case "a", "n":
+			for i := range selected {
+				selected[i] = command == "a"
+			}
+		default:
+			if err := toggleSelection(selected, command); err != nil {
+				fmt.Fprintf(out, "%v\n", err)
+			}
+		}
+	}
+}
+
+// toggleSelection flips the entries named by a comma-separated list of 1-based numbers and
+// ranges such as "2,5-7". Nothing is changed if any part is invalid.
+func toggleSelection(selected []bool, spec string) error {
+	var toggle []int
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		from, to, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(strings.TrimSpace(from))
+		last := first
+		if err == nil && isRange {
+			last, err = strconv.Atoi(strings.TrimSpace(to))
+		}
+		if err != nil || first < 1 || last < first || last > len(selected) {
+			return fmt.Errorf("invalid selection %q: expected numbers or ranges between 1 and %d", part, len(selected))
+		}
+		for i := first; i <= last; i++ {
+			toggle = append(toggle, i-1)
+		}
+	}
+	for _, i := range toggle {
+		selected[i] = !selected[i]
+	}
+	return nil
+}
+
+// printDryRun prints the files a pack would include, in archive order, with their sizes on
+// disk, for --dry-run.
+func printDryRun(files []string) error {
+	fmt.Println("Files that would be packed, in order:")
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	total := 0
+	for _, file := range files {
+		size := 0
+		if info, err := os.Stat(file); err == nil {
+			size = int(info.Size())
+		}
+		total += size
+		fmt.Fprintf(writer, "%s\t  %s\n", formatByteSize(size), filepath.ToSlash(file))
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("%d file(s), %s in total. Nothing was written (--dry-run).\n", len(files), formatByteSize(total))
+	return nil
+}
+
+// baseEntry is what delta packing keeps of a base archive block: enough to tell whether a
+// file changed, without holding the base content in memory.
+type baseEntry struct {
+	digest       [sha256.Size]byte // Of the content
+	size         int               // Size on disk: the content plus its BOM
+	modTime      string
+	isExecutable bool
+	hasBOM       bool
+	symlink      string
+}
+
+// newBaseEntry summarizes block as a baseEntry.
+func newBaseEntry(block *FileBlock) baseEntry {
+	entry := baseEntry{
+		digest:       sha256.Sum256(block.Content),
+		size:         len(block.Content),
+		modTime:      block.ModTime,
+		isExecutable: block.IsExecutable,
+		hasBOM:       block.HasBOM,
+		symlink:      block.Symlink,
+	}
+	if block.HasBOM {
+		entry.size += len(utf8BOM)
+	}
+	return entry
+}
+
+// withOutputExtension completes the --output-file name for the selected output: '.paktxt',
+// '.md' for --markdown, with '.gz' appended for --compress. A name without extension gets the
+// full one, and with --compress 'name.paktxt' becomes 'name.paktxt.gz'. Other extensions are
+// kept with a warning.
+func withOutputExtension(outputFile string) string {
+	baseExtension := paktxtExtension
+	if packMarkdown {
+		baseExtension = mdExtension
+	}
+	expectedExtension := baseExtension
+	if packCompress {
+		expectedExtension += gzipExtension
+	}
+	lower := strings.ToLower(outputFile)
+	switch {
+	case strings.HasSuffix(lower, expectedExtension):
+		return outputFile
+	case filepath.Ext(outputFile) == "":
+		return outputFile + expectedExtension
+	case packCompress && strings.HasSuffix(lower, baseExtension):
+		return outputFile + gzipExtension
+	case !packCompress && strings.HasSuffix(lower, gzipExtension):
+		warnf(warnOutput, outputFile, "Output file '%s' has a '%s' extension, but --compress is not set; the file is written uncompressed.", outputFile, gzipExtension)
+	default:
+		warnf(warnOutput, outputFile, "Output file '%s' does not have a '%s' extension. Using as is.", outputFile, expectedExtension)
+	}
+	return outputFile
+}
+
+// gzipBytes returns data compressed with gzip.
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// loadDiffBase parses the base archive given to flag into entries keyed by slash path, and
+// returns the SHA-256 of the whole archive as its identity.
+func loadDiffBase(path, flag string) (map[string]baseEntry, [sha256.Size]byte, error) {
+	content, err := readPaktxtInput(false, path)
+	if err != nil {
+		return nil, [sha256.Size]byte{}, err
+	}
+	blocks, err := parseBlocks(content)
+	if err != nil {
+		return nil, [sha256.Size]byte{}, fmt.Errorf("failed to parse %s archive '%s': %w", flag, path, err)
+	}
+	base := make(map[string]baseEntry, len(blocks))
+	for _, block := range blocks {
+		if err := loadStoreObject(block); err != nil {
+			return nil, [sha256.Size]byte{}, fmt.Errorf("%s archive '%s': %w", flag, path, err)
+		}
+		base[filepath.ToSlash(block.Filename)] = newBaseEntry(block)
+	}
+	return base, sha256.Sum256(content), nil
+}
+
+// statUnchanged reports whether file has the size and modification time recorded in entry,
+// which --since-archive takes as proof that it is unchanged without reading it.
+func statUnchanged(file string, entry baseEntry) bool {
+	if entry.modTime == "" || entry.symlink != "" {
+		return false
+	}
+	info, err := os.Stat(file)
+	return err == nil && info.Size() == int64(entry.size) && formatTimestamp(info.ModTime()) == entry.modTime
+}
+
+// filesChangedSinceBase keeps the files that are missing from packDiffBase or whose block
+// differs from the archived one. Files deleted since the base are not represented.
+func filesChangedSinceBase(files []string) []string {
+	var changed []string
+	unchanged, statOnly := 0, 0
+	for _, file := range files {
+		old, ok := packDiffBase[filepath.ToSlash(file)]
+		if ok {
+			if packBaseRef != "" && statUnchanged(file, old) {
+				unchanged++
+				statOnly++
+				continue
+			}
+			// Informational labels (language, modtime) do not count as changes.
+			if block, readOK := readFileBlock(file); readOK && sha256.Sum256(block.Content) == old.digest &&
+				old.isExecutable == block.IsExecutable && old.hasBOM == block.HasBOM && old.symlink == block.Symlink {
+				unchanged++
+				continue
+			}
+		}
+		changed = append(changed, file)
+	}
+	fmt.Printf("%d file(s) unchanged since the base archive were left out; %d new or changed.\n", unchanged, len(changed))
+	if packBaseRef != "" {
+		fmt.Printf("%d of the unchanged file(s) were recognized by size and modtime without being read.\n", statOnly)
+	}
+	return changed
+}
+
+// loadAppendTarget reads the archive that 'pack --append' extends and returns its bytes and
+// the set of archived filenames. A missing file yields a nil archive, so a new one is
+// started. The archive's format is adopted for the appended blocks.
+func loadAppendTarget(outputFile string) ([]byte, map[string]bool, error) {
+	data, err := os.ReadFile(outputFile)
+	if os.IsNotExist(err) {
+		fmt.Printf("%s does not exist yet; starting a new archive.\n", outputFile)
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read archive '%s' for --append: %w", outputFile, err)
+	}
+	if body, _, signed := splitSignature(data); signed {
+		warnf(warnOutput, outputFile, "Removing the signature of %s before appending; pass --sign to sign the result.", outputFile)
+		data = body
+	}
+	blocks, err := parseBlocks(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot append to '%s': %w", outputFile, err)
+	}
+	if len(blocks) > 0 && bytes.HasSuffix(data, blocks[len(blocks)-1].raw) && data[len(data)-1] != '\n' {
+		// The last block is complete but its separator was lost, e.g. by an editor or a copy.
+		fmt.Printf("'%s' does not end with a newline; adding it before the new blocks.\n", outputFile)
+		data = append(data, '\n')
+		blocks[len(blocks)-1].raw = append(blocks[len(blocks)-1].raw, '\n')
+	}
+	if len(blocks) == 0 || !bytes.HasSuffix(data, blocks[len(blocks)-1].raw) || data[len(data)-1] != '\n' {
+		return nil, nil, fmt.Errorf("cannot append to '%s': archive does not end cleanly after a complete file block", outputFile)
+	}
+
+	existingFormat := formatV1
+	if bytes.HasPrefix(data, []byte(v2Magic)) {
+		existingFormat = formatV2
+	} else if err := checkCurrentDelimiters(data); err != nil {
+		return nil, nil, fmt.Errorf("cannot append to '%s': %w", outputFile, err)
+	}
+	if packFormat != existingFormat {
+		fmt.Printf("Appending in the existing archive's %s format.\n", existingFormat)
+		packFormat = existingFormat
+	}
+	if existingFormat == formatV1 && packCompactMetadata != blocks[len(blocks)-1].compact {
+		packCompactMetadata = blocks[len(blocks)-1].compact
+		if packCompactMetadata {
+			fmt.Println("Appending with compact metadata, as in the existing archive.")
+		} else {
+			fmt.Println("Appending with labeled metadata, as in the existing archive.")
+		}
+	}
+
+	archived := make(map[string]bool, len(blocks))
+	for _, block := range blocks {
+		archived[filepath.ToSlash(block.Filename)] = true
+	}
+	return data, archived, nil
+}
+
+// skipForAppend drops the archive itself and files that are already archived from files.
+func skipForAppend(files []string, outputFile string, archived map[string]bool) []string {
+	var kept []string
+	for _, file := range files {
+		if absFile, err := filepath.Abs(file); err == nil && absFile == outputFile {
+			warnf(warnSkipped, file, "Skipping %s: it is the archive being appended to.", file)
+			continue
+		}
+		if archived[filepath.ToSlash(file)] {
+			warnf(warnSkipped, file, "Skipping %s: already present in %s.", file, outputFile)
+			continue
+		}
+		kept = append(kept, file)
+	}
+	return kept
+}
+
+// updateArchive re-scans the current directory and writes an updated copy of the archive at
+// archivePath to outputFile. Blocks of unchanged files are copied byte for byte, changed
+// files are re-encoded in place, blocks of files no longer present are dropped and new files
+// are appended. The archive's format and optional metadata (language, symlinks) are kept, and
+// so is a --since-archive base trailer. A signature is replaced when packSignKey is set and
+// removed with a warning otherwise, since it cannot cover the new bytes.
+func updateArchive(archivePath, outputFile string, excludePatterns, filterPatterns []string) error {
+	if info, err := os.Stat(archivePath); err == nil && info.IsDir() {
+		return fmt.Errorf("expected a .paktxt file, got a directory '%s'", archivePath)
+	}
+	data, err := os.ReadFile(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to read archive '%s': %w", archivePath, err)
+	}
+	if isGzip(data) {
+		return fmt.Errorf("archive '%s' is gzip-compressed; 'update' only rewrites plain archives (decompress it with gunzip first)", archivePath)
+	}
+	if encoding := archiveEncoding(data); encoding != encodingUTF8 {
+		return fmt.Errorf("archive '%s' has encoding %s; 'update' only rewrites plain UTF-8 archives", archivePath, encoding)
+	}
+	body, _, signed := splitSignature(data)
+	data, baseRef, _ := splitBaseRef(body)
+	blocks, err := parseBlocks(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse archive '%s': %w", archivePath, err)
+	}
+	for _, block := range blocks {
+		if block.Object != "" {
+			return fmt.Errorf("archive '%s' keeps its contents in a content store; 'update' only rewrites self-contained archives (take a new snapshot with 'pack --store' instead)", archivePath)
+		}
+	}
+	if info, err := os.Stat(outputFile); err == nil && info.IsDir() {
+		return fmt.Errorf("output file '%s' is an existing directory; pass a file path to --output-file", outputFile)
+	}
+
+	// Re-encode with the same settings the archive was produced with.
+	var builder strings.Builder
+	if bytes.HasPrefix(data, []byte(v2Magic)) {
+		packFormat = formatV2
+	} else {
+		packFormat = formatV1
+		if err := checkCurrentDelimiters(data); err != nil {
+			return fmt.Errorf("cannot update '%s': %w", archivePath, err)
+		}
+		builder.Write(data[:bytes.Index(data, []byte(startBlockDelimiter))]) // Keep the header verbatim
+	}
+	for _, block := range blocks {
+		if block.compact {
+			packCompactMetadata = true
+		}
+		if block.Language != "" {
+			packLanguageHints = true
+		}
+		if block.Symlink != "" {
+			packResolveSymlinks = true
+		}
+		if block.ModTime != "" {
+			packModTime = true
+		}
+	}
+
+	fmt.Println("Scanning files for update...")
+	files, err := collectFiles(excludePatterns, filterPatterns)
+	if err != nil {
+		return err
+	}
+	current := make(map[string]bool, len(files))
+	for _, file := range files {
+		current[filepath.ToSlash(file)] = true
+	}
+
+	archived := make(map[string]bool, len(blocks))
+	var unchanged, changed, removed, added int
+	for _, old := range blocks {
+		name := filepath.ToSlash(old.Filename)
+		archived[name] = true
+		if !current[name] {
+			fmt.Printf("Removed: %s\n", old.Filename)
+			removed++
+			continue
+		}
+		block, ok := readFileBlock(filepath.FromSlash(name))
+		if !ok {
+			// Unreadable now; keep the archived version rather than losing it.
+			builder.Write(old.raw)
+			unchanged++
+			continue
+		}
+		block.Filename = old.Filename
+		if sameBlock(old, block) {
+			builder.Write(old.raw)
+			unchanged++
+			continue
+		}
+		encoded, err := encodeBlock(block)
+		if err != nil {
+			return err
+		}
+		builder.WriteString(encoded)
+		fmt.Printf("Updated: %s\n", old.Filename)
+		changed++
+	}
+	for _, file := range files {
+		if archived[filepath.ToSlash(file)] {
+			continue
+		}
+		block, ok := readFileBlock(file)
+		if !ok {
+			continue
+		}
+		encoded, err := encodeBlock(block)
+		if err != nil {
+			return err
+		}
+		builder.WriteString(encoded)
+		fmt.Printf("Added: %s\n", file)
+		added++
+	}
+
+	fmt.Printf("%d unchanged, %d updated, %d added, %d removed.\n", unchanged, changed, added, removed)
+	if changed+added+removed == 0 && outputFile == archivePath && packSignKey == nil {
+		fmt.Println("Archive is up to date; nothing written.")
+		return nil
+	}
+	content := builder.String()
+	if baseRef != "" {
+		content += baseRefPrefix + baseRef + "\n"
+	}
+	if packSignKey != nil {
+		content = signArchive(content, packSignKey)
+		fmt.Println("Archive signed.")
+	} else if signed {
+		warnf(warnOutput, outputFile, "Removing the signature of %s; pass --sign to sign the updated archive.", archivePath)
+	}
+	if err := writeFileAtomic(outputFile, []byte(content), defaultFileMode()); err != nil {
+		return fmt.Errorf("failed to write to file %s: %w", outputFile, err)
+	}
+	fmt.Printf("Archive successfully written to %s.\n", outputFile)
+	return nil
+}
+
+// sameBlock reports whether two blocks carry the same content and restore-relevant metadata.
+func sameBlock(a, b *FileBlock) bool {
+	return a.IsExecutable == b.IsExecutable &&
+		a.HasBOM == b.HasBOM &&
+		a.Symlink == b.Symlink &&
+		a.Language == b.Language &&
+		a.ModTime == b.ModTime &&
+		bytes.Equal(a.Content, b.Content)
+}
+
+// packRoot is the absolute path of the directory being packed, recorded by checkWorkingDir.
+var packRoot string
+
+// checkWorkingDir verifies, before a scan starts, that the current directory still exists and
+// can be listed, and returns its absolute path.
+func checkWorkingDir() (string, error) {
+	root, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("the working directory no longer exists or cannot be resolved: %w", err)
+	}
+	dir, err := os.Open(".")
+	if err == nil {
+		_, err = dir.ReadDir(1)
+		dir.Close()
+		if err == io.EOF {
+			err = nil // Empty, but readable
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("the working directory %s no longer exists", root)
+	}
+	if err != nil {
+		return "", fmt.Errorf("the working directory %s is not readable: %w", root, err)
+	}
+	return root, nil
+}
+
+// checkRootStillExists returns a specific error when the directory being packed was removed
+// while the pack was running, so that the failure is not reported as a generic walk or read error.
+func checkRootStillExists() error {
+	if packRoot == "" {
+		return nil
+	}
+	if _, err := os.Stat(packRoot); errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("the working directory %s was removed while packing; nothing was written", packRoot)
+	}
+	return nil
+}
+
+// collectFiles returns the ordered list of files to pack from the current directory,
+// using git-aware scanning inside a repository and a recursive walk otherwise.
+func collectFiles(excludePatterns, filterPatterns []string) ([]string, error) {
+	var files []string
+	var err error
+
+	if packRoot, err = checkWorkingDir(); err != nil {
+		return nil, err
+	}
+
+	if packGitSelection != "" && !gitAvailable() {
+		if packGitSelection != gitSelectTracked {
+			return nil, fmt.Errorf("--%s-only needs git, which is not installed", packGitSelection)
+		}
+		warnf(warnOption, "", "--tracked-only: git is not available; packing all files.")
+		packGitSelection = ""
+	}
+	if packGitSelection != "" && !isGitRepo() {
+		return nil, fmt.Errorf("--%s-only requires running inside a git repository", packGitSelection)
+	}
+
+	if isGitRepo() {
+		switch packGitSelection {
+		case gitSelectUntracked:
+			fmt.Println("Git repository detected, packing only untracked files.")
+		case gitSelectModified:
+			fmt.Println("Git repository detected, packing only modified files.")
+		case gitSelectTracked:
+			fmt.Println("Git repository detected, packing only tracked files.")
+		default:
+			fmt.Println("Git repository detected, using git-aware file scanning (staged and working files).")
+		}
+		files, err = getGitFiles(excludePatterns, filterPatterns, nil)
+	} else {
+		fmt.Println("No Git repository detected. Scanning all files recursively from current directory...")
+		if packFollowGitignore {
+			fmt.Println("Honoring .gitignore files in all subdirectories.")
+		}
+		files, err = getAllFiles(".", excludePatterns, filterPatterns, nil)
+	}
+	if err != nil {
+		if vanished := checkRootStillExists(); vanished != nil {
+			return nil, vanished
+		}
+		return nil, fmt.Errorf("failed to get file list: %w", err)
+	}
+
+	if packExcludePercentile > 0 {
+		files = excludeAbovePercentile(files, packExcludePercentile)
+	}
+
+	if len(files) == 0 {
+		return nil, errors.New("no relevant files found to concatenate")
+	}
+
+	return prioritizeReadme(files), nil
+}
+
+// packEachSubdir packs every immediate, non-excluded subdirectory of the current directory
+// into its own archive. outputTemplate is an absolute path in which '{dir}' is replaced by the
+// subdirectory name; when empty, '<dir>.paktxt' is written to the current directory.
+func packEachSubdir(outputTemplate string, excludePatterns, filterPatterns []string) error {
+	root, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to determine working directory: %w", err)
+	}
+	if outputTemplate == "" {
+		outputTemplate = filepath.Join(root, "{dir}"+paktxtExtension)
+	} else if !strings.Contains(outputTemplate, "{dir}") {
+		return errors.New("--output-file must contain '{dir}' when used with --split-by-dir")
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %w", root, err)
+	}
+
+	packed, failed := 0, 0
+	for _, entry := range entries {
+		if !entry.IsDir() || shouldExcludeDir(entry.Name()) {
+			continue
+		}
+		outputFile := strings.ReplaceAll(outputTemplate, "{dir}", entry.Name())
+		if err := os.MkdirAll(filepath.Dir(outputFile), 0755); err != nil {
+			return fmt.Errorf("failed to create output directory for %s: %w", outputFile, err)
+		}
+
+		fmt.Printf("\n== Packing directory %s ==\n", entry.Name())
+		if err := os.Chdir(filepath.Join(root, entry.Name())); err != nil {
+			return fmt.Errorf("failed to enter directory %s: %w", entry.Name(), err)
+		}
+		packErr := concatenateAndOutput(false, outputFile, excludePatterns, filterPatterns, nil)
+		if err := os.Chdir(root); err != nil {
+			return fmt.Errorf("failed to return to %s: %w", root, err)
+		}
+		if packErr != nil {
+			warnf(warnSkipped, entry.Name(), "Skipping directory %s: %v", entry.Name(), packErr)
+			failed++
+			continue
+		}
+		packed++
+	}
+
+	fmt.Printf("\nPacked %d directory archive(s), %d skipped.\n", packed, failed)
+	if packed == 0 {
+		return errors.New("no subdirectories produced an archive")
+	}
+	return nil
+}
+
+// defaultFileMode is the mode of a file written without an explicit mode: 0644 less the
+// process umask, as os.WriteFile would create it.
+func defaultFileMode() os.FileMode {
+	return 0644 &^ processUmask()
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it into place
+// once fully written, so a failed write never leaves a partial file at path.
+// The temporary file is removed on any error. perm is applied exactly, as Chmod ignores the
+// umask; callers without an explicit mode pass defaultFileMode().
+func writeFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// excludeAbovePercentile drops files whose size exceeds the given percentile of the
+// collected size distribution (nearest-rank method) and reports what was dropped.
+func excludeAbovePercentile(files []string, percentile float64) []string {
+	sizes := make(map[string]int64, len(files))
+	sorted := make([]int64, 0, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			warnf(warnUnreadable, file, "Could not get file info for %s: %v", file, err)
+			continue
+		}
+		sizes[file] = info.Size()
+		sorted = append(sorted, info.Size())
+	}
+	if len(sorted) == 0 {
+		return files
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	rank := int(math.Ceil(percentile / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	threshold := sorted[rank-1]
+
+	var kept []string
+	for _, file := range files {
+		size, ok := sizes[file]
+		if ok && size > threshold {
+			fmt.Printf("Skipping file above the %gth size percentile (%d bytes > %d bytes): %s\n", percentile, size, threshold, file)
+			recordEvent(eventSkipped, file, "above the %gth size percentile (%d bytes > %d bytes)", percentile, size, threshold)
+			continue
+		}
+		kept = append(kept, file)
+	}
+	if dropped := len(files) - len(kept); dropped > 0 {
+		fmt.Printf("Excluded %d file(s) above the %gth size percentile (%d bytes).\n", dropped, percentile, threshold)
+	}
+	return kept
+}
+
+func prioritizeReadme(files []string) []string {
+	readmeIndex := -1
+	for i, file := range files {
+		if strings.EqualFold(filepath.Base(file), "readme.md") {
+			readmeIndex = i
+			break
+		}
+	}
+
+	if readmeIndex != -1 {
+		readmeFile := files[readmeIndex]
+		files = append(files[:readmeIndex], files[readmeIndex+1:]...)
+		files = append([]string{readmeFile}, files...)
+	}
+	return files
+}
+
+// restoreFiles reads paktxt content from the clipboard or a file and restores it.
+// It returns the paths of the files that were actually written.
+func restoreFiles(fromClipboard bool, paktxtFile string, excludePatterns, filterPatterns, includePatterns []string) ([]string, error) {
+	if fromClipboard {
+		fmt.Println("Reading content from clipboard for restoration...")
+	} else {
+		fmt.Printf("Reading content from file '%s' for restoration...\n", paktxtFile)
+	}
+	var paktxtBytes []byte
+	if fromClipboard {
+		data, err := readPaktxtInput(fromClipboard, paktxtFile)
+		if err != nil {
+			return nil, err
+		}
+		paktxtBytes = data
+	} else {
+		data, release, err := readArchiveFile(paktxtFile)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		paktxtBytes = data
+	}
+	if unpackVerifyKey != nil {
+		if err := verifyArchiveSignature(paktxtBytes, unpackVerifyKey); err != nil {
+			return nil, err
+		}
+		fmt.Println("Signature verified.")
+	}
+	body, _, _ := splitSignature(paktxtBytes)
+	if _, ref, ok := splitBaseRef(body); ok {
+		fmt.Printf("Incremental archive: it only holds changes since base archive %s, which must be restored first.\n", ref)
+	}
+
+	if len(paktxtBytes) > 0 && paktxtBytes[len(paktxtBytes)-1] != '\n' {
+		// Harmless when the last block is complete, which the parser checks; worth knowing
+		// because a cut-off paste or download also ends this way.
+		warnf(warnMetadata, "", "The archive does not end with a newline; it may have been truncated. Complete blocks are restored.")
+	}
+	if unpackTarOutput != nil {
+		fmt.Println("Parsing content and writing a tar stream...")
+		if err := writeTarStream(unpackTarOutput, paktxtBytes, excludePatterns, filterPatterns); err != nil {
+			return nil, fmt.Errorf("failed to write tar stream: %w", err)
+		}
+		return nil, nil
+	}
+
+	if _, err := os.Getwd(); err != nil {
+		return nil, fmt.Errorf("the working directory no longer exists or cannot be resolved: %w", err)
+	}
+	fmt.Println("Parsing content and restoring files...")
+	// Pass includePatterns as nil or an empty slice if it's no longer used
+	restored, err := parseAndRestore(paktxtBytes, excludePatterns, filterPatterns, nil)
+	if err != nil {
+		return restored, fmt.Errorf("failed to parse and restore files: %w", err)
+	}
+	return restored, nil
+}
+
+// clipboardKillGrace is how long runClipboardOp waits, after a timeout, for the operation to
+// return once its clipboard command has been killed.
+const clipboardKillGrace = time.Second
+
+// runClipboardOp runs a blocking clipboard operation in a goroutine. On a terminal it shows
+// a spinner with the elapsed time, and it gives up with an error once clipboardTimeout
+// (if set) elapses, since clipboard backends such as wl-copy can stall indefinitely. The
+// timeout cancels op's context, which kills a clipboard command paktxt started itself. The
+// clipboard library, which reads the clipboard and copies on Windows, cannot be interrupted:
+// its command is left running, and the timeout only returns control.
+func runClipboardOp(description string, op func(ctx context.Context) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- op(ctx) }()
+
+	var timeout <-chan time.Time
+	if clipboardTimeout > 0 {
+		timer := time.NewTimer(clipboardTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	interactive := isTerminal(os.Stderr)
+	ticker := time.NewTicker(150 * time.Millisecond)
+	defer ticker.Stop()
+	spinner := `|/-\`
+	start := time.Now()
+	for frame := 0; ; frame++ {
+		select {
+		case err := <-done:
+			if interactive {
+				fmt.Fprint(os.Stderr, "\r\033[K")
+			}
+			return err
+		case <-timeout:
+			cancel()
+			select {
+			case <-done: // The command was killed
+			case <-time.After(clipboardKillGrace):
+			}
+			if interactive {
+				fmt.Fprint(os.Stderr, "\r\033[K")
+			}
+			return fmt.Errorf("clipboard backend did not respond within %s", clipboardTimeout)
+		case <-ticker.C:
+			if interactive {
+				fmt.Fprintf(os.Stderr, "\r%s %c %.1fs", description, spinner[frame%len(spinner)], time.Since(start).Seconds())
+			}
+		}
+	}
+}
+
+// isTerminal reports whether f is attached to a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// formatByteSize renders a byte count in a human-readable form (e.g., "1.5 MiB").
+func formatByteSize(n int) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := unit, 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// readPaktxtInput reads archive content from the clipboard or from paktxtFile. Files are read
+// into memory rather than mapped, as the callers keep the parsed blocks.
+func readPaktxtInput(fromClipboard bool, paktxtFile string) ([]byte, error) {
+	var data []byte
+	var err error
+	if fromClipboard {
+		data, err = readClipboardArchive()
+	} else {
+		data, err = readArchiveBytes(paktxtFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("input content (from clipboard or file) is empty or contains no parsable paktxt data")
+	}
+	return data, nil
+}
+
+// readClipboardArchive reads archive content from the clipboard and decodes it.
+func readClipboardArchive() ([]byte, error) {
+	var paktxtContent string
+	err := runClipboardOp("Reading from clipboard", func(context.Context) error {
+		var readErr error
+		paktxtContent, readErr = clipboard.ReadAll()
+		return readErr
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Failed to read from clipboard: %v\n", err)
+		fmt.Fprintln(os.Stderr, "This might be due to system restrictions or lack of clipboard content.")
+		return nil, fmt.Errorf("clipboard read failed: %w", err)
+	}
+	if paktxtContent == "" {
+		return nil, errors.New("clipboard content is empty; no parsable paktxt data found")
+	}
+	fmt.Fprintf(os.Stderr, "Read %s from clipboard.\n", formatByteSize(len(paktxtContent)))
+	decoded, err := decodeArchive([]byte(paktxtContent))
+	if err != nil {
+		return nil, fmt.Errorf("clipboard content: %w", err)
+	}
+	return decoded, nil
+}
+
+// mmapThreshold is the archive size above which readArchiveFile memory-maps the file
+// instead of copying it into memory.
+const mmapThreshold = 64 << 20
+
+// readArchiveFile returns the bytes of an archive file. Archives larger than mmapThreshold
+// are memory-mapped where the platform supports it, falling back to os.ReadFile. The data
+// is only valid until release is called.
+func readArchiveFile(paktxtFile string) (data []byte, release func(), err error) {
+	noop := func() {}
+	info, err := os.Stat(paktxtFile)
+	if err == nil && info.IsDir() {
+		return nil, noop, fmt.Errorf("expected a .paktxt file, got a directory '%s'; did you mean to run pack?", paktxtFile)
+	}
+	if err == nil && info.Size() > mmapThreshold && int64(int(info.Size())) == info.Size() {
+		if f, openErr := os.Open(paktxtFile); openErr == nil {
+			data, unmap, mapErr := mapFile(f, int(info.Size()))
+			f.Close() // The mapping stays valid after the descriptor is closed
+			if mapErr == nil && (isGzip(data) || archiveEncoding(data) == encodingBase64) {
+				plain, err := decodeArchiveFile(paktxtFile, data)
+				unmap()
+				return plain, noop, err
+			}
+			if mapErr == nil {
+				return bytes.TrimPrefix(data, utf8BOM), unmap, nil
+			}
+		}
+	}
+	data, err = readArchiveBytes(paktxtFile)
+	return data, noop, err
+}
+
+// readArchiveBytes reads and decodes an archive file like readArchiveFile, but always into
+// memory: for callers that keep slices of the data, such as parsed blocks, with no point at
+// which a mapping could be released.
+func readArchiveBytes(paktxtFile string) ([]byte, error) {
+	if info, err := os.Stat(paktxtFile); err == nil && info.IsDir() {
+		return nil, fmt.Errorf("expected a .paktxt file, got a directory '%s'; did you mean to run pack?", paktxtFile)
+	}
+	data, err := os.ReadFile(paktxtFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from paktxt file '%s': %w", paktxtFile, err)
+	}
+	if len(data) == 0 {
+		return nil, errors.New("input content (from clipboard or file) is empty or contains no parsable paktxt data")
+	}
+	return decodeArchiveFile(paktxtFile, data)
+}
+
+// decodeArchiveFile undoes 'pack --compress' and '--output-encoding' on the contents of an
+// archive file, returning plain archive bytes.
+func decodeArchiveFile(paktxtFile string, data []byte) ([]byte, error) {
+	var err error
+	if isGzip(data) {
+		if data, err = gunzipArchive(paktxtFile, data); err != nil {
+			return nil, err
+		}
+	}
+	if data, err = decodeArchive(data); err != nil {
+		return nil, fmt.Errorf("failed to decode '%s': %w", paktxtFile, err)
+	}
+	return data, nil
+}
+
+// archiveEncoding detects the --output-encoding of archive data: a leading byte order mark
+// means utf8-bom, and a leading base64Marker line means base64.
+func archiveEncoding(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, utf8BOM):
+		return encodingUTF8BOM
+	case bytes.HasPrefix(data, []byte(base64Marker)):
+		return encodingBase64
+	}
+	return encodingUTF8
+}
+
+// encodeArchive applies --output-encoding to a complete archive. base64 output is the marker
+// line followed by the encoded archive in lines of 76 characters.
+func encodeArchive(content, encoding string) string {
+	switch encoding {
+	case encodingUTF8BOM:
+		return string(utf8BOM) + content
+	case encodingBase64:
+		encoded := base64.StdEncoding.EncodeToString([]byte(content))
+		var builder strings.Builder
+		builder.WriteString(base64Marker + "\n")
+		for len(encoded) > 76 {
+			builder.WriteString(encoded[:76] + "\n")
+			encoded = encoded[76:]
+		}
+		builder.WriteString(encoded + "\n")
+		return builder.String()
+	}
+	return content
+}
+
+// decodeArchive returns the plain archive for data in any --output-encoding. Whitespace in
+// base64 content is ignored, so rewrapped or CRLF-converted text still decodes.
+func decodeArchive(data []byte) ([]byte, error) {
+	switch archiveEncoding(data) {
+	case encodingUTF8BOM:
+		return data[len(utf8BOM):], nil
+	case encodingBase64:
+		encoded := strings.Join(strings.Fields(string(data[len(base64Marker):])), "")
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64-encoded archive: %w", err)
+		}
+		return decoded, nil
+	}
+	return data, nil
+}
+
+// isGzip reports whether data starts with the gzip magic number.
+func isGzip(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// gunzipArchive decompresses an archive written with 'pack --compress'.
+func gunzipArchive(paktxtFile string, data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err == nil {
+		data, err = io.ReadAll(reader)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress paktxt file '%s': %w", paktxtFile, err)
+	}
+	return data, nil
+}
+
+// printBlockInfo prints the metadata of the block stored under filename as indented JSON.
+func printBlockInfo(fromClipboard bool, paktxtFile, filename string) error {
+	paktxtContent, err := readPaktxtInput(fromClipboard, paktxtFile)
+	if err != nil {
+		return err
+	}
+	blocks, err := parseBlocks(paktxtContent)
+	if err != nil {
+		return fmt.Errorf("failed to parse paktxt content: %w", err)
+	}
+
+	wanted := filepath.ToSlash(filepath.Clean(filename))
+	for _, block := range blocks {
+		if filepath.ToSlash(filepath.Clean(block.Filename)) != wanted {
+			continue
+		}
+		out, err := json.MarshalIndent(block, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode metadata for %s: %w", block.Filename, err)
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+	return fmt.Errorf("file '%s' not found in archive (%d file(s) present)", filename, len(blocks))
+}
+
+// Tokenizers for 'info --tokens'. Any other --tokenizer value is a shell command.
+const (
+	tokenizerEstimate = "estimate"
+	tokenizerTiktoken = "tiktoken"
+)
+
+// tiktokenScript counts the tokens of each string of a JSON array read from stdin, one count
+// per line, so that python and tiktoken are loaded once for the whole archive.
+const tiktokenScript = `import json, sys
+import tiktoken
+enc = tiktoken.get_encoding("cl100k_base")
+for text in json.load(sys.stdin):
+    print(len(enc.encode(text, disallowed_special=())))
+`
+
+// printTokenReport prints the estimated token count of the whole archive, as it would be
+// pasted, and the files whose content uses the most tokens.
+func printTokenReport(fromClipboard bool, paktxtFile, tokenizer string, top int) error {
+	paktxtContent, err := readPaktxtInput(fromClipboard, paktxtFile)
+	if err != nil {
+		return err
+	}
+	blocks, err := parseBlocks(paktxtContent)
+	if err != nil {
+		return fmt.Errorf("failed to parse paktxt content: %w", err)
+	}
+	if err := loadStoreObjects(blocks); err != nil {
+		return err
+	}
+
+	texts := [][]byte{paktxtContent}
+	for _, block := range blocks {
+		texts = append(texts, block.Content)
+	}
+	counts, err := countTokens(tokenizer, texts)
+	if err != nil {
+		return err
+	}
+	total, perFile := counts[0], counts[1:]
+	order := make([]int, len(blocks))
+	contentTokens := 0
+	for i := range blocks {
+		order[i] = i
+		contentTokens += perFile[i]
+	}
+	sort.SliceStable(order, func(a, b int) bool { return perFile[order[a]] > perFile[order[b]] })
+
+	fmt.Printf("Archive: %d tokens (%s) in %s; file contents %d, headers and metadata %d.\n",
+		total, tokenizer, formatByteSize(len(paktxtContent)), contentTokens, max(total-contentTokens, 0))
+	inStore := 0
+	for _, block := range blocks {
+		if contentInStore(block) {
+			inStore++
+		}
+	}
+	if inStore > 0 {
+		fmt.Printf("%d file(s) keep their content in a content store and are not counted; pass --store to include them.\n", inStore)
+	}
+	if top == 0 || top > len(order) {
+		top = len(order)
+	}
+	share := func(n int) float64 {
+		if contentTokens == 0 {
+			return 0
+		}
+		return float64(n) * 100 / float64(contentTokens)
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "FILE\tTOKENS\tSHARE")
+	for _, i := range order[:top] {
+		if contentInStore(blocks[i]) {
+			fmt.Fprintf(writer, "%s\tin store\t-\n", blocks[i].Filename)
+			continue
+		}
+		fmt.Fprintf(writer, "%s\t%d\t%.1f%%\n", blocks[i].Filename, perFile[i], share(perFile[i]))
+	}
+	if rest := order[top:]; len(rest) > 0 {
+		restTokens := 0
+		for _, i := range rest {
+			restTokens += perFile[i]
+		}
+		fmt.Fprintf(writer, "(%d more files)\t%d\t%.1f%%\n", len(rest), restTokens, share(restTokens))
+	}
+	return writer.Flush()
+}
+
+// countTokens returns the number of tokens of each text with the given --tokenizer.
+func countTokens(tokenizer string, texts [][]byte) ([]int, error) {
+	counts := make([]int, len(texts))
+	switch tokenizer {
+	case tokenizerEstimate:
+		for i, text := range texts {
+			counts[i] = estimateTokens(text)
+		}
+	case tokenizerTiktoken:
+		strs := make([]string, len(texts))
+		for i, text := range texts {
+			strs[i] = string(text)
+		}
+		input, err := json.Marshal(strs)
+		if err != nil {
+			return nil, err
+		}
+		cmd := exec.Command("python3", "-c", tiktokenScript)
+		cmd.Stdin = bytes.NewReader(input)
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("--tokenizer tiktoken needs python3 with the tiktoken package ('pip install tiktoken'): %w", err)
+		}
+		lines := strings.Fields(string(output))
+		if len(lines) != len(texts) {
+			return nil, fmt.Errorf("tiktoken printed %d counts for %d texts", len(lines), len(texts))
+		}
+		for i, line := range lines {
+			if counts[i], err = strconv.Atoi(line); err != nil {
+				return nil, fmt.Errorf("tiktoken printed an invalid count %q", line)
+			}
+		}
+	default:
+		for i, text := range texts {
+			cmd := shellCommand(context.Background(), tokenizer)
+			cmd.Stdin = bytes.NewReader(text)
+			cmd.Stderr = os.Stderr
+			output, err := cmd.Output()
+			if err != nil {
+				return nil, fmt.Errorf("tokenizer %q failed: %w", tokenizer, err)
+			}
+			count, err := strconv.Atoi(strings.TrimSpace(string(output)))
+			if err != nil || count < 0 {
+				return nil, fmt.Errorf("tokenizer %q printed %q instead of a token count", tokenizer, strings.TrimSpace(string(output)))
+			}
+			counts[i] = count
+		}
+	}
+	return counts, nil
+}
+
+// estimateTokens approximates the token count of text without a tokenizer: one token per
+// started group of 4 characters in each whitespace-separated word. For English prose and
+// code, BPE tokenizers usually land within about a quarter of it.
+func estimateTokens(text []byte) int {
+	tokens := 0
+	for _, word := range bytes.Fields(text) {
+		tokens += (utf8.RuneCount(word) + 3) / 4
+	}
+	return tokens
+}
+
+// listArchives prints a summary row for each archive matched by patterns, with the newest
+// recorded file modtime. Archives that cannot be read or parsed get an error row; an error is
+// returned if any of them failed.
+func listArchives(patterns []string, preview int, long, byExt bool, filterPatterns, excludePatterns []string) error {
+	var paths []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil || len(matches) == 0 {
+			paths = append(paths, pattern) // Reported as unreadable below
+			continue
+		}
+		paths = append(paths, matches...)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "ARCHIVE\tFORMAT\tFILES\tSIZE\tNEWEST")
+	failed := 0
+	archived := make(map[string][]*FileBlock) // For --long, --by-ext and --preview
+	for _, path := range paths {
+		content, err := readPaktxtInput(false, path)
+		var blocks []*FileBlock
+		if err == nil {
+			blocks, err = parseBlocks(content)
+		}
+		if err == nil {
+			err = loadStoreObjects(blocks)
+		}
+		if err != nil {
+			fmt.Fprintf(writer, "%s\t-\t-\terror: %v\n", path, err)
+			failed++
+			continue
+		}
+		format := formatV1
+		if bytes.HasPrefix(content, []byte(v2Magic)) {
+			format = formatV2
+		}
+		// Archives record neither a title nor when they were packed; the newest modtime of the
+		// files is the closest, for archives packed with --modtime.
+		total, newest, newestTime := 0, "-", time.Time{}
+		for _, block := range blocks {
+			total += contentSize(block)
+			if modTime, err := time.Parse(time.RFC3339, block.ModTime); err == nil && modTime.After(newestTime) {
+				newest, newestTime = block.ModTime, modTime
+			}
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%s\t%s\n", path, format, len(blocks), formatByteSize(total), newest)
+		archived[path] = blocks
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	selected := func(block *FileBlock) bool {
+		if len(filterPatterns) > 0 && !matchesPattern(block.Filename, filterPatterns) {
+			return false
+		}
+		return !matchesPattern(block.Filename, excludePatterns)
+	}
+	if long {
+		for _, path := range paths {
+			if _, ok := archived[path]; !ok {
+				continue
+			}
+			fmt.Printf("\n==> %s <==\n", path)
+			if err := printLongListing(archived[path], selected); err != nil {
+				return err
+			}
+		}
+	}
+	if byExt {
+		for _, path := range paths {
+			if _, ok := archived[path]; !ok {
+				continue
+			}
+			fmt.Printf("\n==> %s <==\n", path)
+			if err := printExtensionBreakdown(archived[path], selected); err != nil {
+				return err
+			}
+		}
+	}
+	if preview > 0 {
+		for _, path := range paths {
+			for _, block := range archived[path] {
+				if !selected(block) {
+					continue
+				}
+				fmt.Printf("\n==> %s: %s <==\n", path, block.Filename)
+				printPreview(block, preview)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d archive(s) could not be read", failed, len(paths))
+	}
+	return nil
+}
+
+// listHashLength is the number of hex digits of the SHA-256 that 'list --long' prints.
+const listHashLength = 12
+
+// noExtensionLabel groups files without an extension in 'list --by-ext'.
+const noExtensionLabel = "(none)"
+
+// printExtensionBreakdown prints, for 'list --by-ext', the number of selected blocks and their
+// total content size per lower-case extension, by total size descending. Names without a dot
+// and dotfiles such as '.gitignore' are counted under noExtensionLabel.
+func printExtensionBreakdown(blocks []*FileBlock, selected func(*FileBlock) bool) error {
+	type extensionTotal struct {
+		ext          string
+		files, bytes int
+	}
+	totals := make(map[string]*extensionTotal)
+	sum := 0
+	for _, block := range blocks {
+		if !selected(block) {
+			continue
+		}
+		base := path.Base(filepath.ToSlash(block.Filename))
+		ext := strings.ToLower(path.Ext(base))
+		if ext == "" || ext == strings.ToLower(base) {
+			ext = noExtensionLabel
+		}
+		if totals[ext] == nil {
+			totals[ext] = &extensionTotal{ext: ext}
+		}
+		totals[ext].files++
+		totals[ext].bytes += contentSize(block)
+		sum += contentSize(block)
+	}
+	sorted := make([]*extensionTotal, 0, len(totals))
+	for _, total := range totals {
+		sorted = append(sorted, total)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].bytes != sorted[j].bytes {
+			return sorted[i].bytes > sorted[j].bytes
+		}
+		return sorted[i].ext < sorted[j].ext
+	})
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "EXTENSION\tFILES\tSIZE\tSHARE")
+	for _, total := range sorted {
+		share := 0.0
+		if sum > 0 {
+			share = float64(total.bytes) * 100 / float64(sum)
+		}
+		fmt.Fprintf(writer, "%s\t%d\t%s\t%.1f%%\n", total.ext, total.files, formatByteSize(total.bytes), share)
+	}
+	return writer.Flush()
+}
+
+// printLongListing prints one row per selected block with its exact size, mode, trailing
+// newline and a short hash of its content. Hashes are computed from the content, so listings
+// of two archives can be compared with diff. A store block without --store shows its SHA-256
+// reference, or "-" for one stored under another algorithm.
+func printLongListing(blocks []*FileBlock, selected func(*FileBlock) bool) error {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "FILE\tSIZE\tMODE\tNEWLINE\tSHA256")
+	for _, block := range blocks {
+		if !selected(block) {
+			continue
+		}
+		mode := "-"
+		if block.Symlink != "" {
+			mode = "symlink"
+		} else if block.IsExecutable {
+			mode = "exec"
+		}
+		newline := "no"
+		if block.HasTrailingNewline {
+			newline = "yes"
+		}
+		digest := fmt.Sprintf("%x", sha256.Sum256(block.Content))
+		if contentInStore(block) {
+			digest = "-"
+			if algo, hex, _ := splitObjectRef(block.Object); algo == "sha256" {
+				digest = hex
+			}
+		}
+		fmt.Fprintf(writer, "%s\t%d\t%s\t%s\t%s\n", block.Filename, contentSize(block), mode, newline, digest[:min(len(digest), listHashLength)])
+	}
+	return writer.Flush()
+}
+
+// previewLineWidth is the number of characters of a line that 'list --preview' prints.
+const previewLineWidth = 160
+
+// printPreview prints the first n lines of a block, cutting long lines at previewLineWidth
+// characters. Binary-looking content and symlinks get a one-line description instead.
+func printPreview(block *FileBlock, n int) {
+	content := block.Content
+	switch {
+	case block.Symlink != "":
+		fmt.Printf("(symlink to %s)\n", block.Symlink)
+		return
+	case contentInStore(block):
+		fmt.Printf("(content in store, %s; pass --store to preview it)\n", formatByteSize(contentSize(block)))
+		return
+	case len(content) == 0:
+		fmt.Println("(empty)")
+		return
+	case !utf8.Valid(content) || bytes.IndexByte(content, 0) != -1:
+		fmt.Printf("(binary content, %s)\n", formatByteSize(len(content)))
+		return
+	}
+
+	lines := bytes.Split(bytes.TrimSuffix(content, []byte("\n")), []byte("\n"))
+	for _, line := range lines[:min(n, len(lines))] {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if utf8.RuneCount(line) > previewLineWidth {
+			cut := 0
+			for i := 0; i < previewLineWidth; i++ {
+				_, size := utf8.DecodeRune(line[cut:])
+				cut += size
+			}
+			fmt.Printf("%s… (%s more)\n", line[:cut], formatByteSize(len(line)-cut))
+			continue
+		}
+		fmt.Printf("%s\n", line)
+	}
+	if len(lines) > n {
+		fmt.Printf("... (%d more line(s))\n", len(lines)-n)
+	}
+}
+
+// signArchive appends a signature trailer over the exact archive bytes.
+func signArchive(content string, key ed25519.PrivateKey) string {
+	signature := ed25519.Sign(key, []byte(content))
+	return content + signaturePrefix + base64.StdEncoding.EncodeToString(signature) + "\n"
+}
+
+// splitSignature separates a trailing signature line from the archive bytes it signs.
+func splitSignature(data []byte) (body, signature []byte, ok bool) {
+	trimmed := bytes.TrimRight(data, "\r\n")
+	lineStart := bytes.LastIndexByte(trimmed, '\n') + 1
+	if !bytes.HasPrefix(trimmed[lineStart:], []byte(signaturePrefix)) {
+		return data, nil, false
+	}
+	signature, err := base64.StdEncoding.DecodeString(string(trimmed[lineStart+len(signaturePrefix):]))
+	if err != nil {
+		return data, nil, false
+	}
+	return data[:lineStart], signature, true
+}
+
+// splitBaseRef separates the PAKTXT-BASE trailer line written by --since-archive from the
+// archive body. It expects any signature trailer to have been removed already.
+func splitBaseRef(data []byte) (body []byte, ref string, ok bool) {
+	trimmed := bytes.TrimRight(data, "\r\n")
+	lineStart := bytes.LastIndexByte(trimmed, '\n') + 1
+	if !bytes.HasPrefix(trimmed[lineStart:], []byte(baseRefPrefix)) {
+		return data, "", false
+	}
+	return data[:lineStart], string(trimmed[lineStart+len(baseRefPrefix):]), true
+}
+
+// verifyArchiveSignature checks the signature trailer of data against key.
+func verifyArchiveSignature(data []byte, key ed25519.PublicKey) error {
+	body, signature, ok := splitSignature(data)
+	if !ok {
+		return errors.New("archive is not signed; refusing to restore with --verify-sig")
+	}
+	if !ed25519.Verify(key, body, signature) {
+		return errors.New("archive signature is invalid: the content was modified or signed with a different key")
+	}
+	return nil
+}
+
+// generateKeyPair writes a new ed25519 key pair to prefix.key (private, mode 0600) and
+// prefix.pub, refusing to overwrite existing files.
+func generateKeyPair(prefix string) error {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key pair: %w", err)
+	}
+	keys := []struct {
+		path string
+		data []byte
+		perm os.FileMode
+	}{
+		{prefix + ".key", private.Seed(), 0600},
+		{prefix + ".pub", public, 0644},
+	}
+	for _, key := range keys {
+		if pathExists(key.path) {
+			return fmt.Errorf("'%s' already exists; refusing to overwrite it", key.path)
+		}
+	}
+	for _, key := range keys {
+		encoded := base64.StdEncoding.EncodeToString(key.data) + "\n"
+		if err := os.WriteFile(key.path, []byte(encoded), key.perm); err != nil {
+			return fmt.Errorf("failed to write %s: %w", key.path, err)
+		}
+		fmt.Printf("Wrote %s\n", key.path)
+	}
+	return nil
+}
+
+// readKeyFile reads a base64-encoded key written by 'paktxt keygen' and checks its length.
+func readKeyFile(path string, size int) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file '%s': %w", path, err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != size {
+		return nil, fmt.Errorf("'%s' is not a valid key file (expected %d base64-encoded bytes)", path, size)
+	}
+	return key, nil
+}
+
+// absStoreDir makes storeDir absolute, so that it still resolves against the directory paktxt
+// was started in after --working-dir or --walk-root.
+func absStoreDir() error {
+	if storeDir == "" {
+		return nil
+	}
+	if err := expandPathFlags(&storeDir); err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(storeDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve --store '%s': %w", storeDir, err)
+	}
+	storeDir = abs
+	return nil
+}
+
+// storeObjectPath returns where the object of a valid reference lives in the store:
+// objects/<algorithm>/<first two digits>/<remaining digits>, like git's loose objects.
+func storeObjectPath(ref string) string {
+	algo, digest, _ := splitObjectRef(ref)
+	return filepath.Join(storeDir, "objects", algo, digest[:2], digest[2:])
+}
+
+// splitObjectRef splits an object reference into its algorithm and lower-case hex digest, and
+// reports whether the algorithm is one of hashAlgos and the digest has its length. References
+// come from the archive, so anything else is rejected before it becomes part of a path.
+func splitObjectRef(ref string) (algo, digest string, ok bool) {
+	algo, digest, found := strings.Cut(ref, ":")
+	newHash, known := hashAlgos[algo]
+	if !found || !known || len(digest) != 2*newHash().Size() {
+		return "", "", false
+	}
+	for _, c := range digest {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return "", "", false
+		}
+	}
+	return algo, digest, true
+}
+
+// storeBlockContent moves the content of block out for the --store store, leaving only the
+// reference in the block, and returns the content. Nothing is written until the encoded
+// block is known to fit; see writeStoreObject.
+func storeBlockContent(block *FileBlock) []byte {
+	hash := hashAlgos[packHashAlgo]()
+	hash.Write(block.Content)
+	content := block.Content
+	block.Object, block.ObjectSize = fmt.Sprintf("%s:%x", packHashAlgo, hash.Sum(nil)), len(content)
+	block.Content = nil
+	block.Size = 0
+	return content
+}
+
+// writeStoreObject writes the object of a block prepared by storeBlockContent, unless one
+// with the same digest already exists. It reports whether a new object was written.
+func writeStoreObject(block *FileBlock, content []byte) (bool, error) {
+	objectPath := storeObjectPath(block.Object)
+	if pathExists(objectPath) {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0755); err != nil {
+		return false, fmt.Errorf("failed to create content store directory: %w", err)
+	}
+	if err := writeFileAtomic(objectPath, content, defaultFileMode()); err != nil {
+		return false, fmt.Errorf("failed to store the content of %s: %w", block.Filename, err)
+	}
+	return true, nil
+}
+
+// contentSize returns the size of a block's file content: the recorded object size for a
+// --store block, whose content is not in the archive.
+func contentSize(block *FileBlock) int {
+	if block.Object != "" {
+		return block.ObjectSize
+	}
+	return len(block.Content)
+}
+
+// contentInStore reports whether the content of a block is in a --store store that 'list'
+// or 'info' was not given, so that only its size is known.
+func contentInStore(block *FileBlock) bool {
+	return block.Object != "" && storeDir == ""
+}
+
+// loadStoreObjects reads the --store objects of blocks, for 'list' and 'info' given --store.
+func loadStoreObjects(blocks []*FileBlock) error {
+	if storeDir == "" {
+		return nil
+	}
+	for _, block := range blocks {
+		if err := loadStoreObject(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// objectValue returns the value of a store block's 'object:' label: the reference and the
+// size of the object in bytes, so that listings need not read the store.
+func objectValue(block *FileBlock) string {
+	return block.Object + " " + strconv.Itoa(block.ObjectSize)
+}
+
+// parseObjectValue splits the value of an 'object:' label into the reference and the size.
+// The reference is validated when the object is opened.
+func parseObjectValue(value string) (string, int, error) {
+	ref, sizeStr, found := strings.Cut(value, " ")
+	size, err := strconv.Atoi(sizeStr)
+	if !found || err != nil || size < 0 {
+		return "", 0, fmt.Errorf("invalid object %q", value)
+	}
+	return ref, size, nil
+}
+
+// loadStoreObject fills in the content of a block that references a --store object, checking
+// it against the digest. Blocks with inline content are left alone.
+func loadStoreObject(block *FileBlock) error {
+	if block.Object == "" {
+		return nil
+	}
+	object, err := openStoreObject(block)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+	var content bytes.Buffer
+	if info, err := object.Stat(); err == nil {
+		content.Grow(int(info.Size()))
+	}
+	if _, err := copyStoreObject(block, object, &content); err != nil {
+		return err
+	}
+	block.Content = content.Bytes()
+	block.Size = content.Len()
+	return nil
+}
+
+// openStoreObject opens the --store object a block references.
+func openStoreObject(block *FileBlock) (*os.File, error) {
+	if _, _, ok := splitObjectRef(block.Object); !ok {
+		return nil, fmt.Errorf("invalid object reference %q for %s", block.Object, block.Filename)
+	}
+	if storeDir == "" {
+		return nil, fmt.Errorf("the content of %s is in a content store; pass the store directory with --store", block.Filename)
+	}
+	object, err := os.Open(storeObjectPath(block.Object))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the content of %s from the store: %w", block.Filename, err)
+	}
+	return object, nil
+}
+
+// copyStoreObject copies a store object to dst and checks it against the block's digest,
+// which is computed with the referenced algorithm while the object is read, in one pass over
+// its bytes. dst has received the whole object by the time a mismatch is reported; callers
+// discard it. The reference must be valid.
+func copyStoreObject(block *FileBlock, object io.Reader, dst io.Writer) (int64, error) {
+	algo, digest, _ := splitObjectRef(block.Object)
+	hash := hashAlgos[algo]()
+	n, err := io.Copy(io.MultiWriter(hash, dst), object)
+	if err != nil {
+		return n, fmt.Errorf("failed to read the content of %s from the store: %w", block.Filename, err)
+	}
+	if fmt.Sprintf("%x", hash.Sum(nil)) != digest {
+		return n, fmt.Errorf("object %s for %s does not match its digest; the store is damaged", block.Object, block.Filename)
+	}
+	return n, nil
+}
+
+// streamsStoreObject reports whether the restore copies the --store object of a block
+// straight to the restored file instead of loading it into memory, which keeps memory bounded
+// for large files. Options that read or rewrite the content need it in memory.
+func streamsStoreObject(block *FileBlock) bool {
+	return block.Object != "" && block.Symlink == "" && unpackContentFilter == "" &&
+		len(unpackReplacements) == 0 && unpackLineEnding == lineEndingPreserve &&
+		!unpackTouchOnly && !unpackAutoExec && !unpackForce && !unpackSkipUnchanged &&
+		!(unpackOnConflict == conflictNewer && block.ModTime == "")
+}
+
+// restoreStoreObject writes the --store object of a block to block.Filename through a
+// temporary file next to it, which is renamed into place once the digest matches, so a
+// damaged object leaves the path untouched. It returns the number of bytes written. Like
+// os.WriteFile, it refuses to replace a file it cannot write and keeps an existing file's mode.
+func restoreStoreObject(block *FileBlock) (int, error) {
+	object, err := openStoreObject(block)
+	if err != nil {
+		return 0, err
+	}
+	defer object.Close()
+	mode := 0644 &^ unpackUmask
+	if existing, err := os.OpenFile(block.Filename, os.O_WRONLY, 0); err == nil {
+		if info, err := existing.Stat(); err == nil {
+			mode = info.Mode().Perm()
+		}
+		existing.Close()
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(block.Filename), "."+filepath.Base(block.Filename)+".tmp-*")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	written := 0
+	if block.HasBOM && !unpackStripBOM {
+		if written, err = tmp.Write(utf8BOM); err != nil {
+			return 0, err
+		}
+	}
+	n, err := copyStoreObject(block, object, tmp)
+	if err != nil {
+		return 0, err
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		return 0, err
+	}
+	if err = tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err = os.Rename(tmp.Name(), block.Filename); err != nil {
+		return 0, err
+	}
+	block.Size = int(n)
+	return written + int(n), nil
+}
+
+// collectStoreGarbage removes the objects of the --store store that no archive matched by
+// patterns references. Nothing is removed if any archive cannot be read, since its objects
+// would be lost. Files in the store that are not objects are left alone.
+func collectStoreGarbage(patterns []string, dryRun bool) error {
+	referenced := make(map[string]bool)
+	archives := 0
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil || len(matches) == 0 {
+			matches = []string{pattern} // Reported as unreadable below
+		}
+		for _, path := range matches {
+			content, err := readPaktxtInput(false, path)
+			if err != nil {
+				return fmt.Errorf("nothing removed: %w", err)
+			}
+			blocks, err := parseBlocks(content)
+			if err != nil {
+				return fmt.Errorf("nothing removed: failed to parse '%s': %w", path, err)
+			}
+			for _, block := range blocks {
+				if block.Object != "" {
+					referenced[block.Object] = true
+				}
+			}
+			archives++
+		}
+	}
+
+	objectsDir := filepath.Join(storeDir, "objects")
+	if _, err := os.Stat(objectsDir); err != nil {
+		return fmt.Errorf("'%s' is not a content store: %w", storeDir, err)
+	}
+	var unreferenced []string
+	var freed int64
+	kept := 0
+	err := filepath.WalkDir(objectsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		fanOut := filepath.Dir(path)
+		ref := filepath.Base(filepath.Dir(fanOut)) + ":" + filepath.Base(fanOut) + d.Name()
+		if _, _, ok := splitObjectRef(ref); !ok {
+			return nil
+		}
+		if referenced[ref] {
+			kept++
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			freed += info.Size()
+		}
+		unreferenced = append(unreferenced, path)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan content store '%s': %w", storeDir, err)
+	}
+
+	for _, path := range unreferenced {
+		if dryRun {
+			fmt.Printf("Would remove: %s\n", path)
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove object: %w", err)
+		}
+		// Only succeed once the fan-out and algorithm directories are empty.
+		os.Remove(filepath.Dir(path))
+		os.Remove(filepath.Dir(filepath.Dir(path)))
+	}
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+	fmt.Printf("%s %d unreferenced object(s) (%s); %d object(s) referenced by %d archive(s) kept.\n", verb, len(unreferenced), formatByteSize(int(freed)), kept, archives)
+	return nil
+}
+
+// stageRestoredFiles runs 'git add' on the restored files and, if commitMsg is set,
+// commits them. Outside a git repository it reports that nothing was staged and returns nil.
+func stageRestoredFiles(files []string, commitMsg string) error {
+	if !gitAvailable() {
+		fmt.Println("Skipping git staging.")
+		return nil
+	}
+	if !isGitRepo() {
+		fmt.Println("Not inside a git repository; skipping git staging.")
+		return nil
+	}
+	if len(files) == 0 {
+		fmt.Println("No files were restored; nothing to stage.")
+		return nil
+	}
+
+	args := append([]string{"add", "--"}, files...)
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git add failed: %w", err)
+	}
+	for _, file := range files {
+		fmt.Printf("Staged: %s\n", file)
+	}
+	fmt.Printf("Staged %d restored file(s).\n", len(files))
+
+	if commitMsg == "" {
+		return nil
+	}
+	// Files that already match HEAD leave nothing to commit, which git would report as a failure.
+	args = append([]string{"diff", "--cached", "--quiet", "--"}, files...)
+	if err := exec.Command("git", args...).Run(); err == nil {
+		fmt.Println("Restored files match HEAD; nothing to commit.")
+		return nil
+	} else if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		return fmt.Errorf("git diff failed: %w", err)
+	}
+	// Only commit the restored paths so unrelated staged changes stay untouched.
+	args = append([]string{"commit", "-m", commitMsg, "--"}, files...)
+	cmd = exec.Command("git", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git commit failed: %w", err)
+	}
+	fmt.Println("Committed restored files.")
+	return nil
+}
+
+// runPostUnpack runs the --post-unpack command through the platform shell in the current
+// working directory, streaming its output.
+func runPostUnpack(command string) error {
+	fmt.Printf("Running post-unpack command: %s\n", command)
+	cmd := shellCommand(context.Background(), command)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("post-unpack command %q failed: %w", command, err)
+	}
+	fmt.Println("Post-unpack command completed.")
+	return nil
+}
+
+// shellCommand prepares command to run through the platform shell.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+// replacement is a literal content substitution from --replace.
+type replacement struct {
+	from, to []byte
+}
+
+// parseReplacement parses a --replace 'OLD=NEW' value. The first '=' separates the two, so
+// NEW may contain '=' but OLD may not; NEW may be empty to delete OLD.
+func parseReplacement(spec string) (replacement, error) {
+	from, to, ok := strings.Cut(spec, "=")
+	if !ok || from == "" {
+		return replacement{}, fmt.Errorf("invalid replacement %q; expected 'OLD=NEW' with a non-empty OLD", spec)
+	}
+	return replacement{from: []byte(from), to: []byte(to)}, nil
+}
+
+// applyReplacements applies each replacement to content in order and returns the result with
+// the total number of occurrences replaced. Content without any occurrence is returned as is.
+func applyReplacements(content []byte, replacements []replacement) ([]byte, int) {
+	total := 0
+	for _, r := range replacements {
+		if n := bytes.Count(content, r.from); n > 0 {
+			content = bytes.ReplaceAll(content, r.from, r.to)
+			total += n
+		}
+	}
+	return content, total
+}
+
+// runContentFilter pipes a block's content through the --content-filter command and returns
+// its standard output. The block's file name is passed in PAKTXT_FILENAME, and the command is
+// killed once unpackFilterTimeout (if set) elapses.
+func runContentFilter(command string, block *FileBlock) ([]byte, error) {
+	ctx := context.Background()
+	if unpackFilterTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, unpackFilterTimeout)
+		defer cancel()
+	}
+	cmd := shellCommand(ctx, command)
+	cmd.Env = append(os.Environ(), "PAKTXT_FILENAME="+filepath.ToSlash(block.Filename))
+	cmd.Stdin = bytes.NewReader(block.Content)
+	cmd.Stderr = os.Stderr
+	cmd.WaitDelay = time.Second // Don't wait on children of the shell that still hold stdout
+	output, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("content filter %q timed out after %s on '%s'", command, unpackFilterTimeout, block.Filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("content filter %q failed on '%s': %w", command, block.Filename, err)
+	}
+	return output, nil
+}
+
+// Whether the git binary is installed, looked up once by gitAvailable.
+var (
+	gitChecked bool
+	gitFound   bool
+)
+
+// gitAvailable reports whether the git binary can be found. The lookup runs once per process;
+// when git is missing, a single notice says git-aware features are off, and callers fall back
+// to their non-git behavior (e.g., the plain directory walk) instead of failing.
+func gitAvailable() bool {
+	if !gitChecked {
+		gitChecked = true
+		_, err := exec.LookPath("git")
+		gitFound = err == nil
+		if !gitFound {
+			fmt.Println("git is not installed; git-aware features are disabled for this run.")
+		}
+	}
+	return gitFound
+}
+
+func isGitRepo() bool {
+	if !gitAvailable() {
+		return false
+	}
+	cmd := exec.Command("git", "rev-parse", "--is-inside-work-tree")
+	cmd.Stderr = nil
+	output, err := cmd.Output()
+	return err == nil && strings.TrimSpace(string(output)) == "true"
+}
+
+// getGitFiles gets all files that are either staged for commit or in the working directory
+// This includes tracked files (committed), staged files (added to index), and untracked files
+func getGitFiles(excludePatterns, filterPatterns, includePatterns []string) ([]string, error) {
+	gitFiles, err := listGitFiles(packGitSelection)
+	if err != nil {
+		return nil, err
+	}
+	if packGitAttributes {
+		gitFiles = dropExportIgnored(gitFiles)
+	}
+	if len(gitFiles) == 0 {
+		// No files found
+		return []string{}, nil
+	}
+
+	var filteredFiles []string
+	for _, file := range gitFiles {
+		if file == "" {
+			continue
+		}
+
+		// Always exclude paktxt's own output files and executable
+		if isPaktxtArtifact(file) {
+			continue
+		}
+
+		if !underPathPrefix(file, packPathPrefix) {
+			continue
+		}
+
+		// Check if file exists (git ls-files might list deleted files)
+		info, err := os.Stat(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil {
+			if kind := specialFileKind(info.Mode()); kind != "" {
+				warnf(warnSpecialFile, file, "Skipping %s: %s", kind, file)
+				continue
+			}
+		}
+
+		// 1. --filter and --only-ext (Whitelist): If given, file must match at least one
+		if !passesPackFilter(file, filterPatterns) {
+			continue
+		}
+
+		// 2. --exclude (User-defined exclusions)
+		if matchesPattern(file, excludePatterns) {
+			continue
+		}
+
+		// 2b. --min-file-size/--max-file-size (same as getAllFiles)
+		if info != nil && outsideSizeBand(file, info.Size()) {
+			continue
+		}
+
+		// 3. Built-in exclusions (same as getAllFiles), unless the file is listed in --text-file
+		forcedText := isForcedTextFile(file)
+		if shouldExcludePath(file) && !forcedText {
+			continue
+		}
+
+		// 4. Binary check (same as getAllFiles), unless disabled by --exclude-binary-ext-only
+		//    or the extension or exact path is known to be text
+		if !packBinaryExtOnly && !isKnownTextFile(file) && !forcedText {
+			if isBinary, err := isBinaryFileBySignature(file); isBinary {
+				warnf(warnBinarySkip, file, "Skipping binary file (by signature): %s", file)
+				continue
+			} else if err != nil {
+				warnf(warnUnreadable, file, "Error checking binary signature for %s: %v", file, err)
+			}
+		}
+
+		// 5. Option-driven exclusions (content checks etc.)
+		if isExcludedByPackOptions(file) {
+			continue
+		}
+
+		filteredFiles = append(filteredFiles, file)
+	}
+
+	return filteredFiles, nil
+}
+
+// listGitFiles returns the paths, relative to the current directory, of the files
+// selected by the given git selection ("" for tracked, staged and untracked files).
+func listGitFiles(selection string) ([]string, error) {
+	var commands [][]string
+	switch selection {
+	case gitSelectUntracked:
+		// --others: untracked files; --exclude-standard: respect .gitignore
+		commands = [][]string{{"ls-files", "--others", "--exclude-standard"}}
+	case gitSelectModified:
+		// Unstaged and staged modifications; --relative keeps paths relative to the current directory.
+		commands = [][]string{
+			{"diff", "--name-only", "--relative", "--diff-filter=d"},
+			{"diff", "--name-only", "--relative", "--diff-filter=d", "--cached"},
+		}
+	case gitSelectTracked:
+		// --cached alone: committed and staged files, without untracked ones
+		commands = [][]string{{"ls-files", "--cached"}}
+	default:
+		// Get all files that git knows about (tracked + staged)
+		// --cached: files in the index (staged)
+		// --others: untracked files
+		// --exclude-standard: respect .gitignore
+		commands = [][]string{{"ls-files", "--cached", "--others", "--exclude-standard"}}
+	}
+
+	seen := make(map[string]bool)
+	var files []string
+	for _, args := range commands {
+		output, err := exec.Command("git", args...).Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to run git %s: %w", args[0], err)
+		}
+		for _, file := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+			if file != "" && !seen[file] {
+				seen[file] = true
+				files = append(files, file)
+			}
+		}
+	}
+	return files, nil
+}
+
+// dropExportIgnored removes files with the 'export-ignore' git attribute, which 'git archive'
+// leaves out, including files below a directory carrying it ('docs/ export-ignore').
+// Without a .gitattributes file or the attribute, files are returned unchanged.
+func dropExportIgnored(files []string) []string {
+	// Directories are queried with a trailing slash so directory-only patterns match.
+	paths := append([]string{}, files...)
+	seenDirs := make(map[string]bool)
+	for _, file := range files {
+		for dir := path.Dir(file); dir != "." && dir != "/" && !seenDirs[dir]; dir = path.Dir(dir) {
+			seenDirs[dir] = true
+			paths = append(paths, dir+"/")
+		}
+	}
+	cmd := exec.Command("git", "check-attr", "--stdin", "-z", "export-ignore")
+	cmd.Stdin = strings.NewReader(strings.Join(paths, "\x00") + "\x00")
+	output, err := cmd.Output()
+	if err != nil {
+		warnf(warnOption, "", "Could not read git attributes for --respect-gitattributes: %v", err)
+		return files
+	}
+
+	// The -z output is a sequence of <path> NUL <attribute> NUL <value> NUL records.
+	ignored := make(map[string]bool)
+	fields := strings.Split(string(output), "\x00")
+	for i := 0; i+2 < len(fields); i += 3 {
+		if fields[i+2] == "set" {
+			ignored[strings.TrimSuffix(fields[i], "/")] = true
+		}
+	}
+	if len(ignored) == 0 {
+		return files
+	}
+	var kept []string
+	for _, file := range files {
+		if isExportIgnored(file, ignored) {
+			fmt.Printf("Skipping export-ignore file: %s\n", file)
+			recordEvent(eventSkipped, file, "export-ignore")
+			continue
+		}
+		kept = append(kept, file)
+	}
+	return kept
+}
+
+// isExportIgnored reports whether file or one of its parent directories is in ignored.
+func isExportIgnored(file string, ignored map[string]bool) bool {
+	for p := file; p != "." && p != "/"; p = path.Dir(p) {
+		if ignored[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// getAllFiles recursively walks through the directory and collects all non-excluded files.
+func getAllFiles(root string, excludePatterns, filterPatterns, includePatterns []string) ([]string, error) {
+	var files []string
+	var ignores *gitignoreSet
+	if packFollowGitignore {
+		ignores = newGitignoreSet(root)
+	}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Always exclude paktxt's own output file name and its extensions.
+		// And the executable itself.
+		if isPaktxtArtifact(path) {
+			return nil
+		}
+
+		// 1. Directory Exclusion (always first for efficiency)
+		if d.IsDir() {
+			if shouldExcludeDir(path) {
+				return fs.SkipDir
+			}
+			// --path-prefix: only descend into the prefix and the directories leading to it.
+			if path != root && !underPathPrefix(path, packPathPrefix) && !underPathPrefix(packPathPrefix, path) {
+				return fs.SkipDir
+			}
+			if ignores != nil {
+				if ignores.ignored(path, true) {
+					return fs.SkipDir
+				}
+				ignores.load(path)
+			}
+			return nil
+		}
+
+		// 1a. FIFOs, sockets and devices: reading them could block forever or never end.
+		//     Symlinks are checked by their target.
+		mode := d.Type()
+		if mode&fs.ModeSymlink != 0 {
+			if info, err := os.Stat(path); err == nil {
+				mode = info.Mode()
+			}
+		}
+		if kind := specialFileKind(mode); kind != "" {
+			warnf(warnSpecialFile, path, "Skipping %s: %s", kind, path)
+			return nil
+		}
+
+		// 1b. --follow-gitignore-in-subdirs: rules from every .gitignore above the file.
+		if ignores != nil && ignores.ignored(path, false) {
+			return nil
+		}
+
+		// 1c. --path-prefix: files directly in the directories leading to the prefix.
+		if !underPathPrefix(path, packPathPrefix) {
+			return nil
+		}
+
+		// 2. --filter and --only-ext (Whitelist): If given, a file *must* match AT LEAST ONE
+		//    filter pattern or extension to be considered further. Otherwise it's immediately out.
+		if !passesPackFilter(path, filterPatterns) {
+			return nil // Does not match any filter pattern, so exclude
+		}
+
+		// 3. (REMOVED: --include logic was here)
+
+		// 4. --exclude (Additive Exclusion): Apply user-defined glob exclusions.
+		//    Now applied directly without --include override.
+		if matchesPattern(path, excludePatterns) {
+			return nil
+		}
+
+		// 4b. --min-file-size/--max-file-size, from the directory entry before anything is read.
+		if packMinFileSize > 0 || packMaxFileSize > 0 {
+			if info, err := d.Info(); err == nil && outsideSizeBand(path, info.Size()) {
+				return nil
+			}
+		}
+
+		// 5. Built-in Path/Extension Exclusion: Checks common system files and extensions.
+		//    Now applied directly without --include override. Files listed in --text-file bypass it.
+		forcedText := isForcedTextFile(path)
+		if shouldExcludePath(path) && !forcedText {
+			return nil
+		}
+
+		// 6. Binary Signature Check: Most expensive check, performed last.
+		//    Now applied directly without --include override. Skipped by --exclude-binary-ext-only,
+		//    for extensions known to be text and for files listed in --text-file.
+		if !packBinaryExtOnly && !isKnownTextFile(path) && !forcedText {
+			if isBinary, err := isBinaryFileBySignature(path); isBinary {
+				warnf(warnBinarySkip, path, "Skipping binary file (by signature): %s", path)
+				return nil
+			} else if err != nil {
+				// If there's an error reading the signature (e.g., permissions), we'll print a warning
+				// but still include the file unless we explicitly want to skip on error.
+				warnf(warnUnreadable, path, "Error checking binary signature for %s: %v", path, err)
+			}
+		}
+
+		// 7. Option-driven exclusions (content checks etc.), enabled by pack flags.
+		if isExcludedByPackOptions(path) {
+			return nil
+		}
+
+		// If not excluded by any of the above, add it.
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			warnf(warnPath, path, "Could not get relative path for %s: %v", path, err)
+			files = append(files, path)
+		} else {
+			files = append(files, relPath)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// specialFileKind names the kind of a non-regular file that cannot be packed (FIFO, socket or
+// device), or returns "" for regular files, directories and symlinks.
+func specialFileKind(mode fs.FileMode) string {
+	switch {
+	case mode&fs.ModeNamedPipe != 0:
+		return "FIFO"
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	case mode&fs.ModeCharDevice != 0:
+		return "character device"
+	case mode&fs.ModeDevice != 0:
+		return "device"
+	}
+	return ""
+}
+
+// gitignoreRule is one pattern line of a .gitignore file.
+type gitignoreRule struct {
+	base     string // Slash path of the directory holding the .gitignore, relative to the walk root ("" for the root)
+	pattern  string // Slash pattern without the leading '!', leading '/' and trailing '/'
+	negate   bool   // '!pattern': re-includes a previously ignored path
+	dirOnly  bool   // 'pattern/': matches directories only
+	anchored bool   // Contains a '/': matched against the path relative to base, not the name at any depth
+}
+
+// gitignoreSet holds the .gitignore rules that apply to each directory seen by the walk, for
+// --follow-gitignore-in-subdirs. Rules of a directory are its parent's followed by its own, so
+// that, as in git, the last matching rule wins and deeper files override shallower ones.
+type gitignoreSet struct {
+	root  string
+	rules map[string][]gitignoreRule // By slash path of the directory relative to root
+}
+
+func newGitignoreSet(root string) *gitignoreSet {
+	return &gitignoreSet{root: root, rules: make(map[string][]gitignoreRule)}
+}
+
+// rel returns path relative to the walk root as a slash path, "" for the root itself.
+func (g *gitignoreSet) rel(path string) string {
+	rel, err := filepath.Rel(g.root, path)
+	if err != nil || rel == "." {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// load reads the .gitignore of dir, if any, and records the rules that apply inside it. It must
+// be called for a directory before anything below it is checked, which WalkDir's order ensures.
+func (g *gitignoreSet) load(dir string) {
+	relDir := g.rel(dir)
+	var inherited []gitignoreRule
+	if relDir != "" {
+		inherited = g.rules[parentSlashDir(relDir)]
+	}
+	data, err := os.ReadFile(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			warnf(warnUnreadable, dir, "Could not read %s: %v", filepath.Join(dir, ".gitignore"), err)
+		}
+		g.rules[relDir] = inherited
+		return
+	}
+	own := parseGitignore(string(data), relDir)
+	rules := make([]gitignoreRule, 0, len(inherited)+len(own))
+	g.rules[relDir] = append(append(rules, inherited...), own...)
+}
+
+// ignored reports whether path is ignored by the rules of its parent directory.
+func (g *gitignoreSet) ignored(path string, isDir bool) bool {
+	rel := g.rel(path)
+	if rel == "" {
+		return false
+	}
+	ignored := false
+	for _, r := range g.rules[parentSlashDir(rel)] {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.matches(rel) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+// parentSlashDir returns the parent of a slash path relative to the walk root, "" at the top.
+func parentSlashDir(rel string) string {
+	if i := strings.LastIndex(rel, "/"); i >= 0 {
+		return rel[:i]
+	}
+	return ""
+}
+
+// parseGitignore parses the content of a .gitignore file found in the directory base.
+func parseGitignore(content, base string) []gitignoreRule {
+	var rules []gitignoreRule
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		// Trailing spaces are ignored unless escaped with a backslash.
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+			line = line[:len(line)-1]
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r := gitignoreRule{base: base}
+		if strings.HasPrefix(line, "!") {
+			r.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, "\\#") || strings.HasPrefix(line, "\\!") {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			r.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		r.pattern = line
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// matches reports whether the slash path rel (relative to the walk root) matches the rule.
+func (r gitignoreRule) matches(rel string) bool {
+	if r.base != "" {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		rel = rel[len(r.base)+1:]
+	}
+	if !r.anchored {
+		ok, _ := path.Match(r.pattern, path.Base(rel))
+		return ok
+	}
+	return matchGitignoreSegments(strings.Split(r.pattern, "/"), strings.Split(rel, "/"))
+}
+
+// matchGitignoreSegments matches path segments against pattern segments, where a "**" segment
+// matches zero or more whole segments; a trailing one, as in "dir/**", matches at least one.
+func matchGitignoreSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		if len(pattern) == 1 {
+			return len(segments) > 0
+		}
+		for i := 0; i <= len(segments); i++ {
+			if matchGitignoreSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+		return false
+	}
+	return matchGitignoreSegments(pattern[1:], segments[1:])
+}
+
+// isPaktxtArtifact reports whether path is a paktxt archive or the paktxt executable, which
+// are not packed. With --include-paktxt, archives are packed except the one being written.
+func isPaktxtArtifact(path string) bool {
+	if strings.EqualFold(filepath.Base(path), "paktxt") || strings.EqualFold(filepath.Base(path), "paktxt.exe") {
+		return true
+	}
+	if !packIncludePaktxt {
+		return strings.HasSuffix(strings.ToLower(path), paktxtExtension)
+	}
+	abs, err := filepath.Abs(path)
+	return err == nil && abs == packOutputPath
+}
+
+// shouldExcludeDir checks if a directory should be excluded from scanning.
+func shouldExcludeDir(path string) bool {
+	dirName := filepath.Base(path)
+	return excludedDirs[dirName]
+}
+
+// shouldExcludePath checks if a file path indicates it should be excluded based on name or common extension.
+// This is the FASTEST check as it doesn't involve opening the file.
+func shouldExcludePath(path string) bool {
+	name := strings.ToLower(filepath.Base(path))
+	ext := strings.ToLower(filepath.Ext(path))
+
+	// Exclude by specific common names (regardless of extension).
+	excludedNames := map[string]bool{
+		".ds_store":   true, // macOS desktop services store file
+		"thumbs.db":   true, // Windows thumbnail cache
+		"desktop.ini": true, // Windows desktop customization file
+		".localized":  true, // macOS localization marker
+		"icon\r":      true, // macOS custom icon file (has a carriage return in name)
+		// Add other common system/temp files without extensions here if needed
+	}
+	if excludedNames[name] {
+		return true
+	}
+
+	// Exclude by common binary/non-text extensions.
+	// This list is intentionally broad to catch files quickly by their extension.
+	excludedExtensions := map[string]bool{
+		".exe": true, ".dll": true, ".so": true, ".dylib": true, // Executables/Libraries
+		".zip": true, ".tar": true, ".gz": true, ".rar": true, ".7z": true, // Archives
+		".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".bmp": true, ".svg": true, // Images
+		".ico": true,                             // Icons
+		".mp3": true, ".wav": true, ".ogg": true, // Audio
+		".mp4": true, ".avi": true, ".mov": true, ".mkv": true, // Video
+		".pdf":    true,                                // PDF documents
+		".sqlite": true, ".db": true, ".sqlite3": true, // Databases
+		".log":          true, // Logs are text but often very large and unwanted
+		".bin":          true, // Generic binary files
+		".class":        true, // Java compiled classes
+		".jar":          true, // Java archives (are zips)
+		".lock":         true, // Generic lock files
+		paktxtExtension: true, // Exclude paktxt's own output
+		// Add other extensions that are definitely not text and you don't want to pack
+		".obj": true, ".lib": true, ".a": true, // Compiled objects/static libraries
+		".dat": true,               // Generic data file, often binary
+		".tmp": true,               // Temporary files
+		".bak": true,               // Backup files
+		".swp": true, ".swo": true, // Vim swap files
+		".pyc":     true,                     // Python compiled bytecode
+		".iml":     true,                     // IntelliJ IDEA module file (XML, but often auto-generated and noisy)
+		".project": true, ".classpath": true, // Eclipse project files (XML, similarly noisy)
+		".vspscc": true, ".vssscc": true, // Visual Studio Source Control files
+		".suo": true, ".user": true, // Visual Studio user-specific settings
+		".ncb": true, ".sdf": true, ".ipch": true, // Visual Studio Intellisense/Browse info
+	}
+
+	if excludedExtensions[ext] && !(ext == paktxtExtension && packIncludePaktxt) {
+		return true
+	}
+
+	// Also, check if any component of the path (directory name) is in `excludedDirs`.
+	// This helps catch cases like `project/vendor/somefile.txt` if `vendor` is in excludedDirs.
+	// This is a bit redundant with the `fs.SkipDir` in WalkDir, but adds robustness.
+	// We check for `filepath.Separator` on both sides to avoid partial matches (e.g., "mybuild" matching "build").
+	pathComponents := strings.Split(strings.ToLower(path), string(filepath.Separator))
+	for _, comp := range pathComponents {
+		if excludedDirs[comp] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalizePathPrefix cleans a --path-prefix value into a slash path relative to the root.
+// "" and "." scope nothing; absolute paths and paths leaving the root are rejected.
+func normalizePathPrefix(dir string) (string, error) {
+	if dir == "" {
+		return "", nil
+	}
+	cleaned := path.Clean(filepath.ToSlash(dir))
+	if filepath.IsAbs(dir) || path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("--path-prefix '%s' must be a directory inside the root, given as a relative path", dir)
+	}
+	if cleaned == "." {
+		return "", nil
+	}
+	return cleaned, nil
+}
+
+// underPathPrefix reports whether name is the prefix directory itself or lies below it.
+// Whole path segments are compared, so 'a/b' does not contain 'a/bc'.
+func underPathPrefix(name, prefix string) bool {
+	if prefix == "" {
+		return true
+	}
+	name = strings.TrimPrefix(filepath.ToSlash(name), "./")
+	return name == prefix || strings.HasPrefix(name, prefix+"/")
+}
+
+// outsideSizeBand reports, with a progress line, whether a file of the given size is skipped
+// by --min-file-size or --max-file-size.
+func outsideSizeBand(path string, size int64) bool {
+	if packMinFileSize > 0 && size < packMinFileSize {
+		fmt.Printf("Skipping %s: %d bytes is below --min-file-size %d\n", path, size, packMinFileSize)
+		recordEvent(eventSkipped, path, "%d bytes is below --min-file-size %d", size, packMinFileSize)
+		return true
+	}
+	if packMaxFileSize > 0 && size > packMaxFileSize {
+		fmt.Printf("Skipping %s: %d bytes is above --max-file-size %d\n", path, size, packMaxFileSize)
+		recordEvent(eventSkipped, path, "%d bytes is above --max-file-size %d", size, packMaxFileSize)
+		return true
+	}
+	return false
+}
+
+// isExcludedByPackOptions applies the optional, flag-driven exclusions shared by
+// getAllFiles and getGitFiles. Checks that need the file content run last.
+func isExcludedByPackOptions(path string) bool {
+	if packExcludeTests && isTestFile(path) {
+		fmt.Printf("Skipping test file: %s\n", path)
+		recordEvent(eventSkipped, path, "test file (--exclude-test-files)")
+		return true
+	}
+	if packOnlyTests && !isTestFile(path) {
+		return true
+	}
+	if packExcludeEmpty {
+		if info, err := os.Stat(path); err == nil && info.Size() == 0 {
+			fmt.Printf("Skipping empty file: %s\n", path)
+			recordEvent(eventSkipped, path, "empty file (--exclude-if-empty)")
+			return true
+		}
+	}
+	if packMaxLineLength > 0 {
+		if exceeds, err := hasLineLongerThan(path, packMaxLineLength); err != nil {
+			warnf(warnUnreadable, path, "Could not read %s for --max-line-length: %v", path, err)
+		} else if exceeds {
+			warnf(warnSkipped, path, "Skipping %s: it has a line longer than %d bytes (--max-line-length).", path, packMaxLineLength)
+			return true
+		}
+	}
+	if packContentRegex != nil {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			warnf(warnUnreadable, path, "Could not read %s for --exclude-content-regex: %v", path, err)
+		} else if packContentRegex.Match(content) {
+			fmt.Printf("Skipping file with content matching --exclude-content-regex: %s\n", path)
+			recordEvent(eventSkipped, path, "content matches --exclude-content-regex")
+			return true
+		}
+	}
+	return false
+}
+
+// defaultTestPatterns are the test file conventions of common languages recognized by
+// --exclude-test-files and --only-test-files, unless replaced with --test-patterns.
+var defaultTestPatterns = []string{
+	"*_test.go", "test_*.py", "*_test.py", "*.test.*", "*.spec.*",
+	"*Test.java", "*Tests.java", "*Tests.cs", "*_spec.rb",
+	"test/", "tests/", "__tests__/", "spec/", "testdata/",
+}
+
+// isTestFile reports whether path matches one of packTestPatterns. Rules ending in '/' name a
+// directory anywhere above the file; the others are globs matched like --exclude patterns.
+func isTestFile(path string) bool {
+	var globs []string
+	dirs := strings.Split(filepath.ToSlash(filepath.Dir(path)), "/")
+	for _, pattern := range packTestPatterns {
+		dir, isDir := strings.CutSuffix(pattern, "/")
+		if !isDir {
+			globs = append(globs, pattern)
+			continue
+		}
+		for _, segment := range dirs {
+			if matched, _ := filepath.Match(dir, segment); matched {
+				return true
+			}
+		}
+	}
+	return matchesPattern(path, globs)
+}
+
+// hasLineLongerThan reports whether the file at path has a line of more than limit bytes.
+// It reads the file in chunks and stops at the first such line.
+func hasLineLongerThan(path string, limit int) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	buf := make([]byte, 64*1024)
+	current := 0 // Length of the line being read so far
+	for {
+		n, err := file.Read(buf)
+		chunk := buf[:n]
+		for len(chunk) > 0 {
+			i := bytes.IndexByte(chunk, '\n')
+			if i == -1 {
+				current += len(chunk)
+				break
+			}
+			if current+i > limit {
+				return true, nil
+			}
+			current = 0
+			chunk = chunk[i+1:]
+		}
+		if current > limit {
+			return true, nil
+		}
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// isForcedTextFile reports whether path was listed in --text-file.
+func isForcedTextFile(file string) bool {
+	return packTextFiles[path.Clean(filepath.ToSlash(file))]
+}
+
+// isKnownTextFile reports whether path has an extension listed in textExtensions.
+func isKnownTextFile(path string) bool {
+	return textExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// isBinaryFileBySignature checks if a file is a binary based on its magic number (file signature).
+// It reads only a small prefix of the file for efficiency,
+// and acts as a fallback for files that don't have typical binary extensions
+// but are, in fact, binary (e.g., executables without extensions, or compressed archives
+// used as "dot files" or temp files).
+func isBinaryFileBySignature(filePath string) (bool, error) {
+	defer profileAdd("sniff", profileStart())
+	file, err := os.Open(filePath)
+	if err != nil {
+		// If we can't open it (e.g., permissions), return an error.
+		// The caller decides whether to skip or log a warning.
+		return false, fmt.Errorf("cannot open file to check signature %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	// Read enough bytes to cover most common magic numbers and initial header structures (e.g., PE offset)
+	const readBufferSize = 256 // A larger buffer is safer for complex headers like PE
+	buffer := make([]byte, readBufferSize)
+	n, readErr := io.ReadAtLeast(file, buffer, 4) // Read at least 4 bytes for most simple magic numbers
+
+	// ReadAtLeast returns io.EOF for an empty file and io.ErrUnexpectedEOF for one shorter than
+	// 4 bytes; neither is a read error, so such files are sniffed as text below.
+	if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+		// If there's a real read error, report it.
+		return false, fmt.Errorf("failed to read file header for %s: %w", filePath, readErr)
+	}
+	if n < 4 {
+		// File is too small to have common magic numbers, assume it's text (or empty)
+		return false, nil
+	}
+
+	// --- Check for common executable magic numbers ---
+	// ELF: 0x7F 'E' 'L' 'F'
+	if n >= 4 && bytes.HasPrefix(buffer, []byte{0x7F, 0x45, 0x4C, 0x46}) {
+		return true, nil
+	}
+
+	// Mach-O (macOS/iOS executables and libraries)
+	// 32-bit big-endian: FEEDFACE
+	// 32-bit little-endian: CEFAEDFE
+	// 64-bit big-endian: FEEDFACF
+	// 64-bit little-endian: CFFAEDFE
+	if n >= 4 && (bytes.HasPrefix(buffer, []byte{0xFE, 0xED, 0xFA, 0xCE}) ||
+		bytes.HasPrefix(buffer, []byte{0xCE, 0xFA, 0xED, 0xFE}) ||
+		bytes.HasPrefix(buffer, []byte{0xFE, 0xED, 0xFA, 0xCF}) ||
+		bytes.HasPrefix(buffer, []byte{0xCF, 0xFA, 0xED, 0xFE})) {
+		return true, nil
+	}
+
+	// PE (Windows Executables: EXE, DLL)
+	// Starts with 'MZ' (0x4D 0x5A)
+	// Then, at offset 0x3C, there's a 4-byte little-endian pointer to the PE header.
+	// The PE header itself starts with 'PE\0\0' (0x50 0x45 0x00 0x00).
+	if n >= 2 && bytes.HasPrefix(buffer, []byte{0x4D, 0x5A}) { // Check for 'MZ'
+		if n >= 0x3C+4 { // Ensure buffer is large enough to read the PE header offset
+			// Read the 4-byte little-endian offset
+			peHeaderOffset := uint32(buffer[0x3C]) | uint32(buffer[0x3C+1])<<8 |
+				uint32(buffer[0x3C+2])<<16 | uint32(buffer[0x3C+3])<<24
+
+			// Check if the PE header itself is within our buffer
+			if int(peHeaderOffset)+4 <= n {
+				if bytes.HasPrefix(buffer[peHeaderOffset:], []byte{0x50, 0x45, 0x00, 0x00}) {
+					return true, nil // Confirmed PE executable
+				}
+			}
+		}
+	}
+
+	// --- Check for common archive/compressed file magic numbers ---
+	// ZIP archive (including JAR, WAR, DOCX, XLSX, PPTX, etc. as they are ZIPs)
+	if n >= 4 && (bytes.HasPrefix(buffer, []byte{0x50, 0x4B, 0x03, 0x04}) || // Local file header
+		bytes.HasPrefix(buffer, []byte{0x50, 0x4B, 0x05, 0x06}) || // Empty archive (central directory end)
+		bytes.HasPrefix(buffer, []byte{0x50, 0x4B, 0x07, 0x08})) { // Spanned archive
+		return true, nil
+	}
+
+	// Gzip compressed file
+	if n >= 2 && bytes.HasPrefix(buffer, []byte{0x1F, 0x8B}) {
+		return true, nil
+	}
+
+	// 7-Zip archive
+	if n >= 6 && bytes.HasPrefix(buffer, []byte{0x37, 0x7A, 0xBC, 0xAF, 0x27, 0x1C}) {
+		return true, nil
+	}
+
+	// --- Check for common database files ---
+	// SQLite 3.x database file
+	if n >= 16 && bytes.HasPrefix(buffer, []byte{
+		0x53, 0x51, 0x4C, 0x69, 0x74, 0x65, 0x20, 0x66,
+		0x6F, 0x72, 0x6D, 0x61, 0x74, 0x20, 0x33, 0x00}) {
+		return true, nil
+	}
+
+	// --- Check for other common non-text files that might not have extensions or have generic ones ---
+	// PNG (added here as a definitive non-text check, even if extension usually catches it)
+	if n >= 8 && bytes.HasPrefix(buffer, []byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A}) {
+		return true, nil
+	}
+	// JPEG (added here as a definitive non-text check)
+	if n >= 4 && (bytes.HasPrefix(buffer, []byte{0xFF, 0xD8, 0xFF, 0xE0}) || // JFIF
+		bytes.HasPrefix(buffer, []byte{0xFF, 0xD8, 0xFF, 0xE1})) { // EXIF
+		return true, nil
+	}
+	// GIF (added here as a definitive non-text check)
+	if n >= 6 && (bytes.HasPrefix(buffer, []byte{0x47, 0x49, 0x46, 0x38, 0x37, 0x61}) || // GIF87a
+		bytes.HasPrefix(buffer, []byte{0x47, 0x49, 0x46, 0x38, 0x39, 0x61})) { // GIF89a
+		return true, nil
+	}
+	// BMP (added here as a definitive non-text check)
+	if n >= 2 && bytes.HasPrefix(buffer, []byte{0x42, 0x4D}) { // 'BM'
+		return true, nil
+	}
+
+	// MPEG transport stream (.ts video, which shares its extension with TypeScript)
+	// 188-byte packets, each starting with the sync byte 'G' (0x47); the headers contain NUL
+	// bytes, which source text does not.
+	if n > 188 && buffer[0] == 0x47 && buffer[188] == 0x47 && bytes.IndexByte(buffer[:n], 0) >= 0 {
+		return true, nil
+	}
+
+	// PDF (added here as a definitive non-text check, often starts with %PDF)
+	if n >= 4 && bytes.HasPrefix(buffer, []byte{0x25, 0x50, 0x44, 0x46}) { // %PDF
+		return true, nil
+	}
+
+	// If none of the above magic numbers match, assume it's not a specific known binary type.
+	return false, nil
+}
+
+// passesPackFilter reports whether a file is selected by --filter and --only-ext, which form
+// a union. Without either, every file passes.
+func passesPackFilter(filePath string, filterPatterns []string) bool {
+	if len(filterPatterns) == 0 && len(packOnlyExts) == 0 {
+		return true
+	}
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filePath), "."))
+	return (ext != "" && packOnlyExts[ext]) || matchesPattern(filePath, filterPatterns)
+}
+
+// matchesPattern checks if a file path matches any of the provided glob patterns.
+// It returns true if it matches at least one pattern, false otherwise.
+func matchesPattern(filePath string, patterns []string) bool {
+	for _, pattern := range patterns {
+		// Check against base name (e.g., "*.log")
+		matched, err := filepath.Match(pattern, filepath.Base(filePath))
+		if err != nil {
+			warnf(warnInvalidGlob, "", "Invalid glob pattern '%s': %v", pattern, err)
+			continue
+		}
+		if matched {
+			return true
+		}
+
+		// Check against full path (e.g., "temp/*")
+		matchedFullPath, err := filepath.Match(pattern, filePath)
+		if err != nil {
+			warnf(warnInvalidGlob, "", "Invalid glob pattern '%s': %v", pattern, err)
+			continue
+		}
+		if matchedFullPath {
+			return true
+		}
+	}
+	return false
+}
+
+// buildPaktxtContent encodes files as an archive. withHeader is false when the blocks are
+// appended to an existing archive that already carries the header.
+func buildPaktxtContent(files []string, withHeader bool) (string, error) {
+	var builder strings.Builder
+	if err := writePaktxtContent(&builder, files, withHeader); err != nil {
+		return "", err
+	}
+	return builder.String(), nil
+}
+
+// writePaktxtContent writes the pack output for files to w one block at a time, so only a
+// single file is held in memory when w is not itself a buffer.
+func writePaktxtContent(w io.Writer, files []string, withHeader bool) error {
+	if packMarkdown {
+		_, err := io.WriteString(w, buildMarkdownContent(files))
+		return err
+	}
+
+	if marker := strippedMarkerLine(); marker != "" {
+		if _, err := io.WriteString(w, marker); err != nil {
+			return err
+		}
+	}
+	if packFormat == formatV2 || !withHeader {
+		// v2 archives are self-describing through the magic line of each block, and
+		// appended blocks rely on the header of the archive they extend.
+	} else if _, err := io.WriteString(w, paktxtHeader); err != nil {
+		return err
+	}
+
+	// With --max-total-bytes, the budget left for blocks once the header and trailers are
+	// accounted for; files stop being added at the first one that does not fit.
+	budget := 0
+	if packMaxTotalBytes > 0 {
+		budget = packMaxTotalBytes - len(strippedMarkerLine()) - archiveTrailerLength()
+		if withHeader && packFormat != formatV2 {
+			budget -= len(paktxtHeader)
+		}
+		if budget <= 0 {
+			return fmt.Errorf("--max-total-bytes %d is too small for the archive header", packMaxTotalBytes)
+		}
+	}
+
+	packed := 0
+	stored, reused := 0, 0 // --store objects written and found already present
+	if storeDir != "" {
+		defer func() {
+			fmt.Printf("Content store %s: %d new object(s), %d already stored.\n", storeDir, stored, reused)
+		}()
+	}
+	for i, file := range files {
+		readStart := profileStart()
+		block, ok := readFileBlock(file)
+		profileAdd("read", readStart)
+		if !ok {
+			continue
+		}
+		if packAbsolutePaths {
+			absPath, err := filepath.Abs(file)
+			if err != nil {
+				return fmt.Errorf("failed to resolve absolute path for %s: %w", file, err)
+			}
+			block.Filename = absPath
+		}
+		block.Filename = normalizeArchivePath(block.Filename)
+		if packRedactor != nil {
+			packRedactor.redactBlock(block)
+		}
+		size := block.Size // Before --store moves the content out
+		var objectContent []byte
+		if storeDir != "" && block.Symlink == "" {
+			objectContent = storeBlockContent(block)
+		}
+		encodeStart := profileStart()
+		encoded, err := encodeBlock(block)
+		profileAdd("encode", encodeStart)
+		if err != nil {
+			return err
+		}
+		if packMaxTotalBytes > 0 {
+			if len(encoded) > budget {
+				if packed == 0 {
+					return fmt.Errorf("the first file, %s, does not fit in --max-total-bytes %d", file, packMaxTotalBytes)
+				}
+				omitted := files[i:]
+				fmt.Printf("Omitted %d file(s) that do not fit in --max-total-bytes %d:\n", len(omitted), packMaxTotalBytes)
+				for _, name := range omitted {
+					fmt.Printf("  %s\n", filepath.ToSlash(name))
+					recordEvent(eventSkipped, name, "does not fit in --max-total-bytes %d", packMaxTotalBytes)
+				}
+				return nil
+			}
+			budget -= len(encoded)
+		}
+		if block.Object != "" {
+			// Only once the block fits, so an omitted file leaves no object behind.
+			isNew, err := writeStoreObject(block, objectContent)
+			if err != nil {
+				return err
+			}
+			if isNew {
+				stored++
+			} else {
+				reused++
+			}
+		}
+		if _, err := io.WriteString(w, encoded); err != nil {
+			return err
+		}
+		recordEvent(eventPacked, block.Filename, "%d bytes", size)
+		packed++
+	}
+	return nil
+}
+
+// archiveTrailerLength returns the length of the trailer lines added after the blocks: the
+// --since-archive base reference and the --sign signature.
+func archiveTrailerLength() int {
+	length := 0
+	if packBaseRef != "" {
+		length += len(baseRefPrefix + packBaseRef + "\n")
+	}
+	if packSignKey != nil {
+		length += len(signaturePrefix + base64.StdEncoding.EncodeToString(make([]byte, ed25519.SignatureSize)) + "\n")
+	}
+	return length
+}
+
+// encodeBlock encodes a single block in the selected pack format.
+func encodeBlock(block *FileBlock) (string, error) {
+	var builder strings.Builder
+	if packFormat == formatV2 {
+		if err := writeV2Block(&builder, block); err != nil {
+			return "", err
+		}
+	} else {
+		writeLegacyBlock(&builder, block)
+	}
+	return builder.String(), nil
+}
+
+// buildMarkdownContent renders the files as a human-browsable markdown document, with the
+// filename as a heading and the content in a fenced code block. The result is presentation
+// only: it starts with markdownExportMarker and is rejected by unpack.
+func buildMarkdownContent(files []string) string {
+	var builder strings.Builder
+	builder.WriteString(markdownExportMarker)
+	builder.WriteString("\n\n# Project files\n")
+
+	for _, file := range files {
+		block, ok := readFileBlock(file)
+		if !ok {
+			continue
+		}
+		if packRedactor != nil {
+			packRedactor.redactBlock(block)
+		}
+		recordEvent(eventPacked, block.Filename, "%d bytes", block.Size)
+		builder.WriteString("\n## ")
+		builder.WriteString(filepath.ToSlash(block.Filename))
+		builder.WriteString("\n\n")
+		if block.Symlink != "" {
+			fmt.Fprintf(&builder, "Symlink to `%s`.\n", block.Symlink)
+			continue
+		}
+
+		content := block.Content
+		// The fence must be longer than any backtick run inside the content.
+		fence := strings.Repeat("`", max(3, longestRun(content, '`')+1))
+		builder.WriteString(fence)
+		builder.WriteString(detectLanguage(block.Filename, content))
+		builder.WriteString("\n")
+		builder.Write(content)
+		if !block.HasTrailingNewline {
+			builder.WriteString("\n")
+		}
+		builder.WriteString(fence)
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
+
+// longestRun returns the length of the longest consecutive run of b in data.
+func longestRun(data []byte, b byte) int {
+	longest, current := 0, 0
+	for _, c := range data {
+		if c == b {
+			current++
+			longest = max(longest, current)
+		} else {
+			current = 0
+		}
+	}
+	return longest
+}
+
+// readFileBlock reads a file from disk and captures the metadata stored alongside its content.
+// It returns false if the file should be skipped.
+func readFileBlock(file string) (*FileBlock, bool) {
+	if packResolveSymlinks {
+		if target, ok := internalSymlinkTarget(file); ok {
+			return &FileBlock{Filename: file, Symlink: target}, true
+		}
+	}
+
+	content, err := readFileWithRetries(file)
+	if err != nil {
+		warnf(warnUnreadable, file, "Could not read file %s: %v", file, err)
+		return nil, false
+	}
+
+	// The BOM is never stored inline; it is recorded with the 'bom:' label instead.
+	contentBytes := content
+	hasBOM := bytes.HasPrefix(contentBytes, utf8BOM)
+	if hasBOM {
+		contentBytes = contentBytes[len(utf8BOM):]
+	}
+
+	// This check is very important to prevent infinite recursion if a paktxt output is scanned.
+	// It's still here as a safeguard, although getAllFiles also tries to filter it by name/extension.
+	if !packIncludePaktxt && looksLikeArchive(contentBytes) {
+		fmt.Printf("Skipping file %s as it appears to be a paktxt output.\n", file)
+		recordEvent(eventSkipped, file, "appears to be a paktxt output")
+		return nil, false
+	}
+
+	if len(packReplacements) > 0 {
+		var count int
+		contentBytes, count = applyReplacements(contentBytes, packReplacements)
+		if count > 0 {
+			fmt.Printf("Replaced %d occurrence(s) in %s\n", count, file)
+		}
+	}
+	if packStripComments {
+		contentBytes = stripComments(detectLanguage(file, contentBytes), contentBytes)
+	}
+	if packTrimWhitespace {
+		contentBytes = trimWhitespace(contentBytes)
+	}
+
+	fileInfo, err := os.Stat(file)
+	isExecutable := false
+	if err == nil {
+		isExecutable = (fileInfo.Mode().Perm()&0111 != 0)
+	} else {
+		warnf(warnUnreadable, file, "Could not get file info for %s: %v. Assuming non-executable.", file, err)
+	}
+
+	hasTrailingNewline := false
+	if len(contentBytes) > 0 {
+		lastByte := contentBytes[len(contentBytes)-1]
+		if lastByte == '\n' {
+			hasTrailingNewline = true // Found a trailing newline
+			if len(contentBytes) > 1 && contentBytes[len(contentBytes)-2] == '\r' {
+				// This is a \r\n ending, still considered a trailing newline
+			}
+		}
+	}
+
+	block := &FileBlock{
+		Filename:           file,
+		IsExecutable:       isExecutable,
+		HasTrailingNewline: hasTrailingNewline,
+		HasBOM:             hasBOM && !packStripBOM,
+		Size:               len(contentBytes),
+		Content:            contentBytes,
+	}
+	if packLanguageHints {
+		block.Language = detectLanguage(file, contentBytes)
+	}
+	if packModTime && fileInfo != nil {
+		block.ModTime = formatTimestamp(archivedModTime(fileInfo.ModTime()))
+	}
+	return block, true
+}
+
+// readFileWithRetries reads file, retrying up to --read-retries times with a doubling delay.
+// Every error is retried: on network mounts even a missing file can be transient, as can a
+// file an editor is replacing through a rename.
+func readFileWithRetries(file string) ([]byte, error) {
+	delay := packReadRetryDelay
+	for attempt := 1; ; attempt++ {
+		content, err := os.ReadFile(file)
+		if err == nil || attempt > packReadRetries {
+			return content, err
+		}
+		fmt.Printf("Retrying read of %s in %v (retry %d of %d): %v\n", file, delay, attempt, packReadRetries, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// internalSymlinkTarget reports whether file is a symlink that resolves inside the
+// current directory tree, returning its target relative to the link's directory.
+// Symlinks pointing outside the tree return false so their content gets embedded instead.
+func internalSymlinkTarget(file string) (string, bool) {
+	info, err := os.Lstat(file)
+	if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		return "", false
+	}
+
+	root, err := filepath.EvalSymlinks(".")
+	if err == nil {
+		root, err = filepath.Abs(root)
+	}
+	if err != nil {
+		warnf(warnSymlink, file, "Could not resolve the packing root: %v", err)
+		return "", false
+	}
+	resolved, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		warnf(warnSymlink, file, "Could not resolve symlink %s: %v. Embedding it as a regular file.", file, err)
+		return "", false
+	}
+	resolved, err = filepath.Abs(resolved)
+	if err != nil {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		warnf(warnSymlink, file, "Symlink %s points outside the packed tree (%s); embedding its resolved content.", file, resolved)
+		return "", false
+	}
+
+	linkDir, err := filepath.Abs(filepath.Dir(file))
+	if err == nil {
+		linkDir, err = filepath.EvalSymlinks(linkDir)
+	}
+	if err != nil {
+		return "", false
+	}
+	target, err := filepath.Rel(linkDir, resolved)
+	if err != nil {
+		return "", false
+	}
+	return filepath.ToSlash(target), true
+}
+
+// formatTimestamp formats t for archive metadata. Timestamps are always RFC 3339 in UTC, so
+// archives packed on machines in different timezones or locales are byte-comparable.
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// loadTimestampOptions sets packTimestamp from the --timestamp value, or packClampTime from
+// the SOURCE_DATE_EPOCH environment variable (https://reproducible-builds.org/specs/source-date-epoch/).
+func loadTimestampOptions(timestamp string) error {
+	if timestamp != "" {
+		t, err := parseTimestamp(timestamp)
+		if err != nil {
+			return fmt.Errorf("invalid --timestamp: %w", err)
+		}
+		packTimestamp = t
+		return nil
+	}
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: expected Unix seconds", epoch)
+		}
+		packClampTime = time.Unix(seconds, 0)
+	}
+	return nil
+}
+
+// parseTimestamp parses Unix seconds or an RFC 3339 time.
+func parseTimestamp(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither Unix seconds nor an RFC 3339 time", value)
+	}
+	return t, nil
+}
+
+// archivedModTime returns the modification time to record for a file last modified at t.
+func archivedModTime(t time.Time) time.Time {
+	if !packTimestamp.IsZero() {
+		return packTimestamp
+	}
+	if !packClampTime.IsZero() && t.After(packClampTime) {
+		return packClampTime
+	}
+	return t
+}
+
+// detectLanguage infers a language hint from a file's name, falling back to its shebang line.
+// It returns an empty string when the language is unknown.
+func detectLanguage(filename string, content []byte) string {
+	if lang, ok := languageByExtension[strings.ToLower(filepath.Ext(filename))]; ok {
+		return lang
+	}
+	if lang, ok := languageByFilename[strings.ToLower(filepath.Base(filename))]; ok {
+		return lang
+	}
+	if !bytes.HasPrefix(content, []byte("#!")) {
+		return ""
+	}
+	shebang := content[2:]
+	if idx := bytes.IndexByte(shebang, '\n'); idx != -1 {
+		shebang = shebang[:idx]
+	}
+	fields := strings.Fields(strings.TrimSpace(string(shebang)))
+	if len(fields) == 0 {
+		return ""
+	}
+	interpreter := filepath.Base(fields[0])
+	// Handle '#!/usr/bin/env python3' style shebangs.
+	if interpreter == "env" {
+		for _, field := range fields[1:] {
+			if !strings.HasPrefix(field, "-") {
+				interpreter = field
+				break
+			}
+		}
+	}
+	return languageByInterpreter[interpreter]
+}
+
+// strippedMarkerLine returns the marker line that opens presentation-only output, naming
+// what was removed, or "" when the content is packed losslessly.
+func strippedMarkerLine() string {
+	var removed []string
+	if packStripComments {
+		removed = append(removed, "comments removed by 'pack --strip-comments'")
+	}
+	if packTrimWhitespace {
+		removed = append(removed, "whitespace trimmed by 'pack --trim-whitespace'")
+	}
+	if len(removed) == 0 {
+		return ""
+	}
+	return strippedMarker + strings.Join(removed, ", ") + "; presentation only, not restorable with 'paktxt unpack'\n"
+}
+
+// trimWhitespace implements --trim-whitespace: it removes trailing spaces and tabs from every
+// line and collapses runs of 3 or more blank lines into a single one. Line endings (LF or
+// CRLF) are kept.
+func trimWhitespace(content []byte) []byte {
+	var out bytes.Buffer
+	var blankRun [][]byte // Line endings of the pending blank lines
+	flushBlankRun := func() {
+		if len(blankRun) >= 3 {
+			blankRun = blankRun[:1]
+		}
+		for _, ending := range blankRun {
+			out.Write(ending)
+		}
+		blankRun = blankRun[:0]
+	}
+	for len(content) > 0 {
+		line, rest, found := bytes.Cut(content, []byte("\n"))
+		content = rest
+		var ending []byte
+		if found {
+			ending = []byte("\n")
+			if bytes.HasSuffix(line, []byte("\r")) {
+				line, ending = line[:len(line)-1], []byte("\r\n")
+			}
+		}
+		line = bytes.TrimRight(line, " \t")
+		if len(line) == 0 && found {
+			blankRun = append(blankRun, ending)
+			continue
+		}
+		flushBlankRun()
+		out.Write(line)
+		out.Write(ending)
+	}
+	flushBlankRun()
+	return out.Bytes()
+}
+
+// stripComments removes comments from content for the languages supported by
+// --strip-comments and returns other content unchanged. Lines that held only a comment are
+// dropped. A small lexer skips string literals, so this is best effort: constructs such as
+// JavaScript regex literals or shell heredocs may be mangled.
+func stripComments(language string, content []byte) []byte {
+	var lineComment, quotes string
+	blockComments := false
+	switch language {
+	case "go", "javascript", "typescript":
+		lineComment, quotes, blockComments = "//", "\"'`", true
+	case "python", "shell":
+		lineComment, quotes = "#", "\"'"
+	default:
+		return content
+	}
+
+	var out []byte
+	touched := make(map[int]bool) // Lines of out where a comment was removed
+	line := 0
+	for i := 0; i < len(content); {
+		c := content[i]
+		switch {
+		case c == '\n':
+			out = append(out, c)
+			line++
+			i++
+		case strings.IndexByte(quotes, c) != -1:
+			end := skipStringLiteral(content, i, language)
+			out = append(out, content[i:end]...)
+			line += bytes.Count(content[i:end], []byte("\n"))
+			i = end
+		case blockComments && bytes.HasPrefix(content[i:], []byte("/*")):
+			end := len(content)
+			if idx := bytes.Index(content[i+2:], []byte("*/")); idx != -1 {
+				end = i + 2 + idx + 2
+			}
+			// Keep the line breaks so the surrounding lines stay intact.
+			for _, b := range content[i:end] {
+				if b == '\n' {
+					touched[line] = true
+					out = append(out, '\n')
+					line++
+				}
+			}
+			touched[line] = true
+			i = end
+		case bytes.HasPrefix(content[i:], []byte(lineComment)) && startsLineComment(content, i, language):
+			end := len(content)
+			if idx := bytes.IndexByte(content[i:], '\n'); idx != -1 {
+				end = i + idx
+			}
+			touched[line] = true
+			i = end
+		default:
+			out = append(out, c)
+			i++
+		}
+	}
+
+	// Drop lines left blank by comment removal and trim trailing whitespace on the others.
+	var result []byte
+	for n, l := range bytes.SplitAfter(out, []byte("\n")) {
+		if !touched[n] {
+			result = append(result, l...)
+			continue
+		}
+		body := bytes.TrimRight(l, " \t\r\n")
+		if len(body) == 0 {
+			continue
+		}
+		result = append(result, body...)
+		result = append(result, l[len(bytes.TrimRight(l, "\r\n")):]...)
+	}
+	return result
+}
+
+// startsLineComment reports whether the comment marker at content[i] really starts a
+// comment: a shebang is kept, and in shell '#' only starts a comment at the start of a word
+// (so '$#' and '${#var}' are left alone).
+func startsLineComment(content []byte, i int, language string) bool {
+	if i == 0 && bytes.HasPrefix(content, []byte("#!")) {
+		return false
+	}
+	if language == "shell" && i > 0 {
+		return strings.IndexByte(" \t\n;", content[i-1]) != -1
+	}
+	return true
+}
+
+// skipStringLiteral returns the index just past the string literal starting at content[i].
+// Unterminated single-line literals end at the line break.
+func skipStringLiteral(content []byte, i int, language string) int {
+	quote := content[i]
+	if language == "python" && i+2 < len(content) && content[i+1] == quote && content[i+2] == quote {
+		if idx := bytes.Index(content[i+3:], []byte{quote, quote, quote}); idx != -1 {
+			return i + 3 + idx + 3
+		}
+		return len(content)
+	}
+	multiline := quote == '`' || language == "shell"
+	escapes := !(quote == '`' && language == "go") && !(quote == '\'' && language == "shell")
+	for j := i + 1; j < len(content); j++ {
+		switch {
+		case escapes && content[j] == '\\':
+			j++
+		case content[j] == quote:
+			return j + 1
+		case content[j] == '\n' && !multiline:
+			return j
+		}
+	}
+	return len(content)
+}
+
+// extendLanguageMap adds the comma-separated ext=language pairs to languageByExtension.
+func extendLanguageMap(pairs string) error {
+	for _, pair := range parsePatterns(pairs) {
+		ext, lang, ok := strings.Cut(pair, "=")
+		ext, lang = strings.TrimSpace(ext), strings.TrimSpace(lang)
+		if !ok || ext == "" || lang == "" {
+			return fmt.Errorf("invalid --language-map entry '%s'; expected ext=language", pair)
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		languageByExtension[strings.ToLower(ext)] = lang
+	}
+	return nil
+}
+
+// writeLegacyBlock encodes a block using the delimiter-based format.
+func writeLegacyBlock(builder *strings.Builder, block *FileBlock) {
+	builder.WriteString(startBlockDelimiter)
+	builder.WriteString("\n")
+	// Content ending in a bare '\r' would lose it to the newline stripping on restore, and
+	// content containing the end delimiter would end the block early; record the exact size.
+	sized := (!block.HasTrailingNewline && bytes.HasSuffix(block.Content, []byte("\r"))) ||
+		bytes.Contains(block.Content, []byte(endBlockDelimiter))
+	if packCompactMetadata {
+		writeCompactMetadata(builder, block, sized)
+	} else {
+		writeLabeledMetadata(builder, block, sized)
+	}
+	// Ensure exactly one newline separates the content and the end delimiter.
+	// If the original content didn't end with a newline, add one here.
+	builder.Write(block.Content)
+	if !block.HasTrailingNewline || block.Object != "" {
+		builder.WriteString("\n") // Store references carry no content: an empty line, like an empty file
+	}
+	builder.WriteString(endBlockDelimiter)
+	builder.WriteString(blockSeparator)
+}
+
+// writeLabeledMetadata writes the default metadata of a v1 block: one labeled line per field,
+// then the content label.
+func writeLabeledMetadata(builder *strings.Builder, block *FileBlock, sized bool) {
+	builder.WriteString(filenameLabel)
+	builder.WriteString(block.Filename)
+	builder.WriteString("\n")
+	builder.WriteString(executableLabel)
+	if block.IsExecutable {
+		builder.WriteString("true")
+	} else {
+		builder.WriteString("false")
+	}
+	builder.WriteString("\n")
+	builder.WriteString(trailingNewlineLabel)
+	if block.HasTrailingNewline {
+		builder.WriteString("true")
+	} else {
+		builder.WriteString("false")
+	}
+	builder.WriteString("\n")
+	if block.Language != "" {
+		builder.WriteString(languageLabel)
+		builder.WriteString(block.Language)
+		builder.WriteString("\n")
+	}
+	if block.Symlink != "" {
+		builder.WriteString(symlinkLabel)
+		builder.WriteString(block.Symlink)
+		builder.WriteString("\n")
+	}
+	if block.HasBOM {
+		builder.WriteString(bomLabel)
+		builder.WriteString("true\n")
+	}
+	if block.ModTime != "" {
+		builder.WriteString(modtimeLabel)
+		builder.WriteString(block.ModTime)
+		builder.WriteString("\n")
+	}
+	if block.Object != "" {
+		builder.WriteString(objectLabel)
+		builder.WriteString(objectValue(block))
+		builder.WriteString("\n")
+	}
+	if sized {
+		builder.WriteString(sizeLabel)
+		builder.WriteString(strconv.Itoa(len(block.Content)))
+		builder.WriteString("\n")
+	}
+	builder.WriteString(contentLabel)
+}
 
-func changeWorkingDir(path string) error {
-	absWorkingDir, err := filepath.Abs(path)
-	if err != nil {
-		fmt.Printf("Error resolving working directory '%s': %v\n", path, err)
-		return err
+// compactValueEscaper escapes the characters that delimit compact metadata fields, and
+// compactValueUnescaper reverses it.
+var (
+	compactValueEscaper   = strings.NewReplacer("%", "%25", ";", "%3B")
+	compactValueUnescaper = strings.NewReplacer("%25", "%", "%3B", ";")
+)
+
+// writeCompactMetadata writes the metadata of a v1 block as a single compactMetaLabel line of
+// key=value pairs separated by ';'. Keys are the labels without ": "; the content follows on
+// the next line.
+func writeCompactMetadata(builder *strings.Builder, block *FileBlock, sized bool) {
+	fields := []string{
+		"filename=" + compactValueEscaper.Replace(block.Filename),
+		"executable=" + strconv.FormatBool(block.IsExecutable),
+		"trailing_newline=" + strconv.FormatBool(block.HasTrailingNewline),
 	}
-	if err := os.Chdir(absWorkingDir); err != nil {
-		fmt.Printf("Error changing working directory to '%s': %v\n", absWorkingDir, err)
-		return err
+	if block.Language != "" {
+		fields = append(fields, "language="+compactValueEscaper.Replace(block.Language))
 	}
-	fmt.Printf("Changed working directory to: %s\n", absWorkingDir)
-	return nil
+	if block.Symlink != "" {
+		fields = append(fields, "symlink="+compactValueEscaper.Replace(block.Symlink))
+	}
+	if block.HasBOM {
+		fields = append(fields, "bom=true")
+	}
+	if block.ModTime != "" {
+		fields = append(fields, "modtime="+compactValueEscaper.Replace(block.ModTime))
+	}
+	if block.Object != "" {
+		fields = append(fields, "object="+objectValue(block))
+	}
+	if sized {
+		fields = append(fields, "size="+strconv.Itoa(len(block.Content)))
+	}
+	builder.WriteString(compactMetaLabel)
+	builder.WriteString(strings.Join(fields, ";"))
+	builder.WriteString("\n")
 }
 
-func concatenateAndOutput(toClipboard bool, outputFile string, excludePatterns, filterPatterns, includePatterns []string) error {
-	fmt.Println("Scanning files for concatenation...")
+// parseCompactMetadata fills block from the fields of a compactMetaLabel line, records the keys
+// seen as labels in seen and returns the size field, or -1 when there is none.
+func parseCompactMetadata(fields string, block *FileBlock, seen map[string]bool) (int, error) {
+	size := -1
+	for _, field := range strings.Split(fields, ";") {
+		key, escaped, ok := strings.Cut(field, "=")
+		if !ok {
+			return size, fmt.Errorf("field %q is not key=value", field)
+		}
+		value := compactValueUnescaper.Replace(escaped)
+		var err error
+		seen[key+": "] = true
+		switch key + ": " {
+		case filenameLabel:
+			block.Filename = value
+		case executableLabel:
+			block.IsExecutable = value == "true"
+		case trailingNewlineLabel:
+			block.HasTrailingNewline = value == "true"
+		case languageLabel:
+			block.Language = value
+		case symlinkLabel:
+			block.Symlink = value
+		case bomLabel:
+			block.HasBOM = value == "true"
+		case modtimeLabel:
+			block.ModTime = value
+		case objectLabel:
+			block.Object, block.ObjectSize, err = parseObjectValue(value)
+			if err != nil {
+				return -1, err
+			}
+		case sizeLabel:
+			size, err = strconv.Atoi(value)
+			if err != nil || size < 0 {
+				return -1, fmt.Errorf("invalid size %q", value)
+			}
+		default:
+			if strictParse {
+				return size, fmt.Errorf("unknown key %q", key)
+			}
+			warnf(warnMetadata, block.Filename, "Ignoring unknown compact metadata key %q for file %q", key, block.Filename)
+		}
+	}
+	return size, nil
+}
 
-	var files []string
-	var err error
+// writeV2Block encodes a block using the length-prefixed format:
+// the magic line, a single-line JSON header, exactly Size bytes of content and a newline.
+func writeV2Block(builder *strings.Builder, block *FileBlock) error {
+	header, err := json.Marshal(block)
+	if err != nil {
+		return fmt.Errorf("failed to encode header for %s: %w", block.Filename, err)
+	}
+	builder.WriteString(v2Magic)
+	builder.Write(header)
+	builder.WriteString("\n")
+	builder.Write(block.Content)
+	builder.WriteString("\n")
+	return nil
+}
 
-	if isGitRepo() {
-		fmt.Println("Git repository detected, using git-aware file scanning (staged and working files).")
-		files, err = getGitFiles(excludePatterns, filterPatterns, nil)
+// parseBlocks parses paktxt content into file blocks, detecting the archive format.
+// The returned blocks hold the exact original file content.
+func parseBlocks(paktxtBytes []byte) ([]*FileBlock, error) {
+	if bytes.HasPrefix(paktxtBytes, []byte(markdownExportMarker)) {
+		return nil, errors.New("content is a markdown presentation export (pack --markdown) and cannot be unpacked; re-pack without --markdown")
+	}
+	if bytes.HasPrefix(paktxtBytes, []byte(strippedMarker)) {
+		return nil, errors.New("content was packed with --strip-comments or --trim-whitespace and cannot be unpacked; re-pack without them")
+	}
+	paktxtBytes, _, _ = splitSignature(paktxtBytes)
+	paktxtBytes, _, _ = splitBaseRef(paktxtBytes)
+	var blocks []*FileBlock
+	var err error
+	if bytes.HasPrefix(paktxtBytes, []byte(v2Magic)) {
+		blocks, err = parseV2Blocks(paktxtBytes)
 	} else {
-		fmt.Println("No Git repository detected. Scanning all files recursively from current directory...")
-		files, err = getAllFiles(".", excludePatterns, filterPatterns, nil)
+		blocks, err = parseLegacyBlocks(paktxtBytes)
 	}
-	if err != nil {
-		return fmt.Errorf("failed to get file list: %w", err)
+	for _, block := range blocks {
+		block.Filename = normalizeArchivePath(block.Filename)
 	}
+	return blocks, err
+}
 
-	if len(files) == 0 {
-		return errors.New("no relevant files found to concatenate")
+// normalizeArchivePath returns the form in which filenames are stored and compared: slash
+// separated and cleaned, so './a/b.go', 'a//b.go' and 'a/b.go' are the same file.
+func normalizeArchivePath(name string) string {
+	if name == "" {
+		return name
 	}
+	return path.Clean(filepath.ToSlash(name))
+}
 
-	files = prioritizeReadme(files)
+// parseV2Blocks parses a length-prefixed (v2) archive.
+func parseV2Blocks(paktxtBytes []byte) ([]*FileBlock, error) {
+	var blocks []*FileBlock
+	cursor := 0
 
-	paktxtContent, err := buildPaktxtContent(files)
-	if err != nil {
-		return fmt.Errorf("failed to build paktxt content: %w", err)
-	}
+	for cursor < len(paktxtBytes) {
+		if !bytes.HasPrefix(paktxtBytes[cursor:], []byte(v2Magic)) {
+			return blocks, fmt.Errorf("malformed v2 paktxt content: expected block magic at byte %d", cursor)
+		}
+		blockStart := cursor
+		cursor += len(v2Magic)
 
-	if toClipboard {
-		fmt.Println("Attempting to copy content to clipboard...")
-		if err := clipboard.WriteAll(paktxtContent); err != nil {
-			fmt.Printf("Error: Failed to copy to clipboard: %v\n", err)
-			fmt.Println("This might be due to system restrictions or lack of clipboard support.")
-			return fmt.Errorf("clipboard copy failed: %w", err)
+		headerEnd := bytes.IndexByte(paktxtBytes[cursor:], '\n')
+		if headerEnd == -1 {
+			return blocks, fmt.Errorf("malformed v2 paktxt content: unterminated header at byte %d", cursor)
 		}
-		fmt.Println("Content successfully copied to clipboard.")
-	} else {
-		if filepath.Ext(outputFile) == "" {
-			outputFile += paktxtExtension
-		} else if filepath.Ext(outputFile) != paktxtExtension {
-			fmt.Printf("Warning: Output file '%s' does not have a '%s' extension. Using as is.\n", outputFile, paktxtExtension)
+		block := &FileBlock{}
+		decoder := json.NewDecoder(bytes.NewReader(paktxtBytes[cursor : cursor+headerEnd]))
+		if strictParse {
+			decoder.DisallowUnknownFields()
 		}
+		if err := decoder.Decode(block); err != nil {
+			return blocks, fmt.Errorf("malformed v2 paktxt content: invalid header at byte %d: %w", cursor, err)
+		}
+		cursor += headerEnd + 1
 
-		fmt.Printf("Writing content to %s...\n", outputFile)
-		if err := os.WriteFile(outputFile, []byte(paktxtContent), 0644); err != nil {
-			return fmt.Errorf("failed to write to file %s: %w", outputFile, err)
+		if block.Size < 0 || block.Size > len(paktxtBytes)-cursor {
+			return blocks, fmt.Errorf("malformed v2 paktxt content: block for %q declares %d bytes but only %d remain", block.Filename, block.Size, len(paktxtBytes)-cursor)
 		}
-		fmt.Printf("Content successfully written to %s.\n", outputFile)
-	}
-	return nil
-}
+		block.Content = paktxtBytes[cursor : cursor+block.Size]
+		cursor += block.Size
 
-func prioritizeReadme(files []string) []string {
-	readmeIndex := -1
-	for i, file := range files {
-		if strings.EqualFold(filepath.Base(file), "readme.md") {
-			readmeIndex = i
-			break
+		// Each block is terminated by a single newline; tolerate its absence at end of data.
+		if cursor < len(paktxtBytes) {
+			if paktxtBytes[cursor] != '\n' {
+				return blocks, fmt.Errorf("malformed v2 paktxt content: missing block terminator at byte %d", cursor)
+			}
+			cursor++
 		}
-	}
+		block.raw = paktxtBytes[blockStart:cursor]
 
-	if readmeIndex != -1 {
-		readmeFile := files[readmeIndex]
-		files = append(files[:readmeIndex], files[readmeIndex+1:]...)
-		files = append([]string{readmeFile}, files...)
+		if block.Filename == "" {
+			if strictParse {
+				return blocks, fmt.Errorf("malformed v2 paktxt content: block at byte %d has no filename", blockStart)
+			}
+			warnf(warnMetadata, "", "Skipping malformed file block (no filename found).")
+			continue
+		}
+		blocks = append(blocks, block)
 	}
-	return files
+	return blocks, nil
 }
 
-func restoreFiles(fromClipboard bool, paktxtFile string, excludePatterns, filterPatterns, includePatterns []string) error {
-	var paktxtContent string
-	var err error
+// parseLegacyBlocks parses the delimiter-based archive format. It works on byte offsets
+// (bytes.Index) rather than a line scanner, so lines of any length need no buffer limit.
+func parseLegacyBlocks(paktxtBytes []byte) ([]*FileBlock, error) {
+	cursor := 0 // Current position in paktxtBytes
+	var blocks []*FileBlock
 
-	if fromClipboard {
-		fmt.Println("Reading content from clipboard for restoration...")
-		paktxtContent, err = clipboard.ReadAll()
-		if err != nil {
-			fmt.Printf("Error: Failed to read from clipboard: %v\n", err)
-			fmt.Println("This might be due to system restrictions or lack of clipboard content.")
-			return fmt.Errorf("clipboard read failed: %w", err)
+	delims, headerEndIndex, err := detectDelimiters(paktxtBytes)
+	if err != nil {
+		return nil, err
+	}
+	cursor = headerEndIndex // Start parsing from the first delimiter
+
+blockLoop:
+	for cursor < len(paktxtBytes) {
+		startBlockIdx := bytes.Index(paktxtBytes[cursor:], []byte(delims.start))
+		if startBlockIdx == -1 {
+			break // No more start delimiters found, we are done.
+		}
+
+		blockStart := cursor + startBlockIdx
+		cursor += startBlockIdx + len(delims.start)
+		// Skip the line ending (LF or CRLF) after the start delimiter
+		cursor = skipLineEnding(paktxtBytes, cursor)
+
+		currentFileBlock := &FileBlock{}
+		foundContentLabel := false
+		seenLabels := make(map[string]bool)
+		contentSize := -1 // From the optional size label
+
+		for {
+			lineEnd := bytes.IndexByte(paktxtBytes[cursor:], '\n')
+			if lineEnd == -1 {
+				return blocks, fmt.Errorf("malformed paktxt content: unexpected end of data during metadata parsing of block at byte %d", blockStart)
+			}
+
+			lineBytes := bytes.TrimSuffix(paktxtBytes[cursor:cursor+lineEnd], []byte("\r"))
+			line := string(lineBytes)
+
+			lineAdvance := lineEnd + 1
+			if cursor+lineAdvance > len(paktxtBytes) {
+				return blocks, fmt.Errorf("malformed paktxt content: reading past end of buffer at byte %d", cursor)
+			}
+
+			if line == delims.start {
+				// A block cut off before its content: drop it and resync on the next one.
+				if strictParse {
+					return blocks, fmt.Errorf("malformed paktxt content: block at byte %d is truncated; another block starts at byte %d before its content", blockStart, cursor)
+				}
+				warnf(warnMetadata, currentFileBlock.Filename, "Skipping truncated file block at byte %d (%q): another block starts at byte %d before its content.", blockStart, currentFileBlock.Filename, cursor)
+				continue blockLoop
+			}
+			if fields, ok := strings.CutPrefix(line, compactMetaLabel); ok {
+				// --compact-metadata: every field on one line, and the content starts on the next.
+				size, err := parseCompactMetadata(fields, currentFileBlock, seenLabels)
+				if err != nil {
+					return blocks, fmt.Errorf("malformed paktxt content: invalid compact metadata at byte %d: %w", cursor, err)
+				}
+				contentSize = size
+				currentFileBlock.compact = true
+				cursor += lineAdvance
+				break
+			}
+			if label, _, ok := strings.Cut(line, ": "); ok {
+				seenLabels[label+": "] = true
+			}
+			if strings.HasPrefix(line, filenameLabel) {
+				currentFileBlock.Filename = strings.TrimPrefix(line, filenameLabel)
+			} else if strings.HasPrefix(line, executableLabel) {
+				execStr := strings.TrimPrefix(line, executableLabel)
+				currentFileBlock.IsExecutable = (execStr == "true")
+			} else if strings.HasPrefix(line, trailingNewlineLabel) {
+				tnlStr := strings.TrimPrefix(line, trailingNewlineLabel)
+				currentFileBlock.HasTrailingNewline = (tnlStr == "true")
+			} else if strings.HasPrefix(line, languageLabel) {
+				// Informational only; restore does not use it.
+				currentFileBlock.Language = strings.TrimPrefix(line, languageLabel)
+			} else if strings.HasPrefix(line, symlinkLabel) {
+				currentFileBlock.Symlink = strings.TrimPrefix(line, symlinkLabel)
+			} else if strings.HasPrefix(line, bomLabel) {
+				currentFileBlock.HasBOM = (strings.TrimPrefix(line, bomLabel) == "true")
+			} else if strings.HasPrefix(line, modtimeLabel) {
+				currentFileBlock.ModTime = strings.TrimPrefix(line, modtimeLabel)
+			} else if strings.HasPrefix(line, objectLabel) {
+				object, objectSize, err := parseObjectValue(strings.TrimPrefix(line, objectLabel))
+				if err != nil {
+					return blocks, fmt.Errorf("malformed paktxt content: %v at byte %d", err, cursor)
+				}
+				currentFileBlock.Object, currentFileBlock.ObjectSize = object, objectSize
+			} else if strings.HasPrefix(line, sizeLabel) {
+				size, err := strconv.Atoi(strings.TrimPrefix(line, sizeLabel))
+				if err != nil || size < 0 {
+					return blocks, fmt.Errorf("malformed paktxt content: invalid size label %q at byte %d", line, cursor)
+				}
+				contentSize = size
+			} else if strings.TrimSpace(line) == strings.TrimSpace(contentLabel) {
+				// Tolerates stray whitespace around the label; the content starts on the next line.
+				foundContentLabel = true
+			} else if strings.TrimSpace(line) == "" {
+				// Allow empty lines in metadata
+			} else {
+				if strictParse {
+					return blocks, fmt.Errorf("malformed paktxt content: unexpected metadata line %q at byte %d", line, cursor)
+				}
+				warnf(warnMetadata, currentFileBlock.Filename, "Unexpected line in metadata block for file %q: %q", currentFileBlock.Filename, line)
+			}
+
+			cursor += lineAdvance
+
+			if foundContentLabel {
+				break
+			}
 		}
-		if paktxtContent == "" {
-			fmt.Println("Clipboard content is empty.")
-			return errors.New("clipboard content is empty; no parsable paktxt data found")
+
+		if strictParse {
+			for _, label := range []string{filenameLabel, executableLabel, trailingNewlineLabel} {
+				if !seenLabels[label] {
+					return blocks, fmt.Errorf("malformed paktxt content: block at byte %d is missing the required '%s' label", blockStart, strings.TrimSuffix(label, " "))
+				}
+			}
 		}
-	} else {
-		fmt.Printf("Reading content from file '%s' for restoration...\n", paktxtFile)
-		contentBytes, readErr := os.ReadFile(paktxtFile)
-		if readErr != nil {
-			return fmt.Errorf("failed to read from paktxt file '%s': %w", paktxtFile, readErr)
+
+		var endBlockIdx int
+		if contentSize >= 0 {
+			// The size is authoritative: take exactly that many bytes, then the newline added
+			// for files without one, then the end delimiter.
+			if contentSize > len(paktxtBytes)-cursor { // Compared before adding, which can overflow
+				return blocks, fmt.Errorf("malformed paktxt content: size label of block at byte %d exceeds the archive", blockStart)
+			}
+			contentEnd := cursor + contentSize
+			delimiterAt := contentEnd
+			if !currentFileBlock.HasTrailingNewline {
+				delimiterAt = skipLineEnding(paktxtBytes, contentEnd)
+			}
+			if !bytes.HasPrefix(paktxtBytes[delimiterAt:], []byte(delims.end)) {
+				return blocks, fmt.Errorf("malformed paktxt content: content of block at byte %d does not match its size label", blockStart)
+			}
+			currentFileBlock.Content = paktxtBytes[cursor:contentEnd]
+			endBlockIdx = delimiterAt - cursor
+		} else {
+			endBlockIdx = bytes.Index(paktxtBytes[cursor:], []byte(delims.end))
+			if endBlockIdx == -1 {
+				return blocks, fmt.Errorf("malformed paktxt content: missing end delimiter for file block at byte %d", blockStart)
+			}
+			if strictParse && (endBlockIdx == 0 || paktxtBytes[cursor+endBlockIdx-1] != '\n') {
+				return blocks, fmt.Errorf("malformed paktxt content: end delimiter at byte %d does not start on its own line", cursor+endBlockIdx)
+			}
+			currentFileBlock.Content = paktxtBytes[cursor : cursor+endBlockIdx]
+		}
+		cursor += endBlockIdx + len(delims.end)
+
+		// Consume the end delimiter's line ending plus the block separator: any run of
+		// whitespace-only lines before the next start delimiter.
+		cursor = skipLineEnding(paktxtBytes, cursor)
+		cursor = skipBlankLines(paktxtBytes, cursor)
+		currentFileBlock.raw = paktxtBytes[blockStart:cursor]
+		// Archives concatenated from several pack runs repeat the header between blocks, in
+		// the wording of whichever version wrote them.
+		if bytes.HasPrefix(paktxtBytes[cursor:], []byte(headerFirstLine)) {
+			if next := bytes.Index(paktxtBytes[cursor:], []byte(delims.start)); next != -1 {
+				cursor += next
+			} else {
+				cursor = len(paktxtBytes)
+			}
+		}
+		if strictParse && cursor < len(paktxtBytes) && !bytes.HasPrefix(paktxtBytes[cursor:], []byte(delims.start)) {
+			return blocks, fmt.Errorf("malformed paktxt content: unexpected data between blocks at byte %d", cursor)
+		}
+
+		if currentFileBlock == nil || currentFileBlock.Filename == "" {
+			warnf(warnMetadata, "", "Skipping malformed file block (no filename found).")
+			continue
+		}
+
+		// If the original file did NOT have a trailing newline, remove the one added during packing.
+		// Sized content is already exact.
+		contentLen := len(currentFileBlock.Content)
+		if !currentFileBlock.HasTrailingNewline && contentLen > 0 && contentSize < 0 {
+			// Check for and remove trailing CRLF (\r\n) first
+			if contentLen >= 2 && currentFileBlock.Content[contentLen-2] == '\r' && currentFileBlock.Content[contentLen-1] == '\n' {
+				currentFileBlock.Content = currentFileBlock.Content[:contentLen-2]
+			} else if currentFileBlock.Content[contentLen-1] == '\n' {
+				// If not CRLF, check for and remove single LF (\n)
+				currentFileBlock.Content = currentFileBlock.Content[:len(currentFileBlock.Content)-1]
+
+			}
 		}
-		paktxtContent = string(contentBytes)
+		if currentFileBlock.Object != "" {
+			// The content is in the store; the block only holds the empty line written for it.
+			currentFileBlock.Content = nil
+		}
+		currentFileBlock.Size = len(currentFileBlock.Content)
+		blocks = append(blocks, currentFileBlock)
 	}
 
-	if paktxtContent == "" {
-		return errors.New("input content (from clipboard or file) is empty or contains no parsable paktxt data")
+	return blocks, nil
+}
+
+// headerFirstLine starts the header of every v1 archive, whatever its version.
+const headerFirstLine = "PAKTXT\n"
+
+// detectDelimiters returns the delimiter set of a v1 archive and the offset of its first
+// block. A format_version line in the header decides; without one, the known start delimiter
+// that occurs first does. Versions newer than this build are reported as such.
+func detectDelimiters(data []byte) (delimiterSet, int, error) {
+	var found delimiterSet
+	first := -1
+	for _, set := range knownDelimiters {
+		if i := bytes.Index(data, []byte(set.start)); i != -1 && (first == -1 || i < first) {
+			found, first = set, i
+		}
 	}
 
-	fmt.Println("Parsing content and restoring files...")
-	// Pass includePatterns as nil or an empty slice if it's no longer used
-	if err := parseAndRestore(paktxtContent, excludePatterns, filterPatterns, nil); err != nil {
-		return fmt.Errorf("failed to parse and restore files: %w", err)
+	headerEnd := first
+	if headerEnd == -1 {
+		headerEnd = len(data)
+	}
+	if bytes.HasPrefix(data, []byte(headerFirstLine)) {
+		for _, line := range strings.Split(string(data[:headerEnd]), "\n") {
+			value, ok := strings.CutPrefix(strings.TrimSuffix(line, "\r"), formatVersionLabel)
+			if !ok {
+				continue
+			}
+			declared, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return found, 0, fmt.Errorf("malformed paktxt header: invalid format_version %q", value)
+			}
+			for _, set := range knownDelimiters {
+				if set.version == declared {
+					if i := bytes.Index(data, []byte(set.start)); i != -1 {
+						return set, i, nil
+					}
+					return set, 0, errors.New("no file blocks found in paktxt content (missing start delimiter)")
+				}
+			}
+			return found, 0, fmt.Errorf("the archive has format_version %d, which this version of paktxt (%s) cannot read; upgrade paktxt", declared, version)
+		}
+	}
+	if first == -1 {
+		return found, 0, errors.New("no file blocks found in paktxt content (missing start delimiter)")
+	}
+	return found, first, nil
+}
+
+// checkCurrentDelimiters returns an error if the v1 archive data uses an older delimiter set
+// than pack writes, since blocks with different delimiters cannot be mixed in one archive.
+func checkCurrentDelimiters(data []byte) error {
+	delims, _, err := detectDelimiters(data)
+	if err != nil {
+		return err
+	}
+	if current := knownDelimiters[len(knownDelimiters)-1]; delims != current {
+		return fmt.Errorf("it uses the delimiters of format_version %d, and new blocks would use those of version %d; re-pack it first", delims.version, current.version)
 	}
 	return nil
 }
 
-func isGitRepo() bool {
-	cmd := exec.Command("git", "rev-parse", "--is-inside-work-tree")
-	cmd.Stderr = nil
-	output, err := cmd.Output()
-	return err == nil && strings.TrimSpace(string(output)) == "true"
+// looksLikeArchive reports whether content is a paktxt archive of any version: a v2 archive,
+// or a v1 header followed by blocks or a format_version line this build may not know.
+func looksLikeArchive(content []byte) bool {
+	if bytes.HasPrefix(content, []byte(v2Magic)) {
+		return true
+	}
+	if !bytes.HasPrefix(content, []byte(headerFirstLine)) {
+		return false
+	}
+	_, _, err := detectDelimiters(content)
+	return err == nil || bytes.HasPrefix(content[len(headerFirstLine):], []byte(formatVersionLabel))
 }
 
-// getGitFiles gets all files that are either staged for commit or in the working directory
-// This includes tracked files (committed), staged files (added to index), and untracked files
-func getGitFiles(excludePatterns, filterPatterns, includePatterns []string) ([]string, error) {
-	// Get all files that git knows about (tracked + staged)
-	// --cached: files in the index (staged)
-	// --others: untracked files
-	// --exclude-standard: respect .gitignore
-	cmd := exec.Command("git", "ls-files", "--cached", "--others", "--exclude-standard")
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("failed to run git ls-files: %w", err)
+// skipLineEnding advances cursor past a single LF or CRLF line ending, if present.
+func skipLineEnding(data []byte, cursor int) int {
+	if cursor < len(data) && data[cursor] == '\r' && cursor+1 < len(data) && data[cursor+1] == '\n' {
+		return cursor + 2
 	}
+	if cursor < len(data) && data[cursor] == '\n' {
+		return cursor + 1
+	}
+	return cursor
+}
 
-	gitFiles := strings.Split(strings.TrimSpace(string(output)), "\n")
-	if len(gitFiles) == 1 && gitFiles[0] == "" {
-		// No files found
-		return []string{}, nil
+// skipBlankLines advances cursor past any run of whitespace-only lines. A trailing
+// whitespace-only fragment without a line ending (end of data) is skipped as well.
+func skipBlankLines(data []byte, cursor int) int {
+	for cursor < len(data) {
+		lineEnd := bytes.IndexByte(data[cursor:], '\n')
+		var line []byte
+		if lineEnd == -1 {
+			line = data[cursor:]
+		} else {
+			line = data[cursor : cursor+lineEnd]
+		}
+		if len(bytes.TrimSpace(line)) != 0 {
+			return cursor
+		}
+		if lineEnd == -1 {
+			return len(data)
+		}
+		cursor += lineEnd + 1
 	}
+	return cursor
+}
 
-	var filteredFiles []string
-	for _, file := range gitFiles {
-		if file == "" {
+// parseAndRestore parses the paktxt content and recreates files and directories.
+// Files are written one at a time in archive order, or in reverse order with --reverse-restore;
+// scripts/roundtrip-test.sh checks this. Only --jobs above 1 opts out: directories are still
+// created in order, but file contents are written concurrently by a restorePool. It returns
+// the paths of the files that were written, in the order written.
+func parseAndRestore(paktxtBytes []byte, excludePatterns, filterPatterns, includePatterns []string) ([]string, error) {
+	var restored []string
+	kept := 0
+	var createdDirs []string                  // Directories this run created, parents before children
+	restoredByFold := make(map[string]string) // Case-folded name -> first name restored under it
+	loweredFrom := make(map[string]string)    // --ignore-case-filenames: lower-case name -> archived name
+	renamed := 0
+	if unpackPruneEmpty {
+		defer func() { pruneEmptyDirs(createdDirs) }()
+	}
+
+	blocks, err := parseRestoreBlocks(paktxtBytes)
+	if err != nil {
+		return nil, err
+	}
+	defer profileAdd("write", profileStart())
+	var pool *restorePool
+	if unpackJobs > 1 {
+		pool = newRestorePool(unpackJobs)
+		defer pool.close() // On early returns, let the writes in progress finish
+	}
+
+	for _, currentFileBlock := range blocks {
+		if !selectRestoreBlock(currentFileBlock, excludePatterns, filterPatterns) {
 			continue
 		}
+		streamed := streamsStoreObject(currentFileBlock)
+		if !streamed {
+			if err := loadStoreObject(currentFileBlock); err != nil {
+				return restored, err
+			}
+		}
+		wasRenamed, err := transformRestoreBlock(currentFileBlock, loweredFrom, streamed)
+		if err != nil {
+			return restored, err
+		}
+		if wasRenamed {
+			renamed++
+		}
 
-		// Always exclude paktxt's own output files and executable
-		if strings.HasSuffix(strings.ToLower(file), paktxtExtension) ||
-			strings.EqualFold(filepath.Base(file), "paktxt") || strings.EqualFold(filepath.Base(file), "paktxt.exe") {
-			continue
+		if unpackRelocate {
+			taken := pathExists
+			if pool != nil {
+				taken = pool.taken
+			}
+			if relocated := nonCollidingName(currentFileBlock.Filename, taken); relocated != currentFileBlock.Filename {
+				fmt.Printf("Relocating %s to %s (name already taken).\n", currentFileBlock.Filename, relocated)
+				currentFileBlock.Filename = relocated
+			}
 		}
 
-		// Check if file exists (git ls-files might list deleted files)
-		if _, err := os.Stat(file); os.IsNotExist(err) {
+		if earlier := caseCollision(currentFileBlock.Filename, restoredByFold); earlier != "" {
+			warnf(warnPath, currentFileBlock.Filename, "'%s' and '%s' differ only in case and are the same file on this case-insensitive filesystem; use --relocate-on-collision to keep both.", currentFileBlock.Filename, earlier)
+		}
+		if pool != nil {
+			// A block whose final name is still being written must see the earlier file on disk.
+			pool.waitFor(currentFileBlock.Filename)
+		}
+		if keepExistingFile(currentFileBlock) {
+			kept++
 			continue
 		}
-
-		// 1. --filter (Whitelist): If filter patterns are provided, file must match at least one
-		if len(filterPatterns) > 0 {
-			if !matchesPattern(file, filterPatterns) {
-				continue
-			}
+		if fold := strings.ToLower(filepath.Clean(currentFileBlock.Filename)); restoredByFold[fold] == "" {
+			restoredByFold[fold] = currentFileBlock.Filename
 		}
 
-		// 2. --exclude (User-defined exclusions)
-		if matchesPattern(file, excludePatterns) {
+		// Checked only now, after renames and once the blocks this one depends on are on disk.
+		if reason := unsafeRestoreTarget(currentFileBlock); reason != "" {
+			warnf(warnPath, currentFileBlock.Filename, "Skipping restoration of %s: %s.", currentFileBlock.Filename, reason)
 			continue
 		}
 
-		// 3. Built-in exclusions (same as getAllFiles)
-		if shouldExcludePath(file) {
+		dir := filepath.Dir(currentFileBlock.Filename)
+		if dir != "" && dir != "." {
+			if unpackPruneEmpty {
+				createdDirs = append(createdDirs, missingDirs(dir)...)
+			}
+			if err := os.MkdirAll(dir, unpackDirMode&^unpackUmask); err != nil {
+				return restored, fmt.Errorf("failed to create directory '%s' for file '%s': %w", dir, currentFileBlock.Filename, err)
+			}
+		}
+
+		if pool != nil {
+			if err := pool.submit(currentFileBlock); err != nil {
+				return restored, err
+			}
 			continue
 		}
+		written, err := writeRestoredBlock(currentFileBlock)
+		if err != nil {
+			return restored, err
+		}
+		if written {
+			restored = append(restored, currentFileBlock.Filename)
+		}
+	}
 
-		// 4. Binary check (same as getAllFiles)
-		if isBinary, err := isBinaryFileBySignature(file); isBinary {
-			fmt.Printf("Skipping binary file (by signature): %s\n", file)
-			continue
-		} else if err != nil {
-			fmt.Printf("Warning: Error checking binary signature for %s: %v\n", file, err)
+	if pool != nil {
+		written, err := pool.close()
+		restored = append(restored, written...)
+		if err != nil {
+			return restored, err
+		}
+	}
+	if kept > 0 {
+		policy := "--on-conflict " + unpackOnConflict
+		if unpackSkipUnchanged {
+			policy += ", --skip-unchanged"
 		}
+		fmt.Printf("Kept %d existing file(s) (%s).\n", kept, policy)
+	}
+	if renamed > 0 {
+		fmt.Printf("Renamed %d file(s) to lower case.\n", renamed)
+	}
+	return restored, nil
+}
 
-		filteredFiles = append(filteredFiles, file)
+// overwriteReadOnlyFile writes content to the existing file name for --force by making it
+// writable for the owner first, and puts its previous mode back afterwards, also when the
+// write fails. It returns that mode.
+func overwriteReadOnlyFile(name string, content []byte) (fs.FileMode, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	mode := info.Mode().Perm()
+	if err := os.Chmod(name, mode|0200); err != nil {
+		return 0, err
+	}
+	writeErr := os.WriteFile(name, content, mode)
+	if err := os.Chmod(name, mode); err != nil && writeErr == nil {
+		return 0, err
 	}
+	return mode, writeErr
+}
 
-	return filteredFiles, nil
+// caseCollision returns the name of a file restored earlier in this run that name refers to
+// as well, which happens when the two differ only in case on a case-insensitive filesystem
+// (the macOS and Windows default), or "" if there is none.
+func caseCollision(name string, restoredByFold map[string]string) string {
+	earlier := restoredByFold[strings.ToLower(filepath.Clean(name))]
+	if earlier == "" || earlier == name {
+		return ""
+	}
+	earlierInfo, err := os.Lstat(earlier)
+	if err != nil {
+		return ""
+	}
+	info, err := os.Lstat(name)
+	if err != nil || !os.SameFile(earlierInfo, info) {
+		return ""
+	}
+	return earlier
 }
 
-// getAllFiles recursively walks through the directory and collects all non-excluded files.
-func getAllFiles(root string, excludePatterns, filterPatterns, includePatterns []string) ([]string, error) {
-	var files []string
-	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
+// missingDirs returns dir and those of its ancestors that do not exist yet, outermost first.
+func missingDirs(dir string) []string {
+	var missing []string
+	for ; dir != "." && dir != string(filepath.Separator) && !pathExists(dir); dir = filepath.Dir(dir) {
+		missing = append([]string{dir}, missing...)
+	}
+	return missing
+}
+
+// pruneEmptyDirs removes the directories in dirs that are empty, innermost first, so that
+// parents emptied by removing their children are removed as well.
+func pruneEmptyDirs(dirs []string) {
+	for i := len(dirs) - 1; i >= 0; i-- {
+		entries, err := os.ReadDir(dirs[i])
+		if err != nil || len(entries) > 0 {
+			continue
 		}
-		// Always exclude paktxt's own output file name and its extensions.
-		// And the executable itself.
-		if strings.HasSuffix(strings.ToLower(path), paktxtExtension) ||
-			strings.EqualFold(filepath.Base(path), "paktxt") || strings.EqualFold(filepath.Base(path), "paktxt.exe") {
-			return nil
+		if err := os.Remove(dirs[i]); err == nil {
+			fmt.Printf("Removed empty directory: %s\n", dirs[i])
 		}
+	}
+}
 
-		// 1. Directory Exclusion (always first for efficiency)
-		if d.IsDir() {
-			if shouldExcludeDir(path) {
-				return fs.SkipDir
+// checkRequiredFiles returns an error naming every pattern in required that no block matches.
+func checkRequiredFiles(blocks []*FileBlock, required []string) error {
+	var missing []string
+	for _, pattern := range required {
+		found := false
+		for _, block := range blocks {
+			if matchesPattern(block.Filename, []string{pattern}) {
+				found = true
+				break
 			}
-			return nil
 		}
+		if !found {
+			missing = append(missing, pattern)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("archive has no file matching the required pattern(s): %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
 
-		// 2. --filter (Whitelist): If filter patterns are provided, a file *must* match AT LEAST ONE
-		//    filter pattern to be considered further. If it doesn't match, it's immediately out.
-		if len(filterPatterns) > 0 {
-			if !matchesPattern(path, filterPatterns) {
-				return nil // Does not match any filter pattern, so exclude
-			}
+// unsafeRestorePath reports why a block's filename must not be restored, or "" if it is safe.
+// Absolute paths are only allowed with --allow-absolute; relative paths must stay inside the
+// working directory. The check is lexical: unpack also applies unsafeRestoreTarget before
+// writing, which covers symlinked parent directories and symlink targets.
+func unsafeRestorePath(name string) string {
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" || strings.HasPrefix(filepath.ToSlash(name), "/") {
+		if unpackAllowAbsolute {
+			return ""
 		}
+		return "absolute path (use --allow-absolute to restore it)"
+	}
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "path escapes the working directory"
+	}
+	return ""
+}
 
-		// 3. (REMOVED: --include logic was here)
+// unsafeRestoreTarget complements unsafeRestorePath with the checks that depend on the
+// filesystem and on symlink targets, so that no block is written outside the working
+// directory through a symlink: an existing parent directory of a relative name must not be a
+// symlink, and a symlink block must point inside the working directory. Its target must be
+// relative and clean, so that only leading '..' elements are resolved by the filesystem, and
+// only through real directories. It reports why the block must not be restored, or "".
+func unsafeRestoreTarget(block *FileBlock) string {
+	name := filepath.FromSlash(block.Filename)
+	if filepath.IsAbs(name) {
+		return "" // Only restored with --allow-absolute, which permits any location
+	}
+	if parent := symlinkedParent(name); parent != "" {
+		return fmt.Sprintf("its parent directory '%s' is a symlink", filepath.ToSlash(parent))
+	}
+	if block.Symlink == "" {
+		return ""
+	}
+	target := filepath.FromSlash(block.Symlink)
+	if filepath.IsAbs(target) || filepath.VolumeName(target) != "" || strings.HasPrefix(block.Symlink, "/") {
+		return fmt.Sprintf("its symlink target '%s' is absolute", block.Symlink)
+	}
+	if target != filepath.Clean(target) {
+		return fmt.Sprintf("its symlink target '%s' is not a clean path", block.Symlink)
+	}
+	resolved := filepath.Join(filepath.Dir(name), target)
+	if resolved == ".." || strings.HasPrefix(resolved, ".."+string(filepath.Separator)) {
+		return fmt.Sprintf("its symlink target '%s' is outside the working directory", block.Symlink)
+	}
+	return ""
+}
 
-		// 4. --exclude (Additive Exclusion): Apply user-defined glob exclusions.
-		//    Now applied directly without --include override.
-		if matchesPattern(path, excludePatterns) {
-			return nil
+// symlinkedParent returns the first existing parent directory of the relative path name that
+// is a symlink, or "" if there is none.
+func symlinkedParent(name string) string {
+	dir := filepath.Dir(filepath.Clean(name))
+	if dir == "." {
+		return ""
+	}
+	current := ""
+	for _, part := range strings.Split(dir, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if err != nil || !info.IsDir() && info.Mode()&fs.ModeSymlink == 0 {
+			return "" // Created by the restore, or not a directory, which fails the restore
 		}
-
-		// 5. Built-in Path/Extension Exclusion: Checks common system files and extensions.
-		//    Now applied directly without --include override.
-		if shouldExcludePath(path) {
-			return nil
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return current
 		}
+	}
+	return ""
+}
 
-		// 6. Binary Signature Check: Most expensive check, performed last.
-		//    Now applied directly without --include override.
-		if isBinary, err := isBinaryFileBySignature(path); isBinary {
-			fmt.Printf("Skipping binary file (by signature): %s\n", path)
-			return nil
-		} else if err != nil {
-			// If there's an error reading the signature (e.g., permissions), we'll print a warning
-			// but still include the file unless we explicitly want to skip on error.
-			fmt.Printf("Warning: Error checking binary signature for %s: %v\n", path, err)
-		}
+// maxNameLength is the longest file name (in bytes) nonCollidingName produces, matching the
+// limit of common filesystems.
+const maxNameLength = 255
 
-		// If not excluded by any of the above, add it.
-		relPath, err := filepath.Rel(root, path)
-		if err != nil {
-			fmt.Printf("Warning: Could not get relative path for %s: %v\n", path, err)
-			files = append(files, path)
-		} else {
-			files = append(files, relPath)
+// nonCollidingName returns path if taken reports it as free, or otherwise the first free
+// variant 'name (1).ext', 'name (2).ext', ... . Only the last extension is kept apart
+// ('a.tar (1).gz'), dotfiles such as '.env' have no extension, and the stem is shortened
+// (on a UTF-8 boundary) to keep the name within maxNameLength bytes.
+func nonCollidingName(path string, taken func(string) bool) string {
+	if !taken(path) {
+		return path
+	}
+	dir, base := filepath.Split(path)
+	ext := filepath.Ext(base)
+	if ext == base {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(base, ext)
+	for n := 1; ; n++ {
+		suffix := fmt.Sprintf(" (%d)", n)
+		trimmed := stem
+		if keep := maxNameLength - len(suffix) - len(ext); len(trimmed) > keep {
+			trimmed = trimmed[:max(keep, 0)]
+			for len(trimmed) > 0 && !utf8.ValidString(trimmed) {
+				trimmed = trimmed[:len(trimmed)-1]
+			}
 		}
-		return nil
-	})
-	return files, err
+		if candidate := dir + trimmed + suffix + ext; !taken(candidate) {
+			return candidate
+		}
+	}
 }
 
-// shouldExcludeDir checks if a directory should be excluded from scanning.
-func shouldExcludeDir(path string) bool {
-	dirName := filepath.Base(path)
-	return excludedDirs[dirName]
+// pathExists reports whether anything (including a dangling symlink) exists at path.
+func pathExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
 }
 
-// shouldExcludePath checks if a file path indicates it should be excluded based on name or common extension.
-// This is the FASTEST check as it doesn't involve opening the file.
-func shouldExcludePath(path string) bool {
-	name := strings.ToLower(filepath.Base(path))
-	ext := strings.ToLower(filepath.Ext(path))
-
-	// Exclude by specific common names (regardless of extension).
-	excludedNames := map[string]bool{
-		".ds_store":   true, // macOS desktop services store file
-		"thumbs.db":   true, // Windows thumbnail cache
-		"desktop.ini": true, // Windows desktop customization file
-		".localized":  true, // macOS localization marker
-		"icon\r":      true, // macOS custom icon file (has a carriage return in name)
-		// Add other common system/temp files without extensions here if needed
+// keepExistingFile applies --skip-unchanged and the --on-conflict policy, and reports whether
+// the file already on disk should be kept instead of restoring block over it. Without a
+// recorded modtime, 'newer' falls back to comparing content.
+func keepExistingFile(block *FileBlock) bool {
+	if unpackOnConflict == conflictOverwrite && !unpackSkipUnchanged {
+		return false
 	}
-	if excludedNames[name] {
-		return true
+	info, err := os.Lstat(block.Filename)
+	if err != nil {
+		return false // Nothing to conflict with
 	}
-
-	// Exclude by common binary/non-text extensions.
-	// This list is intentionally broad to catch files quickly by their extension.
-	excludedExtensions := map[string]bool{
-		".exe": true, ".dll": true, ".so": true, ".dylib": true, // Executables/Libraries
-		".zip": true, ".tar": true, ".gz": true, ".rar": true, ".7z": true, // Archives
-		".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".bmp": true, ".svg": true, // Images
-		".ico": true,                             // Icons
-		".mp3": true, ".wav": true, ".ogg": true, // Audio
-		".mp4": true, ".avi": true, ".mov": true, ".mkv": true, // Video
-		".pdf":    true,                                // PDF documents
-		".sqlite": true, ".db": true, ".sqlite3": true, // Databases
-		".log":          true, // Logs are text but often very large and unwanted
-		".bin":          true, // Generic binary files
-		".class":        true, // Java compiled classes
-		".jar":          true, // Java archives (are zips)
-		".lock":         true, // Generic lock files
-		paktxtExtension: true, // Exclude paktxt's own output
-		// Add other extensions that are definitely not text and you don't want to pack
-		".obj": true, ".lib": true, ".a": true, // Compiled objects/static libraries
-		".dat": true,               // Generic data file, often binary
-		".tmp": true,               // Temporary files
-		".bak": true,               // Backup files
-		".swp": true, ".swo": true, // Vim swap files
-		".pyc":     true,                     // Python compiled bytecode
-		".iml":     true,                     // IntelliJ IDEA module file (XML, but often auto-generated and noisy)
-		".project": true, ".classpath": true, // Eclipse project files (XML, similarly noisy)
-		".vspscc": true, ".vssscc": true, // Visual Studio Source Control files
-		".suo": true, ".user": true, // Visual Studio user-specific settings
-		".ncb": true, ".sdf": true, ".ipch": true, // Visual Studio Intellisense/Browse info
+	if unpackOnConflict == conflictSkip {
+		fmt.Printf("Keeping existing file: %s\n", block.Filename)
+		recordEvent(eventKept, block.Filename, "exists on disk (--on-conflict %s)", unpackOnConflict)
+		return true
 	}
-
-	if excludedExtensions[ext] {
+	if (unpackSkipUnchanged || (unpackOnConflict == conflictNewer && block.ModTime == "")) && sameContentOnDisk(block, info) {
+		fmt.Printf("Keeping unchanged file: %s\n", block.Filename)
+		recordEvent(eventKept, block.Filename, "content identical on disk")
 		return true
 	}
-
-	// Also, check if any component of the path (directory name) is in `excludedDirs`.
-	// This helps catch cases like `project/vendor/somefile.txt` if `vendor` is in excludedDirs.
-	// This is a bit redundant with the `fs.SkipDir` in WalkDir, but adds robustness.
-	// We check for `filepath.Separator` on both sides to avoid partial matches (e.g., "mybuild" matching "build").
-	pathComponents := strings.Split(strings.ToLower(path), string(filepath.Separator))
-	for _, comp := range pathComponents {
-		if excludedDirs[comp] {
-			return true
-		}
+	if unpackOnConflict == conflictOverwrite {
+		return false
+	}
+	if block.ModTime == "" {
+		warnf(warnMetadata, block.Filename, "No modtime recorded for '%s' and its content differs; overwriting it (pack with --modtime to use --on-conflict newer).", block.Filename)
+		return false
+	}
+	archived, err := time.Parse(time.RFC3339, block.ModTime)
+	if err != nil {
+		warnf(warnMetadata, block.Filename, "Invalid modtime %q for '%s'; overwriting it.", block.ModTime, block.Filename)
+		return false
+	}
+	if !archived.After(info.ModTime()) {
+		fmt.Printf("Keeping %s: the file on disk is not older than the archived version (--on-conflict newer).\n", block.Filename)
+		recordEvent(eventKept, block.Filename, "not older than the archived version (--on-conflict newer)")
+		return true
 	}
-
 	return false
 }
 
-// isBinaryFileBySignature checks if a file is a binary based on its magic number (file signature).
-// It reads only a small prefix of the file for efficiency,
-// and acts as a fallback for files that don't have typical binary extensions
-// but are, in fact, binary (e.g., executables without extensions, or compressed archives
-// used as "dot files" or temp files).
-func isBinaryFileBySignature(filePath string) (bool, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		// If we can't open it (e.g., permissions), return an error.
-		// The caller decides whether to skip or log a warning.
-		return false, fmt.Errorf("cannot open file to check signature %s: %w", filePath, err)
+// sameContentOnDisk reports whether the existing file at block.Filename (described by info)
+// already holds what restoring block would write: its content, with the BOM unless
+// --strip-bom, or for a symlink block its target.
+func sameContentOnDisk(block *FileBlock, info fs.FileInfo) bool {
+	if block.Symlink != "" {
+		target, err := os.Readlink(block.Filename)
+		return err == nil && target == block.Symlink
 	}
-	defer file.Close()
+	if !info.Mode().IsRegular() {
+		return false
+	}
+	want := block.Content
+	if block.HasBOM && !unpackStripBOM {
+		want = append(append([]byte{}, utf8BOM...), want...)
+	}
+	if info.Size() != int64(len(want)) {
+		return false
+	}
+	existing, err := os.ReadFile(block.Filename)
+	return err == nil && bytes.Equal(existing, want)
+}
 
-	// Read enough bytes to cover most common magic numbers and initial header structures (e.g., PE offset)
-	const readBufferSize = 256 // A larger buffer is safer for complex headers like PE
-	buffer := make([]byte, readBufferSize)
-	n, readErr := io.ReadAtLeast(file, buffer, 4) // Read at least 4 bytes for most simple magic numbers
+// pathRedactor consistently replaces path components with generic names for --redact-paths.
+// Directories become dirN and files become fileN plus their original extension; the same
+// original path always maps to the same redacted path.
+type pathRedactor struct {
+	redacted map[string]string // original slash path -> redacted slash path
+	dirs     int
+	files    int
+}
 
-	if readErr != nil && readErr != io.EOF {
-		// If there's a real read error (not just EOF because file is too short), report it.
-		return false, fmt.Errorf("failed to read file header for %s: %w", filePath, readErr)
+func newPathRedactor() *pathRedactor {
+	return &pathRedactor{redacted: make(map[string]string)}
+}
+
+// redact returns the redacted form of a relative slash path.
+func (r *pathRedactor) redact(path string, isDir bool) string {
+	path = filepath.ToSlash(filepath.Clean(path))
+	if path == "." || path == "" {
+		return path
 	}
-	if n < 4 {
-		// File is too small to have common magic numbers, assume it's text (or empty)
-		return false, nil
+	if name, ok := r.redacted[path]; ok {
+		return name
+	}
+	parent, base := "", path
+	if idx := strings.LastIndex(path, "/"); idx != -1 {
+		parent, base = r.redact(path[:idx], true)+"/", path[idx+1:]
+	}
+	if base == ".." {
+		// Parent references carry no name to hide.
+		r.redacted[path] = parent + base
+		return parent + base
+	}
+	var name string
+	if isDir {
+		r.dirs++
+		name = fmt.Sprintf("dir%d", r.dirs)
+	} else {
+		r.files++
+		name = fmt.Sprintf("file%d%s", r.files, filepath.Ext(base))
 	}
+	r.redacted[path] = parent + name
+	return parent + name
+}
 
-	// --- Check for common executable magic numbers ---
-	// ELF: 0x7F 'E' 'L' 'F'
-	if n >= 4 && bytes.HasPrefix(buffer, []byte{0x7F, 0x45, 0x4C, 0x46}) {
-		return true, nil
+// redactBlock rewrites the block's filename and, for internal symlinks, its target.
+func (r *pathRedactor) redactBlock(block *FileBlock) {
+	original := block.Filename
+	block.Filename = filepath.FromSlash(r.redact(original, false))
+	if block.Symlink == "" {
+		return
 	}
+	target := filepath.Join(filepath.Dir(original), filepath.FromSlash(block.Symlink))
+	info, err := os.Stat(target)
+	redactedTarget := r.redact(target, err == nil && info.IsDir())
+	if rel, err := filepath.Rel(filepath.Dir(block.Filename), filepath.FromSlash(redactedTarget)); err == nil {
+		block.Symlink = filepath.ToSlash(rel)
+	}
+}
 
-	// Mach-O (macOS/iOS executables and libraries)
-	// 32-bit big-endian: FEEDFACE
-	// 32-bit little-endian: CEFAEDFE
-	// 64-bit big-endian: FEEDFACF
-	// 64-bit little-endian: CFFAEDFE
-	if n >= 4 && (bytes.HasPrefix(buffer, []byte{0xFE, 0xED, 0xFA, 0xCE}) ||
-		bytes.HasPrefix(buffer, []byte{0xCE, 0xFA, 0xED, 0xFE}) ||
-		bytes.HasPrefix(buffer, []byte{0xFE, 0xED, 0xFA, 0xCF}) ||
-		bytes.HasPrefix(buffer, []byte{0xCF, 0xFA, 0xED, 0xFE})) {
-		return true, nil
+// writeMap writes the redacted-to-original mapping as JSON.
+func (r *pathRedactor) writeMap(path string) error {
+	mapping := make(map[string]string, len(r.redacted))
+	for original, redacted := range r.redacted {
+		mapping[redacted] = original
+	}
+	data, err := json.MarshalIndent(mapping, "", "  ")
+	if err != nil {
+		return err
 	}
+	return os.WriteFile(path, append(data, '\n'), 0600)
+}
 
-	// PE (Windows Executables: EXE, DLL)
-	// Starts with 'MZ' (0x4D 0x5A)
-	// Then, at offset 0x3C, there's a 4-byte little-endian pointer to the PE header.
-	// The PE header itself starts with 'PE\0\0' (0x50 0x45 0x00 0x00).
-	if n >= 2 && bytes.HasPrefix(buffer, []byte{0x4D, 0x5A}) { // Check for 'MZ'
-		if n >= 0x3C+4 { // Ensure buffer is large enough to read the PE header offset
-			// Read the 4-byte little-endian offset
-			peHeaderOffset := uint32(buffer[0x3C]) | uint32(buffer[0x3C+1])<<8 |
-				uint32(buffer[0x3C+2])<<16 | uint32(buffer[0x3C+3])<<24
+// loadRedactionMap reads a mapping written by 'pack --redact-map'.
+func loadRedactionMap(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read redaction map '%s': %w", path, err)
+	}
+	mapping := make(map[string]string)
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("invalid redaction map '%s': %w", path, err)
+	}
+	return mapping, nil
+}
 
-			// Check if the PE header itself is within our buffer
-			if int(peHeaderOffset)+4 <= n {
-				if bytes.HasPrefix(buffer[peHeaderOffset:], []byte{0x50, 0x45, 0x00, 0x00}) {
-					return true, nil // Confirmed PE executable
-				}
+// unredactBlock restores the original filename and symlink target of a redacted block.
+func unredactBlock(block *FileBlock, mapping map[string]string) {
+	redacted := filepath.ToSlash(filepath.Clean(block.Filename))
+	original, ok := mapping[redacted]
+	if !ok {
+		warnf(warnPath, block.Filename, "No original path recorded for redacted file %s; restoring it under the redacted name.", block.Filename)
+		return
+	}
+	if block.Symlink != "" {
+		target := filepath.ToSlash(filepath.Join(filepath.Dir(redacted), block.Symlink))
+		if originalTarget, ok := mapping[target]; ok {
+			if rel, err := filepath.Rel(filepath.Dir(original), originalTarget); err == nil {
+				block.Symlink = filepath.ToSlash(rel)
 			}
 		}
 	}
+	block.Filename = filepath.FromSlash(original)
+}
 
-	// --- Check for common archive/compressed file magic numbers ---
-	// ZIP archive (including JAR, WAR, DOCX, XLSX, PPTX, etc. as they are ZIPs)
-	if n >= 4 && (bytes.HasPrefix(buffer, []byte{0x50, 0x4B, 0x03, 0x04}) || // Local file header
-		bytes.HasPrefix(buffer, []byte{0x50, 0x4B, 0x05, 0x06}) || // Empty archive (central directory end)
-		bytes.HasPrefix(buffer, []byte{0x50, 0x4B, 0x07, 0x08})) { // Spanned archive
-		return true, nil
+// convertLineEndings rewrites every line ending of content as LF or CRLF for --line-ending.
+// A lone '\r' is not a line ending and stays. Content with NUL bytes is treated as binary and
+// returned unchanged, as is everything in the preserve mode.
+func convertLineEndings(content []byte, mode string) []byte {
+	if mode == lineEndingPreserve || bytes.IndexByte(content, 0) >= 0 {
+		return content
 	}
+	lf := bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	if mode == lineEndingCRLF {
+		return bytes.ReplaceAll(lf, []byte("\n"), []byte("\r\n"))
+	}
+	return lf
+}
 
-	// Gzip compressed file
-	if n >= 2 && bytes.HasPrefix(buffer, []byte{0x1F, 0x8B}) {
-		return true, nil
+// writeTarStream converts the blocks of an archive into a tar stream on w, for 'unpack
+// --to-tar'. Blocks are selected and transformed as in a restore, so entries get the name,
+// content, symlink target, modification time and executable bit a restore would produce, and
+// parent directories get --dir-mode. Options about files already on disk are rejected in main.
+func writeTarStream(w io.Writer, paktxtBytes []byte, excludePatterns, filterPatterns []string) error {
+	blocks, err := parseRestoreBlocks(paktxtBytes)
+	if err != nil {
+		return err
 	}
 
-	// 7-Zip archive
-	if n >= 6 && bytes.HasPrefix(buffer, []byte{0x37, 0x7A, 0xBC, 0xAF, 0x27, 0x1C}) {
-		return true, nil
-	}
+	now := time.Now().Truncate(time.Second) // Whole seconds, so that 'tar -x' never sees them in the future
+	tw := tar.NewWriter(w)
+	dirs := make(map[string]bool)          // Directory entries already written
+	loweredFrom := make(map[string]string) // --ignore-case-filenames: lower-case name -> archived name
+	for _, block := range blocks {
+		if !selectRestoreBlock(block, excludePatterns, filterPatterns) {
+			continue
+		}
+		if err := loadStoreObject(block); err != nil {
+			return err
+		}
+		if _, err := transformRestoreBlock(block, loweredFrom, false); err != nil {
+			return err
+		}
+		name := filepath.ToSlash(block.Filename)
+		modTime := now
+		if block.ModTime != "" {
+			if parsed, err := time.Parse(time.RFC3339, block.ModTime); err == nil {
+				modTime = parsed
+			} else {
+				warnf(warnMetadata, block.Filename, "Ignoring invalid modtime %q for '%s'.", block.ModTime, block.Filename)
+			}
+		}
+
+		// Parents first, so that 'tar -x' creates them with --dir-mode.
+		var parents []string
+		for dir := path.Dir(name); dir != "." && dir != "/" && !dirs[dir]; dir = path.Dir(dir) {
+			parents = append(parents, dir)
+		}
+		for i := len(parents) - 1; i >= 0; i-- {
+			dirs[parents[i]] = true
+			header := &tar.Header{Typeflag: tar.TypeDir, Name: parents[i] + "/", Mode: int64(unpackDirMode &^ unpackUmask), ModTime: now}
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+		}
+
+		if block.Symlink != "" {
+			header := &tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: block.Symlink, Mode: 0777, ModTime: modTime}
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			fmt.Printf("Added symlink: %s -> %s\n", name, block.Symlink)
+			recordEvent(eventRestored, name, "tar symlink to %s", block.Symlink)
+			continue
+		}
 
-	// --- Check for common database files ---
-	// SQLite 3.x database file
-	if n >= 16 && bytes.HasPrefix(buffer, []byte{
-		0x53, 0x51, 0x4C, 0x69, 0x74, 0x65, 0x20, 0x66,
-		0x6F, 0x72, 0x6D, 0x61, 0x74, 0x20, 0x33, 0x00}) {
-		return true, nil
+		mode := int64(0644)
+		if block.IsExecutable {
+			mode = 0755
+		}
+		header := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: mode &^ int64(unpackUmask), Size: int64(len(block.Content)), ModTime: modTime}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(block.Content); err != nil {
+			return err
+		}
+		fmt.Printf("Added: %s\n", name)
+		recordEvent(eventRestored, name, "tar entry of %d bytes", len(block.Content))
 	}
+	return tw.Close()
+}
 
-	// --- Check for other common non-text files that might not have extensions or have generic ones ---
-	// PNG (added here as a definitive non-text check, even if extension usually catches it)
-	if n >= 8 && bytes.HasPrefix(buffer, []byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A}) {
-		return true, nil
-	}
-	// JPEG (added here as a definitive non-text check)
-	if n >= 4 && (bytes.HasPrefix(buffer, []byte{0xFF, 0xD8, 0xFF, 0xE0}) || // JFIF
-		bytes.HasPrefix(buffer, []byte{0xFF, 0xD8, 0xFF, 0xE1})) { // EXIF
-		return true, nil
+// extractPackInput unpacks the --from-tar or --from-zip archive at archivePath into a new
+// temporary directory, which pack then scans in place of the filesystem. Paths, executable
+// bits and modification times come from the entry headers; entries that would land outside
+// the directory and special files are skipped with a warning. The caller removes the directory.
+func extractPackInput(archivePath string, isZip bool) (string, error) {
+	dir, err := os.MkdirTemp(os.Getenv(tempDirEnv), "paktxt-input-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create a directory for the input archive: %w", err)
 	}
-	// GIF (added here as a definitive non-text check)
-	if n >= 6 && (bytes.HasPrefix(buffer, []byte{0x47, 0x49, 0x46, 0x38, 0x37, 0x61}) || // GIF87a
-		bytes.HasPrefix(buffer, []byte{0x47, 0x49, 0x46, 0x38, 0x39, 0x61})) { // GIF89a
-		return true, nil
+	if isZip {
+		err = extractZipInput(archivePath, dir)
+	} else {
+		err = extractTarInput(archivePath, dir)
 	}
-	// BMP (added here as a definitive non-text check)
-	if n >= 2 && bytes.HasPrefix(buffer, []byte{0x42, 0x4D}) { // 'BM'
-		return true, nil
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to read '%s': %w", archivePath, err)
 	}
+	return dir, nil
+}
 
-	// PDF (added here as a definitive non-text check, often starts with %PDF)
-	if n >= 4 && bytes.HasPrefix(buffer, []byte{0x25, 0x50, 0x44, 0x46}) { // %PDF
-		return true, nil
+// removePackInput removes the directory extractPackInput created, if any. The process works
+// inside it, so it first moves to the parent, which Windows requires for the removal.
+func removePackInput(dir string) {
+	if dir == "" {
+		return
 	}
-
-	// If none of the above magic numbers match, assume it's not a specific known binary type.
-	return false, nil
+	os.Chdir(filepath.Dir(dir))
+	os.RemoveAll(dir)
 }
 
-// matchesPattern checks if a file path matches any of the provided glob patterns.
-// It returns true if it matches at least one pattern, false otherwise.
-func matchesPattern(filePath string, patterns []string) bool {
-	for _, pattern := range patterns {
-		// Check against base name (e.g., "*.log")
-		matched, err := filepath.Match(pattern, filepath.Base(filePath))
+// extractTarInput extracts a tar archive, gzip-compressed or not, into dir.
+func extractTarInput(archivePath, dir string) error {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	var stream io.Reader = reader
+	if magic, _ := reader.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(reader)
 		if err != nil {
-			fmt.Printf("Warning: Invalid glob pattern '%s': %v\n", pattern, err)
-			continue
+			return err
 		}
-		if matched {
-			return true
+		defer gz.Close()
+		stream = gz
+	}
+	tr := tar.NewReader(stream)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
 		}
-
-		// Check against full path (e.g., "temp/*")
-		matchedFullPath, err := filepath.Match(pattern, filePath)
 		if err != nil {
-			fmt.Printf("Warning: Invalid glob pattern '%s': %v\n", pattern, err)
-			continue
+			return err
 		}
-		if matchedFullPath {
-			return true
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = extractInputEntry(dir, header.Name, fs.ModeDir, header.ModTime, nil)
+		case tar.TypeReg:
+			err = extractInputEntry(dir, header.Name, fs.FileMode(header.Mode)&0111, header.ModTime, tr)
+		case tar.TypeSymlink:
+			err = extractInputEntry(dir, header.Name, fs.ModeSymlink, header.ModTime, strings.NewReader(header.Linkname))
+		case tar.TypeXGlobalHeader:
+			// PAX metadata for the whole archive, not an entry
+		default:
+			warnf(warnSpecialFile, header.Name, "Skipping %s: unsupported tar entry type %q.", header.Name, header.Typeflag)
+		}
+		if err != nil {
+			return err
 		}
 	}
-	return false
 }
 
-func buildPaktxtContent(files []string) (string, error) {
-	var builder strings.Builder
-	builder.WriteString(paktxtHeader)
-
-	for _, file := range files {
-		content, err := os.ReadFile(file)
-		if err != nil {
-			fmt.Printf("Warning: Could not read file %s: %v\n", file, err)
+// extractZipInput extracts a zip archive into dir.
+func extractZipInput(archivePath, dir string) error {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	for _, entry := range zr.File {
+		mode := entry.Mode()
+		var content io.ReadCloser
+		switch {
+		case mode.IsDir():
+			mode = fs.ModeDir
+		case mode.IsRegular():
+			mode &= 0111
+		case mode&fs.ModeSymlink != 0:
+			mode = fs.ModeSymlink
+		default:
+			warnf(warnSpecialFile, entry.Name, "Skipping %s: unsupported zip entry mode %v.", entry.Name, mode)
 			continue
 		}
-
-		contentBytes := content
-		if bytes.HasPrefix(contentBytes, utf8BOM) {
-			contentBytes = contentBytes[len(utf8BOM):]
+		if mode != fs.ModeDir {
+			if content, err = entry.Open(); err != nil {
+				return err
+			}
 		}
-
-		// This check is very important to prevent infinite recursion if a paktxt output is scanned.
-		// It's still here as a safeguard, although getAllFiles also tries to filter it by name/extension.
-		if bytes.HasPrefix(contentBytes, []byte(paktxtHeader)) {
-			fmt.Printf("Skipping file %s as it appears to be a paktxt output.\n", file)
-			continue
+		err = extractInputEntry(dir, entry.Name, mode, entry.Modified, content)
+		if content != nil {
+			content.Close()
 		}
-
-		fileInfo, err := os.Stat(file)
-		isExecutable := false
-		if err == nil {
-			isExecutable = (fileInfo.Mode().Perm()&0111 != 0)
-		} else {
-			fmt.Printf("Warning: Could not get file info for %s: %v. Assuming non-executable.\n", file, err)
+		if err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		hasTrailingNewline := false
-		if len(content) > 0 {
-			lastByte := content[len(content)-1]
-			if lastByte == '\n' {
-				hasTrailingNewline = true // Found a trailing newline
-				if len(content) > 1 && content[len(content)-2] == '\r' {
-					// This is a \r\n ending, still considered a trailing newline
-				}
-			}
+// extractInputEntry creates one entry of an input archive under dir: a directory for
+// fs.ModeDir, a symlink to the target read from content for fs.ModeSymlink, and otherwise a
+// regular file with the given executable bits. Symlinks are only kept while they point
+// inside dir, so packing cannot reach files of the host through them.
+func extractInputEntry(dir, name string, mode fs.FileMode, modTime time.Time, content io.Reader) error {
+	name = strings.TrimPrefix(path.Clean(filepath.ToSlash(name)), "./")
+	if name == "." {
+		return nil
+	}
+	if reason := unsafeRestorePath(name); reason != "" {
+		warnf(warnPath, name, "Skipping %s: %s.", name, reason)
+		return nil
+	}
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	if mode == fs.ModeDir {
+		return os.MkdirAll(target, 0755)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if mode == fs.ModeSymlink {
+		link, err := io.ReadAll(content)
+		if err != nil {
+			return err
 		}
+		resolved := path.Join(path.Dir(name), filepath.ToSlash(string(link)))
+		if reason := unsafeRestorePath(string(link)); reason != "" || strings.HasPrefix(resolved, "../") || resolved == ".." {
+			warnf(warnSymlink, name, "Skipping symlink %s: its target '%s' is outside the input archive.", name, link)
+			return nil
+		}
+		os.Remove(target) // A later entry of the same name replaces the earlier one
+		return os.Symlink(string(link), target)
+	}
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644|mode&0111)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if !modTime.IsZero() {
+		os.Chtimes(target, modTime, modTime)
+	}
+	return nil
+}
 
-		builder.WriteString(startBlockDelimiter)
-		builder.WriteString("\n")
-		builder.WriteString(filenameLabel)
-		builder.WriteString(file)
-		builder.WriteString("\n")
-		builder.WriteString(executableLabel)
-		if isExecutable {
-			builder.WriteString("true")
-		} else {
-			builder.WriteString("false")
+// unpackToMap parses an archive and returns the content of its files keyed by cleaned slash
+// path, without writing to disk, for tests and callers that want the files in memory. modes
+// holds each file's mode: 0755 for executables, 0644 otherwise, and fs.ModeSymlink for
+// symlinks, whose content is the link target. As in a restore, a name archived twice keeps its
+// later block, a BOM recorded in the metadata is put back, store objects are read from --store,
+// and names that would restore outside the working directory are skipped with a warning.
+func unpackToMap(data []byte) (map[string][]byte, map[string]fs.FileMode, error) {
+	blocks, err := parseBlocks(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	files := make(map[string][]byte, len(blocks))
+	modes := make(map[string]fs.FileMode, len(blocks))
+	for _, block := range blocks {
+		if reason := unsafeRestorePath(block.Filename); reason != "" {
+			warnf(warnPath, block.Filename, "Skipping %s: %s.", block.Filename, reason)
+			continue
 		}
-		builder.WriteString("\n")
-		builder.WriteString(trailingNewlineLabel)
-		if hasTrailingNewline {
-			builder.WriteString("true")
-		} else {
-			builder.WriteString("false")
+		if err := loadStoreObject(block); err != nil {
+			return nil, nil, err
 		}
-		builder.WriteString("\n")
-		builder.WriteString(contentLabel)
-		// Ensure exactly one newline separates the content and the end delimiter.
-		// If the original content didn't end with a newline, add one here.
-		builder.Write(content)
-		if !hasTrailingNewline {
-			builder.WriteString("\n")
+		content, mode := block.Content, fs.FileMode(0644)
+		switch {
+		case block.Symlink != "":
+			content, mode = []byte(block.Symlink), fs.ModeSymlink|0777
+		case block.IsExecutable:
+			mode = 0755
 		}
-		builder.WriteString(endBlockDelimiter)
-		builder.WriteString("\n") // Add an extra newline after the end delimiter for block separation
+		if block.HasBOM && block.Symlink == "" {
+			content = append(append([]byte{}, utf8BOM...), content...)
+		}
+		name := path.Clean(filepath.ToSlash(block.Filename))
+		files[name], modes[name] = content, mode
 	}
-	return builder.String(), nil
+	return files, modes, nil
 }
 
-// parseAndRestore parses the paktxt content and recreates files and directories.
-func parseAndRestore(paktxtContent string, excludePatterns, filterPatterns, includePatterns []string) error {
-	paktxtBytes := []byte(paktxtContent)
-	cursor := 0 // Current position in paktxtBytes
+// parseRestoreBlocks parses an archive for a restore or --to-tar, puts back the paths of
+// --redact-map, checks --require and applies --reverse-restore.
+func parseRestoreBlocks(paktxtBytes []byte) ([]*FileBlock, error) {
+	parseStart := profileStart()
+	blocks, err := parseBlocks(paktxtBytes)
+	if err != nil {
+		return nil, err
+	}
+	profileAdd("parse", parseStart)
+	if unpackRedactMap != nil {
+		for _, block := range blocks {
+			unredactBlock(block, unpackRedactMap)
+		}
+	}
+	if err := checkRequiredFiles(blocks, unpackRequire); err != nil {
+		return nil, err
+	}
+	if unpackReverse {
+		for i, j := 0, len(blocks)-1; i < j; i, j = i+1, j-1 {
+			blocks[i], blocks[j] = blocks[j], blocks[i]
+		}
+	}
+	return blocks, nil
+}
 
-	// Simple header skip: Find the first occurrence of the start delimiter.
-	headerEndIndex := bytes.Index(paktxtBytes, []byte(startBlockDelimiter))
-	if headerEndIndex == -1 {
-		return errors.New("no file blocks found in paktxt content (missing start delimiter)")
+// selectRestoreBlock reports whether a block is restored or added to --to-tar: it must be
+// under --path-prefix, match --filter if given, not match --exclude, and have a safe path.
+func selectRestoreBlock(block *FileBlock, excludePatterns, filterPatterns []string) bool {
+	if !underPathPrefix(block.Filename, unpackPathPrefix) {
+		fmt.Printf("Skipping restoration of file outside --path-prefix: %s\n", block.Filename)
+		recordEvent(eventSkipped, block.Filename, "outside --path-prefix")
+		return false
 	}
-	cursor = headerEndIndex // Start parsing from the first delimiter
+	if len(filterPatterns) > 0 && !matchesPattern(block.Filename, filterPatterns) {
+		fmt.Printf("Skipping restoration of filtered file: %s\n", block.Filename)
+		recordEvent(eventSkipped, block.Filename, "does not match --filter")
+		return false
+	}
+	if matchesPattern(block.Filename, excludePatterns) {
+		fmt.Printf("Skipping restoration of excluded file: %s (due to --exclude)\n", block.Filename)
+		recordEvent(eventSkipped, block.Filename, "matches --exclude")
+		return false
+	}
+	if reason := unsafeRestorePath(block.Filename); reason != "" {
+		warnf(warnPath, block.Filename, "Skipping restoration of %s: %s.", block.Filename, reason)
+		return false
+	}
+	return true
+}
 
-	for cursor < len(paktxtBytes) {
-		startBlockIdx := bytes.Index(paktxtBytes[cursor:], []byte(startBlockDelimiter))
-		if startBlockIdx == -1 {
-			break // No more start delimiters found, we are done.
+// transformRestoreBlock turns an archived block into what a restore or --to-tar writes:
+// --ignore-case-filenames renames it, --content-filter, --replace, --line-ending and the
+// recorded BOM change its content, and --auto-exec and --executable-glob its executable bit.
+// The content of a streamed store object is left to restoreStoreObject. loweredFrom maps each
+// lower-cased name to the first archived name that became it. It reports whether the block
+// was renamed.
+func transformRestoreBlock(block *FileBlock, loweredFrom map[string]string, streamed bool) (bool, error) {
+	renamed := false
+	if unpackLowerNames && !filepath.IsAbs(block.Filename) {
+		original, lower := block.Filename, strings.ToLower(block.Filename)
+		if first, ok := loweredFrom[lower]; ok && first != original {
+			warnf(warnPath, original, "'%s' and '%s' both become '%s' with --ignore-case-filenames; the later one is restored according to --on-conflict.", first, original, lower)
+		} else {
+			loweredFrom[lower] = original
 		}
-
-		cursor += startBlockIdx + len(startBlockDelimiter)
-		// Skip the newline(s) after the start delimiter
-		if cursor < len(paktxtBytes) && paktxtBytes[cursor] == '\n' {
-			cursor++
+		if lower != original {
+			fmt.Printf("Renamed: %s -> %s (--ignore-case-filenames)\n", original, lower)
+			recordEvent(eventRenamed, original, "to %s (--ignore-case-filenames)", lower)
+			block.Filename = lower
+			renamed = true
 		}
-		if cursor < len(paktxtBytes) && paktxtBytes[cursor] == '\r' { // Handle CRLF
-			cursor++
-			if cursor < len(paktxtBytes) && paktxtBytes[cursor] == '\n' {
-				cursor++
-			}
+		if block.Symlink != "" && !filepath.IsAbs(block.Symlink) {
+			block.Symlink = strings.ToLower(block.Symlink)
 		}
+	}
+	if block.Symlink != "" {
+		return renamed, nil
+	}
 
-		currentFileBlock := &FileBlock{}
-		foundContentLabel := false
-
-		for {
-			lineEnd := bytes.IndexByte(paktxtBytes[cursor:], '\n')
-			if lineEnd == -1 {
-				return errors.New("malformed paktxt content: unexpected end of data during metadata parsing")
-			}
-
-			lineBytes := bytes.TrimSuffix(paktxtBytes[cursor:cursor+lineEnd], []byte("\r"))
-			line := string(lineBytes)
-
-			lineAdvance := lineEnd + 1
-			if cursor+lineAdvance > len(paktxtBytes) {
-				return errors.New("malformed paktxt content: reading past end of buffer")
+	if !streamed {
+		if unpackContentFilter != "" {
+			filtered, err := runContentFilter(unpackContentFilter, block)
+			if err != nil {
+				return renamed, err
 			}
-
-			if strings.HasPrefix(line, filenameLabel) {
-				currentFileBlock.Filename = strings.TrimPrefix(line, filenameLabel)
-			} else if strings.HasPrefix(line, executableLabel) {
-				execStr := strings.TrimPrefix(line, executableLabel)
-				currentFileBlock.IsExecutable = (execStr == "true")
-			} else if strings.HasPrefix(line, trailingNewlineLabel) {
-				tnlStr := strings.TrimPrefix(line, trailingNewlineLabel)
-				currentFileBlock.HasTrailingNewline = (tnlStr == "true")
-			} else if strings.HasPrefix(line, contentLabel[:len(contentLabel)-1]) {
-				foundContentLabel = true
-				lineAdvance = len(contentLabel)
-			} else if strings.TrimSpace(line) == "" {
-				// Allow empty lines in metadata
-			} else {
-				fmt.Printf("Warning: Unexpected line in metadata block for file %q: %q\n", currentFileBlock.Filename, line)
+			block.Content = filtered
+		}
+		if len(unpackReplacements) > 0 {
+			var count int
+			block.Content, count = applyReplacements(block.Content, unpackReplacements)
+			if count > 0 {
+				fmt.Printf("Replaced %d occurrence(s) in %s\n", count, block.Filename)
 			}
+		}
+		block.Content = convertLineEndings(block.Content, unpackLineEnding)
+		if block.HasBOM && !unpackStripBOM {
+			block.Content = append(append([]byte{}, utf8BOM...), block.Content...)
+		}
+	}
+	if !block.IsExecutable && unpackAutoExec && bytes.HasPrefix(bytes.TrimPrefix(block.Content, utf8BOM), []byte("#!")) {
+		fmt.Printf("Marking %s executable (shebang detected, --auto-exec).\n", block.Filename)
+		block.IsExecutable = true
+	}
+	if !block.IsExecutable && matchesPattern(block.Filename, unpackExecGlobs) {
+		fmt.Printf("Marking %s executable (matches --executable-glob).\n", block.Filename)
+		block.IsExecutable = true
+	}
+	return renamed, nil
+}
 
-			cursor += lineAdvance
+// writeRestoredBlock writes one block whose directory already exists and that
+// transformRestoreBlock has prepared: the symlink or the content, then the executable bit and
+// modification time. It reports whether the
+// file counts as restored, which is not the case for --touch-only files left unchanged.
+func writeRestoredBlock(block *FileBlock) (bool, error) {
+	if block.Symlink != "" {
+		if err := restoreSymlink(block); err != nil {
+			return false, err
+		}
+		fmt.Printf("Restored symlink: %s -> %s\n", block.Filename, block.Symlink)
+		recordEvent(eventRestored, block.Filename, "symlink to %s", block.Symlink)
+		return true, nil
+	}
 
-			if foundContentLabel {
-				break
+	var keptMode fs.FileMode // Previous mode of a read-only file overwritten with --force
+	unchanged := false
+	if unpackTouchOnly {
+		// Only a regular file counts: metadata is never synced through a symlink at the path.
+		if info, err := os.Lstat(block.Filename); err == nil && info.Mode().IsRegular() && info.Size() == int64(len(block.Content)) {
+			existing, err := os.ReadFile(block.Filename)
+			unchanged = err == nil && bytes.Equal(existing, block.Content)
+		}
+	}
+	if unchanged {
+		fmt.Printf("Unchanged: %s (content identical, syncing metadata only)\n", block.Filename)
+		recordEvent(eventUnchanged, block.Filename, "content identical, metadata synced (--touch-only)")
+	} else {
+		action := eventRestored
+		if reportFile != "" && pathExists(block.Filename) {
+			action = eventOverwritten
+		}
+		// A symlink at the path is replaced, not written through, as it may point anywhere.
+		if info, err := os.Lstat(block.Filename); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			if err := os.Remove(block.Filename); err != nil {
+				return false, fmt.Errorf("failed to replace symlink '%s' with a file: %w", block.Filename, err)
 			}
 		}
-
-		endBlockIdx := bytes.Index(paktxtBytes[cursor:], []byte(endBlockDelimiter))
-		if endBlockIdx == -1 {
-			return errors.New("malformed paktxt content: missing end delimiter for file block")
+		size := len(block.Content)
+		var err error
+		if streamsStoreObject(block) {
+			size, err = restoreStoreObject(block)
+		} else {
+			err = os.WriteFile(block.Filename, block.Content, 0644&^unpackUmask)
 		}
-
-		currentFileBlock.Content = paktxtBytes[cursor : cursor+endBlockIdx]
-		cursor += endBlockIdx + len(endBlockDelimiter)
-
-		if cursor < len(paktxtBytes) && paktxtBytes[cursor] == '\n' {
-			cursor++
-			if cursor < len(paktxtBytes) && paktxtBytes[cursor] == '\r' {
-				cursor++
-				if cursor < len(paktxtBytes) && paktxtBytes[cursor] == '\n' {
-					cursor++
-				}
+		if err != nil && unpackForce && errors.Is(err, fs.ErrPermission) {
+			if keptMode, err = overwriteReadOnlyFile(block.Filename, block.Content); err == nil {
+				fmt.Printf("Overwrote read-only file %s (--force); kept its mode %04o.\n", block.Filename, keptMode)
 			}
 		}
-		if cursor < len(paktxtBytes) && paktxtBytes[cursor] == '\n' {
-			cursor++
+		if err != nil {
+			return false, fmt.Errorf("failed to write file '%s': %w", block.Filename, err)
 		}
+		fmt.Printf("Restored: %s\n", block.Filename)
+		recordEvent(action, block.Filename, "%d bytes", size)
+	}
 
-		if currentFileBlock == nil || currentFileBlock.Filename == "" {
-			fmt.Println("Warning: Skipping malformed file block (no filename found).")
-			continue
+	if block.IsExecutable {
+		// Chmod ignores the umask, so it is applied here: the restore never grants more than
+		// the process umask (and --umask) allows, whatever the archive says.
+		mode := 0755 &^ unpackUmask
+		if keptMode != 0 {
+			mode = (keptMode | 0111) &^ unpackUmask // Stay read-only
 		}
-
-		// Apply filter patterns during restore: If filter patterns are present, the file must match.
-		if len(filterPatterns) > 0 {
-			if !matchesPattern(currentFileBlock.Filename, filterPatterns) {
-				fmt.Printf("Skipping restoration of filtered file: %s\n", currentFileBlock.Filename)
-				continue
-			}
+		if err := os.Chmod(block.Filename, mode); err != nil {
+			warnf(warnPermission, block.Filename, "Failed to set executable permission for '%s': %v", block.Filename, err)
 		}
-
-		// (REMOVED: --include logic was here)
-
-		// Apply user-defined exclude patterns during restore.
-		if matchesPattern(currentFileBlock.Filename, excludePatterns) {
-			fmt.Printf("Skipping restoration of excluded file: %s (due to --exclude)\n", currentFileBlock.Filename)
-			continue
+	}
+	if block.ModTime != "" {
+		if modTime, err := time.Parse(time.RFC3339, block.ModTime); err != nil {
+			warnf(warnMetadata, block.Filename, "Ignoring invalid modtime %q for '%s'.", block.ModTime, block.Filename)
+		} else if err := os.Chtimes(block.Filename, modTime, modTime); err != nil {
+			warnf(warnPermission, block.Filename, "Failed to set modification time for '%s': %v", block.Filename, err)
 		}
+	}
+	return !unchanged, nil
+}
 
-		dir := filepath.Dir(currentFileBlock.Filename)
-		if dir != "" && dir != "." {
-			if err := os.MkdirAll(dir, 0755); err != nil {
-				return fmt.Errorf("failed to create directory '%s' for file '%s': %w", dir, currentFileBlock.Filename, err)
+// restorePool writes blocks on a fixed number of goroutines for 'unpack --jobs'. Directories are
+// created by the caller before a block is submitted, so workers never race on MkdirAll. A name
+// is never written by two workers at once: waitFor drains the pool when a name comes back.
+// Output lines of different files may interleave, and warnf is safe for concurrent use.
+type restorePool struct {
+	blocks   chan *FileBlock
+	wg       sync.WaitGroup // Submitted blocks not yet written
+	workers  sync.WaitGroup
+	mu       sync.Mutex
+	err      error           // First write error; blocks submitted after it are not written
+	restored []string        // Names written, in completion order
+	pending  map[string]bool // Case-folded names submitted since the last drain
+	closed   bool
+}
+
+func newRestorePool(jobs int) *restorePool {
+	p := &restorePool{blocks: make(chan *FileBlock, jobs), pending: make(map[string]bool)}
+	for range jobs {
+		p.workers.Add(1)
+		go func() {
+			defer p.workers.Done()
+			for block := range p.blocks {
+				p.write(block)
+				p.wg.Done()
 			}
-		}
+		}()
+	}
+	return p
+}
 
-		// If the original file did NOT have a trailing newline, remove the one added during packing.
-		contentLen := len(currentFileBlock.Content)
-		if !currentFileBlock.HasTrailingNewline && contentLen > 0 {
-			// Check for and remove trailing CRLF (\r\n) first
-			if contentLen >= 2 && currentFileBlock.Content[contentLen-2] == '\r' && currentFileBlock.Content[contentLen-1] == '\n' {
-				currentFileBlock.Content = currentFileBlock.Content[:contentLen-2]
-			} else if currentFileBlock.Content[contentLen-1] == '\n' {
-				// If not CRLF, check for and remove single LF (\n)
-				currentFileBlock.Content = currentFileBlock.Content[:len(currentFileBlock.Content)-1]
+func (p *restorePool) write(block *FileBlock) {
+	p.mu.Lock()
+	failed := p.err != nil
+	p.mu.Unlock()
+	if failed {
+		return
+	}
+	written, err := writeRestoredBlock(block)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil && p.err == nil {
+		p.err = err
+	}
+	if written {
+		p.restored = append(p.restored, block.Filename)
+	}
+}
 
-			}
+// submit hands block to a worker, or returns the first error a worker has hit so far.
+func (p *restorePool) submit(block *FileBlock) error {
+	p.mu.Lock()
+	err := p.err
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	p.pending[strings.ToLower(filepath.Clean(block.Filename))] = true
+	p.wg.Add(1)
+	p.blocks <- block
+	return nil
+}
+
+// waitFor waits for all submitted blocks to be written if name or one of its parent
+// directories is among them, as a symlink block may be a parent of later blocks.
+func (p *restorePool) waitFor(name string) {
+	for folded := strings.ToLower(filepath.Clean(name)); folded != "." && folded != string(filepath.Separator); folded = filepath.Dir(folded) {
+		if p.pending[folded] {
+			p.wg.Wait()
+			clear(p.pending)
+			return
 		}
-		if err := os.WriteFile(currentFileBlock.Filename, currentFileBlock.Content, os.FileMode(0644)); err != nil {
-			return fmt.Errorf("failed to write file '%s': %w", currentFileBlock.Filename, err)
+		if filepath.Dir(folded) == folded {
+			return
 		}
-		fmt.Printf("Restored: %s\n", currentFileBlock.Filename)
+	}
+}
 
-		if currentFileBlock.IsExecutable {
-			if err := os.Chmod(currentFileBlock.Filename, os.FileMode(0755)); err != nil {
-				fmt.Printf("Warning: Failed to set executable permission for '%s': %v\n", currentFileBlock.Filename, err)
-			}
-		}
+// taken reports whether name exists on disk or is among the blocks submitted but possibly
+// not yet written, for choosing a --relocate-on-collision name without waiting.
+func (p *restorePool) taken(name string) bool {
+	return p.pending[strings.ToLower(filepath.Clean(name))] || pathExists(name)
+}
+
+// close waits for the workers to finish and returns the names they wrote and the first write
+// error. Later calls do nothing.
+func (p *restorePool) close() ([]string, error) {
+	if p.closed {
+		return nil, nil
 	}
+	p.closed = true
+	close(p.blocks)
+	p.workers.Wait()
+	return p.restored, p.err
+}
 
+// restoreSymlink recreates a symlink block, replacing any existing file or link at its path.
+func restoreSymlink(block *FileBlock) error {
+	if info, err := os.Lstat(block.Filename); err == nil {
+		if info.IsDir() {
+			return fmt.Errorf("cannot create symlink '%s': a directory exists at that path", block.Filename)
+		}
+		if err := os.Remove(block.Filename); err != nil {
+			return fmt.Errorf("failed to replace existing file '%s' with symlink: %w", block.Filename, err)
+		}
+	}
+	if err := os.Symlink(filepath.FromSlash(block.Symlink), block.Filename); err != nil {
+		return fmt.Errorf("failed to create symlink '%s': %w", block.Filename, err)
+	}
 	return nil
 }
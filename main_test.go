@@ -0,0 +1,899 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// TestMain runs the real command line instead of the tests when PAKTXT_TEST_MAIN is set, so
+// that runPaktxt gets fresh option variables for every command, like the shell scripts do.
+func TestMain(m *testing.M) {
+	if os.Getenv("PAKTXT_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runPaktxt runs the test binary as paktxt with args and returns its stdout. A non-zero exit
+// fails the test with the command's stderr.
+func runPaktxt(t testing.TB, args ...string) []byte {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "PAKTXT_TEST_MAIN=1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("paktxt %s: %v\n%s%s", strings.Join(args, " "), err, stdout.String(), stderr.String())
+	}
+	return stdout.Bytes()
+}
+
+// chdir changes into dir for the rest of the test. The restore works relative to the current
+// directory, like the command line does after --working-dir.
+func chdir(t testing.TB, dir string) {
+	t.Helper()
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(previous) })
+}
+
+// silenceStdout discards the progress messages printed while the test runs.
+func silenceStdout(t testing.TB) {
+	t.Helper()
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := os.Stdout
+	os.Stdout = devNull
+	t.Cleanup(func() {
+		os.Stdout = previous
+		devNull.Close()
+	})
+}
+
+// setPackFormat selects the format buildPaktxtContent and encodeBlock write: "v1",
+// "v1-compact" or "v2". Callers restore packFormat and packCompactMetadata.
+func setPackFormat(format string) {
+	packFormat, packCompactMetadata = formatV1, false
+	switch format {
+	case "v1-compact":
+		packCompactMetadata = true
+	case formatV2:
+		packFormat = formatV2
+	}
+}
+
+// fuzzSeeds returns valid archives of a small tree in every format, written by
+// buildPaktxtContent, and hostile archives: names and symlink chains that lead outside the
+// restore directory, and size labels that overflow when added to an offset. The working
+// directory, stdout and pack format are restored before it returns, rather than by f.Cleanup,
+// which would leave them changed in the fuzzing workers.
+func fuzzSeeds(f *testing.F) [][]byte {
+	src := f.TempDir()
+	files := map[string]string{
+		"empty.txt":                "",
+		"a-cr.txt":                 "a\r",
+		"crlf.txt":                 "a\r\nb\r\n",
+		"bom.txt":                  "\xef\xbb\xbfbom\n",
+		"nested/run.sh":            "#!/bin/sh\necho hi\n",
+		"nested/dir/delimiter.txt": "x\n" + endBlockDelimiter + "\ny",
+	}
+	var names []string
+	for name, content := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			f.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			f.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	previousDir, err := os.Getwd()
+	if err != nil {
+		f.Fatal(err)
+	}
+	if err := os.Chdir(src); err != nil {
+		f.Fatal(err)
+	}
+	defer os.Chdir(previousDir)
+	previousStdout := os.Stdout
+	os.Stdout = nil // fmt.Printf to a nil *os.File fails silently
+	defer func() { os.Stdout = previousStdout }()
+	previousFormat, previousCompact := packFormat, packCompactMetadata
+	defer func() { packFormat, packCompactMetadata = previousFormat, previousCompact }()
+
+	var seeds [][]byte
+	for _, format := range []string{formatV1, "v1-compact", formatV2} {
+		setPackFormat(format)
+		content, err := buildPaktxtContent(names, true)
+		if err != nil {
+			f.Fatal(err)
+		}
+		seeds = append(seeds, []byte(content))
+
+		hostile := [][]*FileBlock{
+			{{Filename: "../escape.txt", Content: []byte("x\n"), HasTrailingNewline: true}},
+			{{Filename: filepath.Join(f.TempDir(), "absolute.txt"), Content: []byte("x\n"), HasTrailingNewline: true}},
+			{{Filename: "link", Symlink: ".."}, {Filename: "link/pwned.txt", Content: []byte("x\n"), HasTrailingNewline: true}},
+			{{Filename: "link", Symlink: "real/../.."}, {Filename: "link/pwned.txt", Content: []byte("x\n"), HasTrailingNewline: true}},
+			{{Filename: "link", Symlink: "."}, {Filename: "second", Symlink: "link/.."}, {Filename: "second/pwned.txt", Content: []byte("x\n"), HasTrailingNewline: true}},
+		}
+		for _, blocks := range hostile {
+			var archive strings.Builder
+			if format != formatV2 {
+				archive.WriteString(paktxtHeader)
+			}
+			for _, block := range blocks {
+				block.Size = len(block.Content)
+				encoded, err := encodeBlock(block)
+				if err != nil {
+					f.Fatal(err)
+				}
+				archive.WriteString(encoded)
+			}
+			seeds = append(seeds, []byte(archive.String()))
+		}
+	}
+	for _, meta := range []string{
+		filenameLabel + "big.txt\n" + executableLabel + "false\n" + trailingNewlineLabel + "true\n" + sizeLabel + "9223372036854775800\n",
+		compactMetaLabel + "filename=big.txt;executable=false;trailing_newline=true;size=9223372036854775800\n",
+	} {
+		seeds = append(seeds, []byte(startBlockDelimiter+"\n"+meta+contentLabel+"x\n"+endBlockDelimiter+"\n"))
+	}
+	return seeds
+}
+
+// FuzzParseAndRestore feeds arbitrary archives to parseBlocks and parseAndRestore. Neither may
+// panic, and the restore must not write anything outside the directory it restores into.
+func FuzzParseAndRestore(f *testing.F) {
+	for _, seed := range fuzzSeeds(f) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// The restore root is nested, so that escapes of several levels stay inside dir.
+		dir := t.TempDir()
+		target := filepath.Join(dir, "a", "b", "target")
+		if err := os.MkdirAll(target, 0755); err != nil {
+			t.Fatal(err)
+		}
+		chdir(t, target)
+		silenceStdout(t)
+		currentRun = RunResult{}
+
+		parseBlocks(data)
+		parseAndRestore(data, nil, nil, nil)
+
+		for _, level := range []string{dir, filepath.Join(dir, "a"), filepath.Join(dir, "a", "b")} {
+			entries, err := os.ReadDir(level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Fatalf("the restore wrote outside its directory: %s contains %d entries", level, len(entries))
+			}
+		}
+	})
+}
+
+// fixtureFile is one entry of a round-trip fixture: a file with content and mode, or a symlink.
+type fixtureFile struct {
+	content string
+	mode    os.FileMode
+	link    string
+}
+
+// roundTripFixtures are the trees every format must restore identically: same files, same
+// bytes, same executable bits and same symlinks. Features that record new metadata add a row
+// here; the round trip is the contract.
+var roundTripFixtures = []struct {
+	name        string
+	files       map[string]fixtureFile
+	packFlags   []string
+	unpackFlags []string
+	setup       func(t *testing.T, dir string)
+}{
+	{
+		name: "edge_cases",
+		files: map[string]fixtureFile{
+			"empty.txt":           {content: ""},
+			"newline.txt":         {content: "\n"},
+			"a.txt":               {content: "a"},
+			"a-newline.txt":       {content: "a\n"},
+			"a-two-newlines.txt":  {content: "a\n\n"},
+			"a-cr.txt":            {content: "a\r"},
+			"a-crlf.txt":          {content: "a\r\n"},
+			"crlf-no-newline.txt": {content: "a\r\nb"},
+			"crlf-only.txt":       {content: "\r\n\r\n"},
+			"delimiter.txt":       {content: "x\n" + endBlockDelimiter + "\ny"},
+			"content-label.txt":   {content: "content: x\ncontent:\n"},
+		},
+	},
+	{
+		name: "permissions",
+		files: map[string]fixtureFile{
+			"run.sh":     {content: "#!/bin/sh\necho hi\n", mode: 0755},
+			"tool":       {content: "no shebang\n", mode: 0755},
+			"empty-exec": {content: "", mode: 0755},
+			"plain.txt":  {content: "plain\n", mode: 0644},
+		},
+	},
+	{
+		name: "bom",
+		files: map[string]fixtureFile{
+			"bom.txt":            {content: "\xef\xbb\xbfwith newline\n"},
+			"bom-no-newline.txt": {content: "\xef\xbb\xbfno newline"},
+			"bom-only.txt":       {content: "\xef\xbb\xbf"},
+			"bom-crlf.txt":       {content: "\xef\xbb\xbfa\r\nb\r\n"},
+		},
+	},
+	{
+		name: "bom_preserve",
+		files: map[string]fixtureFile{
+			"bom.txt":      {content: "\xef\xbb\xbfwith newline\n"},
+			"bom-only.txt": {content: "\xef\xbb\xbf"},
+			"no-bom.txt":   {content: "plain\n"},
+		},
+		packFlags:   []string{"--preserve-bom"},
+		unpackFlags: []string{"--preserve-bom"},
+	},
+	{
+		name: "nested",
+		files: map[string]fixtureFile{
+			"a/b/c/deep.txt":               {content: "deep\n"},
+			"a/b/mid.txt":                  {content: "mid"},
+			"with space/dir/file name.txt": {content: "spaced\n"},
+			".hidden/.env":                 {content: "dot\n"},
+			"a/ünïcödé.txt":                {content: "unicode\n"},
+			"a/semi;colon%3B.txt":          {content: "semicolon\n"},
+			"a/b/c/script.py":              {content: "#!/usr/bin/env python3\n", mode: 0755},
+		},
+	},
+	{
+		name:      "nested_archives",
+		files:     map[string]fixtureFile{"inner/a.txt": {content: "inner\n"}},
+		packFlags: []string{"--include-paktxt"},
+		setup: func(t *testing.T, dir string) {
+			inner := filepath.Join(dir, "inner")
+			runPaktxt(t, "pack", "-w", inner, "-o", filepath.Join(dir, "v1.paktxt"))
+			runPaktxt(t, "pack", "--format", formatV2, "-w", inner, "-o", filepath.Join(dir, "v2.paktxt"))
+			v1, err := os.ReadFile(filepath.Join(dir, "v1.paktxt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "archive-without-extension.txt"), v1, 0644); err != nil {
+				t.Fatal(err)
+			}
+		},
+	},
+	{
+		// Links to links are stored as links to the final target, so none are used here.
+		name: "symlinks",
+		files: map[string]fixtureFile{
+			"dir/target.txt": {content: "target\n"},
+			"top.txt":        {content: "top\n"},
+			"link.txt":       {link: "dir/target.txt"},
+			"dir/up.txt":     {link: "../top.txt"},
+		},
+		packFlags: []string{"--resolve-relative-symlinks"},
+	},
+}
+
+// writeFixture creates files under dir.
+func writeFixture(t *testing.T, dir string, files map[string]fixtureFile) {
+	t.Helper()
+	for name, file := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if file.link != "" {
+			if err := os.Symlink(file.link, path); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		mode := file.mode
+		if mode == 0 {
+			mode = 0644
+		}
+		if err := os.WriteFile(path, []byte(file.content), mode); err != nil {
+			t.Fatal(err)
+		}
+		// WriteFile applies the umask; the fixture needs the exact bits.
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// treeListing describes every entry under dir by its type, executable bit or link target, and
+// content hash, keyed by slash-separated path.
+func treeListing(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	listing := map[string]string{}
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			listing[filepath.ToSlash(rel)] = "link -> " + target
+		case info.IsDir():
+			listing[filepath.ToSlash(rel)] = "dir"
+		default:
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			kind := "file"
+			if info.Mode()&0111 != 0 {
+				kind = "exec"
+			}
+			listing[filepath.ToSlash(rel)] = fmt.Sprintf("%s %x", kind, sha256.Sum256(content))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listing
+}
+
+// compareTrees fails the test for every entry that differs between the two trees.
+func compareTrees(t *testing.T, want, got string) {
+	t.Helper()
+	wantListing, gotListing := treeListing(t, want), treeListing(t, got)
+	for name, entry := range wantListing {
+		if gotListing[name] != entry {
+			t.Errorf("%s: want %q, got %q", name, entry, gotListing[name])
+		}
+	}
+	for name, entry := range gotListing {
+		if _, ok := wantListing[name]; !ok {
+			t.Errorf("%s: unexpected %q", name, entry)
+		}
+	}
+}
+
+// extractTar writes the regular files, directories and symlinks of a tar stream under dir.
+func extractTar(t *testing.T, stream []byte, dir string) {
+	t.Helper()
+	reader := tar.NewReader(bytes.NewReader(stream))
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, filepath.FromSlash(header.Name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0755)
+		case tar.TypeSymlink:
+			err = os.Symlink(header.Linkname, path)
+		case tar.TypeReg:
+			var content []byte
+			if content, err = io.ReadAll(reader); err == nil {
+				if err = os.WriteFile(path, content, 0644); err == nil {
+					err = os.Chmod(path, os.FileMode(header.Mode).Perm())
+				}
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestRoundTrip packs every fixture in every format and restores it plainly, with concurrent
+// writes and as a tar stream. Each restored tree must be identical to its source.
+func TestRoundTrip(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fixtures use executable bits and symlinks")
+	}
+	formats := map[string][]string{
+		formatV1:     {"--format", formatV1},
+		"v1-compact": {"--compact-metadata"},
+		formatV2:     {"--format", formatV2},
+	}
+	restores := map[string]func(t *testing.T, archive, dst string, flags []string){
+		"unpack": func(t *testing.T, archive, dst string, flags []string) {
+			runPaktxt(t, append([]string{"unpack", "--strict-parse", "-w", dst, "-i", archive}, flags...)...)
+		},
+		"jobs": func(t *testing.T, archive, dst string, flags []string) {
+			runPaktxt(t, append([]string{"unpack", "--strict-parse", "--jobs", "4", "-w", dst, "-i", archive}, flags...)...)
+		},
+		"to-tar": func(t *testing.T, archive, dst string, flags []string) {
+			extractTar(t, runPaktxt(t, append([]string{"unpack", "--to-tar", "-i", archive}, flags...)...), dst)
+		},
+	}
+	for _, fixture := range roundTripFixtures {
+		for format, formatFlags := range formats {
+			for restore, run := range restores {
+				t.Run(fixture.name+"/"+format+"/"+restore, func(t *testing.T) {
+					t.Parallel()
+					src, dst := t.TempDir(), t.TempDir()
+					writeFixture(t, src, fixture.files)
+					if fixture.setup != nil {
+						fixture.setup(t, src)
+					}
+					archive := filepath.Join(t.TempDir(), fixture.name+".paktxt")
+					args := append([]string{"pack"}, formatFlags...)
+					args = append(args, fixture.packFlags...)
+					runPaktxt(t, append(args, "-w", src, "-o", archive)...)
+					run(t, archive, dst, fixture.unpackFlags)
+					compareTrees(t, src, dst)
+				})
+			}
+		}
+	}
+}
+
+// TestUnpackToMap reads a multi-file archive into memory: contents, modes, BOMs and symlinks
+// come back as packed, a name archived twice keeps its later block, and nothing is written.
+func TestUnpackToMap(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fixture uses executable bits and symlinks")
+	}
+	src := t.TempDir()
+	writeFixture(t, src, map[string]fixtureFile{
+		"a.txt":           {content: "a\n"},
+		"empty.txt":       {content: ""},
+		"crlf.txt":        {content: "a\r\nb"},
+		"bom.txt":         {content: "\xef\xbb\xbfbom\n"},
+		"nested/run.sh":   {content: "#!/bin/sh\necho hi\n", mode: 0755},
+		"nested/link.txt": {link: "../a.txt"},
+	})
+	for format, formatFlags := range map[string][]string{
+		formatV1:     {"--format", formatV1},
+		"v1-compact": {"--compact-metadata"},
+		formatV2:     {"--format", formatV2},
+	} {
+		t.Run(format, func(t *testing.T) {
+			archive := filepath.Join(t.TempDir(), "files.paktxt")
+			runPaktxt(t, append(append([]string{"pack", "--resolve-relative-symlinks"}, formatFlags...), "-w", src, "-o", archive)...)
+			data, err := os.ReadFile(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The same name again, with other content, at the end of the archive.
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("later\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			runPaktxt(t, append(append([]string{"pack"}, formatFlags...), "-w", dir, "-o", archive)...)
+			later, err := os.ReadFile(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			empty := t.TempDir()
+			chdir(t, empty)
+			silenceStdout(t)
+
+			files, modes, err := unpackToMap(append(data, later...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]struct {
+				content string
+				mode    fs.FileMode
+			}{
+				"a.txt":           {"later\n", 0644},
+				"empty.txt":       {"", 0644},
+				"crlf.txt":        {"a\r\nb", 0644},
+				"bom.txt":         {"\xef\xbb\xbfbom\n", 0644},
+				"nested/run.sh":   {"#!/bin/sh\necho hi\n", 0755},
+				"nested/link.txt": {"../a.txt", fs.ModeSymlink | 0777},
+			}
+			if len(files) != len(want) || len(modes) != len(want) {
+				t.Errorf("got %d files and %d modes, want %d", len(files), len(modes), len(want))
+			}
+			for name, file := range want {
+				if content, ok := files[name]; !ok || string(content) != file.content {
+					t.Errorf("%s: content %q, want %q", name, content, file.content)
+				}
+				if modes[name] != file.mode {
+					t.Errorf("%s: mode %v, want %v", name, modes[name], file.mode)
+				}
+			}
+			if entries, err := os.ReadDir(empty); err != nil || len(entries) != 0 {
+				t.Errorf("unpackToMap wrote to disk: %d entries, %v", len(entries), err)
+			}
+		})
+	}
+}
+
+// TestParseBlocksBlankLines checks that zero, one or several blank lines between blocks,
+// including whitespace-only ones, all parse to the same blocks, also with --strict-parse.
+func TestParseBlocksBlankLines(t *testing.T) {
+	var encoded []string
+	for _, block := range []*FileBlock{
+		{Filename: "a.txt", HasTrailingNewline: true, Content: []byte("first\n")},
+		{Filename: "dir/b.go", HasTrailingNewline: false, Content: []byte("package b")},
+		{Filename: "c.md", HasTrailingNewline: true, Content: []byte("\n\nblank lines inside\n\n")},
+	} {
+		text, err := encodeBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Drop encodeBlock's own separator so each case controls what follows the end delimiter.
+		encoded = append(encoded, strings.TrimRight(text, "\n")+"\n")
+	}
+	separators := []struct {
+		name      string
+		separator string
+	}{
+		{"zero", ""},
+		{"one", "\n"},
+		{"several", "\n\n\n"},
+		{"whitespace-only", " \t\n\r\n\n"},
+	}
+	var want []*FileBlock
+	for _, strict := range []bool{false, true} {
+		for _, test := range separators {
+			t.Run(fmt.Sprintf("%s/strict=%v", test.name, strict), func(t *testing.T) {
+				defer func(old bool) { strictParse = old }(strictParse)
+				strictParse = strict
+				archive := paktxtHeader + strings.Join(encoded, test.separator) + test.separator
+				blocks, err := parseBlocks([]byte(archive))
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, block := range blocks {
+					block.raw = nil
+				}
+				if want == nil {
+					want = blocks
+				}
+				if len(blocks) != len(encoded) || !reflect.DeepEqual(blocks, want) {
+					t.Errorf("got %d blocks, differing from the zero-blank-line case", len(blocks))
+					for i := range blocks {
+						t.Logf("%d: %+v", i, *blocks[i])
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestSplitByDirProfile checks that pack --split-by-dir prints one profile for all of its
+// archives, and that each walk subtracts only the sniff time it accounted for itself.
+func TestSplitByDirProfile(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]fixtureFile{}
+	for _, dir := range []string{"one", "two", "three"} {
+		for i := range 20 {
+			// No extension, so every file is sniffed during the walk.
+			files[fmt.Sprintf("%s/notes-%d", dir, i)] = fixtureFile{content: "plain text\n"}
+		}
+	}
+	writeFixture(t, src, files)
+
+	t.Run("printed", func(t *testing.T) {
+		out := string(runPaktxt(t, "pack", "--split-by-dir", "--profile", "-w", src, "-o", filepath.Join(t.TempDir(), "{dir}.paktxt")))
+		_, profile, ok := strings.Cut(out, "Profile:\n")
+		if !ok {
+			t.Fatalf("no profile in the output:\n%s", out)
+		}
+		for _, phase := range packProfilePhases {
+			if !strings.Contains(profile, phase+" ") {
+				t.Errorf("no %s line in the profile:\n%s", phase, profile)
+			}
+		}
+	})
+	t.Run("walk", func(t *testing.T) {
+		chdir(t, filepath.Join(src, "one"))
+		silenceStdout(t)
+		defer func(old bool) { profileFlag = old }(profileFlag)
+		profileFlag = true
+		// Sniff time left over from earlier directories of the same run.
+		profileTimes = map[string]time.Duration{"sniff": time.Hour}
+		t.Cleanup(func() { profileTimes = make(map[string]time.Duration) })
+		if err := concatenateAndOutput(false, filepath.Join(t.TempDir(), "one.paktxt"), nil, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		if walk := profileTimes["walk"]; walk < 0 {
+			t.Errorf("walk time %v is negative", walk)
+		}
+	})
+}
+
+// TestWriteFileAtomicFailure checks that a failed write leaves neither a partial file nor its
+// temporary file behind, and keeps an existing file intact.
+func TestWriteFileAtomicFailure(t *testing.T) {
+	t.Run("rename", func(t *testing.T) {
+		// A non-empty directory at the path makes the final rename fail after the write.
+		dir := t.TempDir()
+		path := filepath.Join(dir, "out.paktxt")
+		if err := os.MkdirAll(filepath.Join(path, "inside"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFileAtomic(path, []byte("content\n"), 0644); err == nil {
+			t.Fatal("writeFileAtomic succeeded over a non-empty directory")
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Name() != "out.paktxt" || !entries[0].IsDir() {
+			t.Errorf("the failed write left %v behind", entries)
+		}
+	})
+	t.Run("read-only directory", func(t *testing.T) {
+		if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+			t.Skip("directory permissions do not stop this user")
+		}
+		dir := t.TempDir()
+		path := filepath.Join(dir, "out.paktxt")
+		if err := os.WriteFile(path, []byte("old\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(dir, 0555); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.Chmod(dir, 0755) })
+		if err := writeFileAtomic(path, []byte("new\n"), 0644); err == nil {
+			t.Fatal("writeFileAtomic succeeded in a read-only directory")
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Errorf("the failed write left %v behind", entries)
+		}
+		if content, err := os.ReadFile(path); err != nil || string(content) != "old\n" {
+			t.Errorf("the existing file changed to %q (%v)", content, err)
+		}
+	})
+}
+
+// TestNonCollidingName covers where the counter goes for multiple dots, no extension and
+// dotfiles, and the shortening of long names on a UTF-8 boundary.
+func TestNonCollidingName(t *testing.T) {
+	long := strings.Repeat("é", 130) // 260 bytes
+	tests := []struct {
+		name  string
+		path  string
+		taken []string
+		want  string
+	}{
+		{"free", "dir/a.txt", nil, "dir/a.txt"},
+		{"extension", "dir/a.txt", []string{"dir/a.txt"}, "dir/a (1).txt"},
+		{"next free", "a.txt", []string{"a.txt", "a (1).txt", "a (2).txt"}, "a (3).txt"},
+		{"multiple dots", "dir/a.tar.gz", []string{"dir/a.tar.gz"}, "dir/a.tar (1).gz"},
+		{"trailing dot", "a.", []string{"a."}, "a (1)."},
+		{"no extension", "dir/README", []string{"dir/README"}, "dir/README (1)"},
+		{"dotfile", ".env", []string{".env"}, ".env (1)"},
+		{"dotfile with extension", "dir/.config.yaml", []string{"dir/.config.yaml"}, "dir/.config (1).yaml"},
+		{"dotted directory", "v1.2/README", []string{"v1.2/README"}, "v1.2/README (1)"},
+		// 255 bytes leave 247 for the stem next to " (1)" and ".txt": 123 two-byte characters,
+		// as the 124th would be cut in half.
+		{"truncated", "dir/" + long + ".txt", []string{"dir/" + long + ".txt"}, "dir/" + strings.Repeat("é", 123) + " (1).txt"},
+		{"truncated without extension", long, []string{long}, strings.Repeat("é", 125) + " (1)"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			taken := map[string]bool{}
+			for _, name := range test.taken {
+				taken[filepath.FromSlash(name)] = true
+			}
+			got := nonCollidingName(filepath.FromSlash(test.path), func(name string) bool { return taken[name] })
+			if got != filepath.FromSlash(test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			if base := filepath.Base(got); len(base) > maxNameLength || !utf8.ValidString(base) {
+				t.Errorf("%q is %d bytes or not valid UTF-8", base, len(base))
+			}
+		})
+	}
+}
+
+// TestIsBinaryFileBySignatureTinyFiles checks that files too short for a magic number are
+// sniffed as text rather than failing the read, and that four bytes are enough to match one.
+func TestIsBinaryFileBySignatureTinyFiles(t *testing.T) {
+	tests := []struct {
+		content string
+		want    bool
+	}{
+		{"", false},
+		{"a", false},
+		{"ab\n", false},
+		{"\x7fEL", false},
+		{"\x7fELF", true},
+	}
+	dir := t.TempDir()
+	for i, test := range tests {
+		path := filepath.Join(dir, fmt.Sprintf("tiny-%d", i))
+		if err := os.WriteFile(path, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := isBinaryFileBySignature(path)
+		if err != nil {
+			t.Errorf("%q: %v", test.content, err)
+		} else if got != test.want {
+			t.Errorf("%q: got binary %v, want %v", test.content, got, test.want)
+		}
+	}
+}
+
+// BenchmarkReadArchiveFile compares parsing an archive above mmapThreshold through
+// readArchiveFile, which maps it, with parsing a copy read by os.ReadFile.
+func BenchmarkReadArchiveFile(b *testing.B) {
+	var archive strings.Builder
+	archive.WriteString(paktxtHeader)
+	line := strings.Repeat("x", 79) + "\n"
+	for i := 0; archive.Len() <= mmapThreshold; i++ {
+		block, err := encodeBlock(&FileBlock{
+			Filename:           fmt.Sprintf("dir/file-%d.txt", i),
+			HasTrailingNewline: true,
+			Content:            []byte(strings.Repeat(line, 100)),
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		archive.WriteString(block)
+	}
+	path := filepath.Join(b.TempDir(), "large.paktxt")
+	if err := os.WriteFile(path, []byte(archive.String()), 0644); err != nil {
+		b.Fatal(err)
+	}
+	b.Run("mmap", func(b *testing.B) {
+		b.SetBytes(int64(archive.Len()))
+		for i := 0; i < b.N; i++ {
+			data, release, err := readArchiveFile(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := parseBlocks(data); err != nil {
+				b.Fatal(err)
+			}
+			release()
+		}
+	})
+	b.Run("ReadFile", func(b *testing.B) {
+		b.SetBytes(int64(archive.Len()))
+		for i := 0; i < b.N; i++ {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := parseBlocks(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// TestRestoreStoreObjectStreams restores a large --store object without loading it into
+// memory, and leaves neither the file nor a temporary file behind when its last bytes are
+// damaged.
+func TestRestoreStoreObjectStreams(t *testing.T) {
+	const size = 32 << 20
+	src, store := t.TempDir(), t.TempDir()
+	content := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+	if err := os.WriteFile(filepath.Join(src, "big.txt"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(t.TempDir(), "big.paktxt")
+	runPaktxt(t, "pack", "--store", store, "-w", src, "-o", archive)
+	data, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousStore := storeDir
+	storeDir = store
+	t.Cleanup(func() { storeDir = previousStore })
+	silenceStdout(t)
+
+	dst := t.TempDir()
+	chdir(t, dst)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := parseAndRestore(data, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/4 {
+		t.Errorf("restoring a %d-byte object allocated %d bytes", size, allocated)
+	}
+	if restored, err := os.ReadFile("big.txt"); err != nil || !bytes.Equal(restored, content) {
+		t.Fatalf("big.txt was not restored intact (%v)", err)
+	}
+
+	objects, err := filepath.Glob(filepath.Join(store, "objects", "sha256", "*", "*"))
+	if err != nil || len(objects) != 1 {
+		t.Fatalf("expected one object, found %v (%v)", objects, err)
+	}
+	object, err := os.OpenFile(objects[0], os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = object.WriteAt([]byte("yz"), size-2)
+	object.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged := t.TempDir()
+	chdir(t, damaged)
+	if _, err := parseAndRestore(data, nil, nil, nil); err == nil || !strings.Contains(err.Error(), "does not match its digest") {
+		t.Fatalf("a damaged object restored with %v", err)
+	}
+	if entries, err := os.ReadDir(damaged); err != nil || len(entries) != 0 {
+		t.Errorf("the damaged object left %d entries behind (%v)", len(entries), err)
+	}
+}
+
+// TestRunClipboardOpTimeout checks that --clipboard-timeout kills a stalled clipboard command
+// instead of leaving it running.
+func TestRunClipboardOpTimeout(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("no sleep command")
+	}
+	previous := clipboardTimeout
+	clipboardTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { clipboardTimeout = previous })
+
+	started := make(chan *os.Process, 1)
+	start := time.Now()
+	err := runClipboardOp("Copying to clipboard", func(ctx context.Context) error {
+		cmd := exec.CommandContext(ctx, "sleep", "30")
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		started <- cmd.Process
+		return cmd.Wait()
+	})
+	if err == nil || !strings.Contains(err.Error(), "did not respond within") {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the timeout returned after %s", elapsed)
+	}
+	if err := (<-started).Signal(syscall.Signal(0)); !errors.Is(err, os.ErrProcessDone) {
+		t.Errorf("the clipboard command is still running (%v)", err)
+	}
+}
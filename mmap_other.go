@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// mapFile is not supported on this platform; callers fall back to reading the file.
+func mapFile(f *os.File, size int) ([]byte, func(), error) {
+	return nil, nil, errors.ErrUnsupported
+}
@@ -0,0 +1,116 @@
+#!/bin/bash
+# Feeds randomly mutated archives (truncated, bit-flipped, spliced, ...) to 'unpack' and
+# checks that it never panics, only exits with 0 or 1, and never writes outside the
+# directory it restores into. Seeds are valid archives in both formats (v1 also with compact metadata), including ones with
+# hostile file names and symlink chains; each seed also runs unmutated first. Set FUZZ_ITERATIONS
+# to run longer (default 300).
+set -e
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+cd "$SCRIPT_DIR/.."
+
+ITERATIONS="${FUZZ_ITERATIONS:-300}"
+WORK="$(mktemp -d)"
+trap 'rm -rf "$WORK"' EXIT
+
+go build -o "$WORK/paktxt" .
+mkdir -p "$WORK/src/nested/dir" "$WORK/seeds"
+printf ''             > "$WORK/src/empty.txt"
+printf 'a\r'          > "$WORK/src/a-cr.txt"
+printf 'a\r\nb\r\n'   > "$WORK/src/crlf.txt"
+printf '\xef\xbb\xbfbom\n' > "$WORK/src/bom.txt"
+printf '#!/bin/sh\necho hi\n' > "$WORK/src/nested/run.sh"
+chmod +x "$WORK/src/nested/run.sh"
+printf 'x\n---PAKTXT_FILE_END-19f8e7d6-c5b4-a321-b0e9-f8a7d6c5b4a3---\ny' > "$WORK/src/nested/dir/delimiter.txt"
+
+for format in v1 v2; do
+    "$WORK/paktxt" pack --format "$format" --language --modtime -w "$WORK/src" -o "$WORK/seeds/$format.paktxt" > /dev/null
+    # Same archive with names that must never be restored outside the target directory.
+    sed -e "s#nested/run.sh#../escape.txt#" -e "s#empty.txt#$WORK/absolute.txt#" \
+        "$WORK/seeds/$format.paktxt" > "$WORK/seeds/$format-hostile.paktxt"
+done
+"$WORK/paktxt" pack --compact-metadata --language --modtime -w "$WORK/src" -o "$WORK/seeds/v1-compact.paktxt" > /dev/null
+
+# Symlink chains that lead outside: 'link' points there directly, absolutely or through an
+# unclean target, or 'second' goes through a link to '.'; a later block is written below it.
+mkdir -p "$WORK/src-links/real" "$WORK/src-links/zz"
+echo x > "$WORK/src-links/real/x.txt"
+echo pwned > "$WORK/src-links/zz/pwned.txt"
+ln -s real "$WORK/src-links/link"
+ln -s real/x.txt "$WORK/src-links/second"
+for format in v1 v2; do
+    "$WORK/paktxt" pack --format "$format" --resolve-relative-symlinks -w "$WORK/src-links" -o "$WORK/links.paktxt" > /dev/null
+    n=0
+    for chain in '..|real/x.txt|link' "$WORK/sandbox|real/x.txt|link" 'real/../..|real/x.txt|link' '.|link/..|second'; do
+        IFS='|' read -r link second parent <<< "$chain"
+        n=$(( n + 1 ))
+        sed -e "s#^symlink: real\$#symlink: $link#" -e "s#\"symlink\":\"real\"#\"symlink\":\"$link\"#" \
+            -e "s#^symlink: real/x.txt\$#symlink: $second#" -e "s#\"symlink\":\"real/x.txt\"#\"symlink\":\"$second\"#" \
+            -e "s#^filename: zz/pwned.txt\$#filename: $parent/pwned.txt#" -e "s#\"filename\":\"zz/pwned.txt\"#\"filename\":\"$parent/pwned.txt\"#" \
+            "$WORK/links.paktxt" > "$WORK/seeds/$format-symlink-chain-$n.paktxt"
+    done
+done
+SEEDS=("$WORK"/seeds/*.paktxt)
+
+random() { echo $(( (RANDOM << 15 | RANDOM) % ($1 + 1) )); }
+
+# mutate IN OUT applies one random mutation to IN and writes the result to OUT.
+mutate() {
+    local size offset length other
+    size=$(wc -c < "$1")
+    offset=$(random "$size")
+    length=$(( RANDOM % 64 + 1 ))
+    case $(( RANDOM % 5 )) in
+    0) head -c "$offset" "$1" > "$2" ;;
+    1) { head -c "$offset" "$1"
+         case $(( RANDOM % 4 )) in
+         0) printf '\r' ;; 1) printf '\n' ;; 2) printf -- '-' ;;
+         *) printf "\\$(printf '%03o' $(( RANDOM % 256 )))" ;;
+         esac
+         tail -c +$(( offset + 2 )) "$1"; } > "$2" ;;
+    2) { head -c "$offset" "$1"; tail -c +$(( offset + length + 1 )) "$1"; } > "$2" ;;
+    3) { head -c $(( offset + length )) "$1"; tail -c +$(( offset + 1 )) "$1"; } > "$2" ;;
+    *) other="${SEEDS[RANDOM % ${#SEEDS[@]}]}"
+       { head -c "$offset" "$1"; tail -c +$(( $(random "$(wc -c < "$other")") + 1 )) "$other"; } > "$2" ;;
+    esac
+}
+
+failures=0
+ITERATIONS=$(( ITERATIONS + ${#SEEDS[@]} ))
+for (( i = 0; i < ITERATIONS; i++ )); do
+    if (( i < ${#SEEDS[@]} )); then
+        cp "${SEEDS[i]}" "$WORK/case.paktxt"
+    else
+        cp "${SEEDS[RANDOM % ${#SEEDS[@]}]}" "$WORK/case.paktxt"
+    fi
+    for (( m = RANDOM % 3; m >= 0 && i >= ${#SEEDS[@]}; m-- )); do
+        mutate "$WORK/case.paktxt" "$WORK/mutated.paktxt"
+        mv "$WORK/mutated.paktxt" "$WORK/case.paktxt"
+    done
+
+    rm -rf "$WORK/sandbox"
+    mkdir -p "$WORK/sandbox/target"
+    status=0
+    "$WORK/paktxt" unpack -w "$WORK/sandbox/target" -i "$WORK/case.paktxt" > "$WORK/out.txt" 2>&1 || status=$?
+
+    problem=""
+    if grep -q '^panic:' "$WORK/out.txt"; then
+        problem="panicked"
+    elif [ "$status" -ne 0 ] && [ "$status" -ne 1 ]; then
+        problem="exited with status $status"
+    elif [ "$(ls -A "$WORK/sandbox")" != "target" ] || [ -e "$WORK/absolute.txt" ]; then
+        problem="wrote outside the target directory"
+    fi
+    if [ -n "$problem" ]; then
+        failures=$(( failures + 1 ))
+        cp "$WORK/case.paktxt" "fuzz-failure-$failures.paktxt"
+        echo "case $i: unpack $problem (input saved to fuzz-failure-$failures.paktxt)"
+        tail -n 5 "$WORK/out.txt"
+        rm -f "$WORK/absolute.txt"
+    fi
+done
+
+if [ "$failures" -gt 0 ]; then
+    echo "$failures of $ITERATIONS cases failed."
+    exit 1
+fi
+echo "fuzz: OK ($ITERATIONS cases)"
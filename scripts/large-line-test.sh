@@ -0,0 +1,21 @@
+#!/bin/bash
+# Round-trips a 10MB single-line file through both archive formats. Guards against
+# line-based readers (e.g. bufio.Scanner with its default 64KB token limit) in the parser.
+set -e
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+cd "$SCRIPT_DIR/.."
+
+WORK="$(mktemp -d)"
+trap 'rm -rf "$WORK"' EXIT
+
+go build -o "$WORK/paktxt" .
+mkdir -p "$WORK/src"
+head -c 10485760 /dev/zero | tr '\0' 'x' > "$WORK/src/minified.js"
+
+for format in v1 v2; do
+    mkdir -p "$WORK/dst-$format"
+    "$WORK/paktxt" pack --format "$format" -w "$WORK/src" -o "$WORK/large-$format.paktxt" > /dev/null
+    "$WORK/paktxt" unpack -w "$WORK/dst-$format" -i "$WORK/large-$format.paktxt" > /dev/null
+    cmp "$WORK/src/minified.js" "$WORK/dst-$format/minified.js"
+    echo "$format: OK"
+done
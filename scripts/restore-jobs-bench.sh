@@ -0,0 +1,37 @@
+#!/bin/bash
+# Compares serial restore with 'unpack --jobs' on an archive of many small files and checks
+# that both restore the same tree. Set BENCH_FILES (default 5000) and BENCH_JOBS (default 8);
+# PAKTXT_BUILD_FLAGS=-race also runs the concurrent restore under the race detector.
+set -e
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+cd "$SCRIPT_DIR/.."
+
+FILES="${BENCH_FILES:-5000}"
+JOBS="${BENCH_JOBS:-8}"
+WORK="$(mktemp -d)"
+trap 'rm -rf "$WORK"' EXIT
+
+go build ${PAKTXT_BUILD_FLAGS} -o "$WORK/paktxt" .
+for (( i = 0; i < FILES; i++ )); do
+    dir="$WORK/src/d$(( i % 50 ))"
+    mkdir -p "$dir"
+    printf 'file %d\n' "$i" > "$dir/f$i.txt"
+done
+"$WORK/paktxt" pack -w "$WORK/src" -o "$WORK/many.paktxt" > /dev/null
+
+# restore_ms JOBS prints the milliseconds taken to restore the archive with --jobs JOBS.
+restore_ms() {
+    rm -rf "$WORK/dst-$1"
+    mkdir -p "$WORK/dst-$1"
+    local start end
+    start=$(date +%s%N)
+    "$WORK/paktxt" unpack --jobs "$1" -w "$WORK/dst-$1" -i "$WORK/many.paktxt" > /dev/null
+    end=$(date +%s%N)
+    echo $(( (end - start) / 1000000 ))
+}
+
+serial=$(restore_ms 1)
+parallel=$(restore_ms "$JOBS")
+diff -r "$WORK/src" "$WORK/dst-1"
+diff -r "$WORK/src" "$WORK/dst-$JOBS"
+echo "$FILES files: serial ${serial}ms, --jobs $JOBS ${parallel}ms"
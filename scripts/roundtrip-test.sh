@@ -0,0 +1,1072 @@
+#!/bin/bash
+# Checks the command-line options around the round trip: that timestamps in metadata do not
+# depend on the local timezone, that concatenated archives restore, restore-time permission
+# options and more. The identity matrix over fixture trees and formats is TestRoundTrip in
+# main_test.go.
+set -e
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+cd "$SCRIPT_DIR/.."
+
+WORK="$(mktemp -d)"
+trap 'rm -rf "$WORK"' EXIT
+
+go build -o "$WORK/paktxt" .
+
+# The identity matrix, every fixture in every format restored plainly, with --jobs and as a
+# tar stream, is TestRoundTrip in main_test.go. These two trees feed the checks below.
+fixture_edge_cases() {
+    printf ''           > "$1/empty.txt"
+    printf '\n'         > "$1/newline.txt"
+    printf 'a'          > "$1/a.txt"
+    printf 'a\n'        > "$1/a-newline.txt"
+    printf 'a\n\n'      > "$1/a-two-newlines.txt"
+    printf 'a\r'        > "$1/a-cr.txt"
+    printf 'a\r\n'      > "$1/a-crlf.txt"
+    printf 'a\r\nb'     > "$1/crlf-no-newline.txt"
+    printf '\r\n\r\n'   > "$1/crlf-only.txt"
+    printf 'x\n---PAKTXT_FILE_END-19f8e7d6-c5b4-a321-b0e9-f8a7d6c5b4a3---\ny' > "$1/delimiter.txt"
+    printf 'content: x\ncontent:\n' > "$1/content-label.txt"
+}
+
+fixture_nested() {
+    mkdir -p "$1/a/b/c" "$1/with space/dir" "$1/.hidden"
+    printf 'deep\n'    > "$1/a/b/c/deep.txt"
+    printf 'mid'       > "$1/a/b/mid.txt"
+    printf 'spaced\n'  > "$1/with space/dir/file name.txt"
+    printf 'dot\n'     > "$1/.hidden/.env"
+    printf 'unicode\n' > "$1/a/ünïcödé.txt"
+    printf 'semicolon\n' > "$1/a/semi;colon%3B.txt"
+    printf '#!/usr/bin/env python3\n' > "$1/a/b/c/script.py"
+    chmod 755 "$1/a/b/c/script.py"
+}
+
+for fixture in edge_cases nested; do
+    mkdir -p "$WORK/src-$fixture"
+    "fixture_$fixture" "$WORK/src-$fixture"
+    for format in v1 v2; do
+        "$WORK/paktxt" pack --format "$format" -w "$WORK/src-$fixture" -o "$WORK/$fixture-$format.paktxt" > /dev/null
+    done
+done
+
+# Timestamps must not depend on the local timezone.
+touch -d '2024-01-02 03:04:05 UTC' "$WORK/src-edge_cases/a.txt"
+TZ=UTC "$WORK/paktxt" pack --modtime -w "$WORK/src-edge_cases" -o "$WORK/tz-utc.paktxt" > /dev/null
+TZ=Asia/Kolkata "$WORK/paktxt" pack --modtime -w "$WORK/src-edge_cases" -o "$WORK/tz-kolkata.paktxt" > /dev/null
+cmp "$WORK/tz-utc.paktxt" "$WORK/tz-kolkata.paktxt"
+grep -q '^modtime: 2024-01-02T03:04:05Z$' "$WORK/tz-utc.paktxt"
+echo "timezone: OK"
+
+# Two archives concatenated into one file (each with its own header) restore as one.
+mkdir -p "$WORK/dst-concat"
+cat "$WORK/edge_cases-v1.paktxt" "$WORK/tz-utc.paktxt" > "$WORK/concat.paktxt"
+"$WORK/paktxt" unpack --strict-parse -w "$WORK/dst-concat" -i "$WORK/concat.paktxt" > /dev/null
+diff -r "$WORK/src-edge_cases" "$WORK/dst-concat"
+echo "concatenated: OK"
+
+# --executable-glob sets the executable bit on matching files only.
+mkdir -p "$WORK/dst-exec"
+"$WORK/paktxt" unpack --executable-glob 'a-*.txt,empty.txt' -w "$WORK/dst-exec" -i "$WORK/edge_cases-v1.paktxt" > /dev/null
+for file in a-cr.txt a-crlf.txt a-newline.txt a-two-newlines.txt empty.txt; do
+    test -x "$WORK/dst-exec/$file"
+done
+test ! -x "$WORK/dst-exec/a.txt" && test ! -x "$WORK/dst-exec/newline.txt"
+echo "executable-glob: OK"
+
+# --exclude-if-empty leaves out zero-byte files and keeps everything else.
+"$WORK/paktxt" pack --exclude-if-empty -w "$WORK/src-edge_cases" -o "$WORK/non-empty.paktxt" > /dev/null
+if grep -q '^filename: empty.txt$' "$WORK/non-empty.paktxt"; then
+    echo "exclude-if-empty: empty.txt was packed"
+    exit 1
+fi
+grep -q '^filename: newline.txt$' "$WORK/non-empty.paktxt"
+grep -q '^filename: a.txt$' "$WORK/non-empty.paktxt"
+echo "exclude-if-empty: OK"
+
+# '~' and $VAR in path flags are expanded; undefined variables are an error.
+mkdir -p "$WORK/home/dst"
+HOME="$WORK/home" NAME=expanded "$WORK/paktxt" pack -w "$WORK/src-nested" -o '~/${NAME}.paktxt' > /dev/null
+HOME="$WORK/home" "$WORK/paktxt" unpack -i '$HOME/expanded.paktxt' -w '~/dst' > /dev/null
+diff -r "$WORK/src-nested" "$WORK/home/dst"
+if "$WORK/paktxt" pack -w "$WORK/src-nested" -o '$PAKTXT_UNDEFINED_VAR/a.paktxt' > /dev/null 2>&1; then
+    echo "path expansion: undefined variable was accepted"
+    exit 1
+fi
+echo "path expansion: OK"
+
+# --max-line-length skips files with a longer line; a line of exactly the limit is kept.
+mkdir -p "$WORK/lines"
+printf 'a\n%s\n' "$(head -c 100 /dev/zero | tr '\0' x)" > "$WORK/lines/limit.txt"
+head -c 101 /dev/zero | tr '\0' x > "$WORK/lines/minified.js"
+"$WORK/paktxt" pack --max-line-length 100 -w "$WORK/lines" -o "$WORK/lines.paktxt" > /dev/null
+grep -q '^filename: limit.txt$' "$WORK/lines.paktxt"
+if grep -q '^filename: minified.js$' "$WORK/lines.paktxt"; then
+    echo "max-line-length: minified.js was packed"
+    exit 1
+fi
+echo "max-line-length: OK"
+
+# Two runs with the same SOURCE_DATE_EPOCH are identical even if files are touched in between.
+SOURCE_DATE_EPOCH=1700000000 "$WORK/paktxt" pack --modtime -w "$WORK/src-nested" -o "$WORK/epoch-1.paktxt" > /dev/null
+touch "$WORK/src-nested/a/b/mid.txt"
+SOURCE_DATE_EPOCH=1700000000 "$WORK/paktxt" pack --modtime -w "$WORK/src-nested" -o "$WORK/epoch-2.paktxt" > /dev/null
+cmp "$WORK/epoch-1.paktxt" "$WORK/epoch-2.paktxt"
+grep -q '^modtime: 2023-11-14T22:13:20Z$' "$WORK/epoch-1.paktxt"
+echo "source-date-epoch: OK"
+
+# --text-file packs exactly the listed paths, even with a blocked extension or binary signature.
+mkdir -p "$WORK/text-file/data"
+printf 'golden\n'          > "$WORK/text-file/data/golden.bin"
+printf 'other\n'           > "$WORK/text-file/data/other.bin"
+printf '\x7fELF not really\n' > "$WORK/text-file/data/elf-like"
+"$WORK/paktxt" pack --text-file 'data/golden.bin,./data/elf-like' -w "$WORK/text-file" -o "$WORK/text-file.paktxt" > /dev/null
+grep -q '^filename: data/golden.bin$' "$WORK/text-file.paktxt"
+grep -q '^filename: data/elf-like$' "$WORK/text-file.paktxt"
+if grep -q '^filename: data/other.bin$' "$WORK/text-file.paktxt"; then
+    echo "text-file: data/other.bin was packed"
+    exit 1
+fi
+echo "text-file: OK"
+
+# .ts is sniffed: MPEG transport streams are skipped, TypeScript (even one whose bytes 0 and
+# 188 are 'G', the stream's sync byte) is packed.
+mkdir -p "$WORK/ts"
+for i in 1 2 3; do
+    printf '\x47\x40\x00\x10'
+    head -c 184 /dev/zero | tr '\0' '\377'
+done > "$WORK/ts/video.ts"
+printf 'export const x = 1;\n' > "$WORK/ts/app.ts"
+{ printf 'G%186s\n' ''; printf 'G = 2;\n'; } > "$WORK/ts/sync-like.ts"
+"$WORK/paktxt" pack -w "$WORK/ts" -o "$WORK/ts.paktxt" > /dev/null
+if grep -q '^filename: video.ts$' "$WORK/ts.paktxt" || ! grep -q '^filename: app.ts$' "$WORK/ts.paktxt" ||
+    ! grep -q '^filename: sync-like.ts$' "$WORK/ts.paktxt"; then
+    echo "ts: packed $(grep '^filename: ' "$WORK/ts.paktxt" | paste -sd,)"
+    exit 1
+fi
+echo "ts: OK"
+
+# --compress: output names per flag and given extension, and compressed archives round-trip.
+mkdir -p "$WORK/names"
+while read -r flag given expected; do
+    [ "$flag" = none ] && flag=""
+    rm -f "$WORK/names/"*
+    "$WORK/paktxt" pack $flag -w "$WORK/src-nested" -o "$WORK/names/$given" > /dev/null
+    if [ "$(ls "$WORK/names")" != "$expected" ]; then
+        echo "compress: '$flag -o $given' wrote '$(ls "$WORK/names")', expected '$expected'"
+        exit 1
+    fi
+done <<'CASES'
+none snap snap.paktxt
+none snap.paktxt snap.paktxt
+none snap.paktxt.gz snap.paktxt.gz
+none snap.zip snap.zip
+--compress snap snap.paktxt.gz
+--compress snap.paktxt snap.paktxt.gz
+--compress snap.paktxt.gz snap.paktxt.gz
+--compress snap.zip snap.zip
+CASES
+for format in v1 v2; do
+    mkdir -p "$WORK/dst-gzip-$format"
+    "$WORK/paktxt" pack --compress --format "$format" -w "$WORK/src-edge_cases" -o "$WORK/gzip-$format" > /dev/null
+    gzip -t "$WORK/gzip-$format.paktxt.gz"
+    "$WORK/paktxt" unpack --strict-parse -w "$WORK/dst-gzip-$format" -i "$WORK/gzip-$format.paktxt.gz" > /dev/null
+    diff -r "$WORK/src-edge_cases" "$WORK/dst-gzip-$format"
+done
+echo "compress: OK"
+
+# --clipboard-via-temp: the archive piped to a stand-in clipboard command round-trips, and the
+# temporary file is removed.
+mkdir -p "$WORK/fake-bin" "$WORK/clip-tmp" "$WORK/dst-clip"
+printf '#!/bin/sh\ncat > "%s"\n' "$WORK/clipboard.paktxt" > "$WORK/fake-bin/xclip"
+chmod +x "$WORK/fake-bin/xclip"
+PATH="$WORK/fake-bin:$PATH" WAYLAND_DISPLAY= PAKTXT_TMPDIR="$WORK/clip-tmp" \
+    "$WORK/paktxt" pack -b --clipboard-via-temp -w "$WORK/src-edge_cases" > /dev/null
+"$WORK/paktxt" unpack --strict-parse -w "$WORK/dst-clip" -i "$WORK/clipboard.paktxt" > /dev/null
+diff -r "$WORK/src-edge_cases" "$WORK/dst-clip"
+if [ -n "$(ls -A "$WORK/clip-tmp")" ]; then
+    echo "clipboard-via-temp: temporary file left behind"
+    exit 1
+fi
+echo "clipboard-via-temp: OK"
+
+# list --long: the short hashes match the source files, in both formats.
+for format in v1 v2; do
+    "$WORK/paktxt" list --long "$WORK/nested-$format.paktxt" | awk '/^==>/ { rows = 1; next } rows && $1 != "FILE" { print $NF }' | sort > "$WORK/long-$format.txt"
+    find "$WORK/src-nested" -type f -exec sha256sum {} + | cut -c1-12 | sort | diff - "$WORK/long-$format.txt"
+done
+echo "list-long: OK"
+
+# list: the newest recorded modtime dates an archive; without modtimes the column is '-'.
+out=$("$WORK/paktxt" list "$WORK/epoch-1.paktxt" "$WORK/nested-v1.paktxt")
+if ! grep -q 'epoch-1.paktxt .* 2023-11-14T22:13:20Z$' <<< "$out" || ! grep -q 'nested-v1.paktxt .* -$' <<< "$out"; then
+    echo "list: unexpected NEWEST column"
+    echo "$out"
+    exit 1
+fi
+echo "list-newest: OK"
+
+# --skip-unchanged: identical files keep their modification time; differing files are restored.
+mkdir -p "$WORK/dst-unchanged"
+"$WORK/paktxt" unpack -w "$WORK/dst-unchanged" -i "$WORK/nested-v1.paktxt" > /dev/null
+touch -d '2001-01-01 00:00:00' "$WORK/dst-unchanged/a/b/c/deep.txt"
+echo 'local edit' > "$WORK/dst-unchanged/a/b/mid.txt"
+"$WORK/paktxt" unpack --skip-unchanged -w "$WORK/dst-unchanged" -i "$WORK/nested-v1.paktxt" > /dev/null
+diff -r "$WORK/src-nested" "$WORK/dst-unchanged"
+if [ "$(date -r "$WORK/dst-unchanged/a/b/c/deep.txt" +%Y)" != 2001 ]; then
+    echo "skip-unchanged: an identical file was rewritten"
+    exit 1
+fi
+echo "skip-unchanged: OK"
+
+# --walk-root: the archive is written relative to the current directory, with paths relative
+# to the scanned tree.
+mkdir -p "$WORK/walk-out" "$WORK/dst-walk"
+(cd "$WORK/walk-out" && "$WORK/paktxt" pack --walk-root ../src-nested -o walk.paktxt > /dev/null)
+"$WORK/paktxt" unpack --strict-parse -w "$WORK/dst-walk" -i "$WORK/walk-out/walk.paktxt" > /dev/null
+diff -r "$WORK/src-nested" "$WORK/dst-walk"
+if [ -e "$WORK/src-nested/walk.paktxt" ]; then
+    echo "walk-root: archive written into the scanned tree"
+    exit 1
+fi
+echo "walk-root: OK"
+
+# The content label is recognized with stray whitespace around it, and only in the metadata:
+# bodies starting with 'content:' are unaffected (see fixture_edge_cases).
+for variant in 'content: ' '  content:' $'content:\t\r'; do
+    rm -rf "$WORK/dst-label"
+    mkdir -p "$WORK/dst-label"
+    awk -v label="$variant" '/^---PAKTXT_FILE_START-/ { meta = 1 } meta && /^content:$/ { print label; meta = 0; next } { print }' \
+        "$WORK/edge_cases-v1.paktxt" > "$WORK/label.paktxt"
+    "$WORK/paktxt" unpack --strict-parse -w "$WORK/dst-label" -i "$WORK/label.paktxt" > /dev/null
+    diff -r "$WORK/src-edge_cases" "$WORK/dst-label"
+done
+echo "content-label: OK"
+
+# Stored filenames are normalized on parse: './a.txt', './/a.txt' and 'x/../a.txt' all name
+# 'a.txt', for restore and for --filter.
+for prefix in './' './/' 'x/../' 'x/./../'; do
+    for format in v1 v2; do
+        rm -rf "$WORK/dst-prefix"
+        mkdir -p "$WORK/dst-prefix"
+        sed -e "s#^filename: #&$prefix#" -e "s#\"filename\":\"#&$prefix#" "$WORK/edge_cases-$format.paktxt" > "$WORK/prefix.paktxt"
+        "$WORK/paktxt" unpack --strict-parse -w "$WORK/dst-prefix" -i "$WORK/prefix.paktxt" > /dev/null
+        diff -r "$WORK/src-edge_cases" "$WORK/dst-prefix"
+        rm -rf "$WORK/dst-prefix"
+        mkdir -p "$WORK/dst-prefix"
+        "$WORK/paktxt" unpack -f 'a.txt' -w "$WORK/dst-prefix" -i "$WORK/prefix.paktxt" > /dev/null
+        if [ "$(ls "$WORK/dst-prefix")" != "a.txt" ]; then
+            echo "path-normalization: --filter 'a.txt' did not match '${prefix}a.txt' ($format)"
+            exit 1
+        fi
+    done
+done
+echo "path-normalization: OK"
+
+# --replace: literal substitutions at pack time change the stored content, and at unpack time
+# the restored content.
+mkdir -p "$WORK/replace/src" "$WORK/replace/dst"
+printf 'root=/home/me/app\n__NAME__ uses /home/me\n' > "$WORK/replace/src/config.txt"
+"$WORK/paktxt" pack --replace /home/me=~ -w "$WORK/replace/src" -o "$WORK/replace.paktxt" > /dev/null
+if "$WORK/paktxt" unpack --replace '=empty' -w "$WORK/replace/dst" -i "$WORK/replace.paktxt" > /dev/null 2>&1; then
+    echo "replace: an empty OLD was accepted"
+    exit 1
+fi
+"$WORK/paktxt" unpack --replace __NAME__=demo --replace 'app=a=b' -w "$WORK/replace/dst" -i "$WORK/replace.paktxt" > /dev/null
+diff <(printf 'root=~/a=b\ndemo uses ~\n') "$WORK/replace/dst/config.txt"
+echo "replace: OK"
+
+# --output-encoding: BOM-prefixed and base64 archives are detected and restore, also after a
+# transport that converts line endings.
+for encoding in utf8-bom base64; do
+    for format in v1 v2; do
+        rm -rf "$WORK/dst-encoding"
+        mkdir -p "$WORK/dst-encoding"
+        "$WORK/paktxt" pack --output-encoding "$encoding" --format "$format" -w "$WORK/src-edge_cases" -o "$WORK/encoded.paktxt" > /dev/null
+        if [ "$encoding" = base64 ]; then
+            sed -i 's/$/\r/' "$WORK/encoded.paktxt"
+        fi
+        "$WORK/paktxt" unpack --strict-parse -w "$WORK/dst-encoding" -i "$WORK/encoded.paktxt" > /dev/null
+        diff -r "$WORK/src-edge_cases" "$WORK/dst-encoding"
+        "$WORK/paktxt" list "$WORK/encoded.paktxt" | grep -q " $format "
+    done
+done
+echo "output-encoding: OK"
+
+# A block cut off before its content, followed directly by the next block's start delimiter, is
+# skipped with a warning (and rejected by --strict-parse) without losing the next block.
+start='---PAKTXT_FILE_START-19f8e7d6-c5b4-a321-b0e9-f8a7d6c5b4a3---'
+end='---PAKTXT_FILE_END-19f8e7d6-c5b4-a321-b0e9-f8a7d6c5b4a3---'
+printf '%s\nfilename: cut.txt\nexecutable: false\n%s\nfilename: ok.txt\nexecutable: false\ntrailing_newline: true\ncontent:\nok\n%s\n' \
+    "$start" "$start" "$end" > "$WORK/truncated.paktxt"
+mkdir -p "$WORK/dst-truncated"
+"$WORK/paktxt" unpack -w "$WORK/dst-truncated" -i "$WORK/truncated.paktxt" > "$WORK/truncated.out" 2>&1
+grep -q 'Skipping truncated file block at byte 0 ("cut.txt")' "$WORK/truncated.out"
+if [ "$(ls "$WORK/dst-truncated")" != "ok.txt" ] || [ "$(cat "$WORK/dst-truncated/ok.txt")" != "ok" ]; then
+    echo "truncated-block: expected only ok.txt to be restored"
+    exit 1
+fi
+if "$WORK/paktxt" unpack --strict-parse -w "$WORK/dst-truncated" -i "$WORK/truncated.paktxt" > /dev/null 2>&1; then
+    echo "truncated-block: --strict-parse accepted a truncated block"
+    exit 1
+fi
+echo "truncated-block: OK"
+
+# A size label near the integer limit is reported as exceeding the archive instead of
+# overflowing the parser, in the labeled and the compact metadata style.
+while read -r meta; do
+    printf '%s\n%b\ncontent:\nx\n%s\n' "$start" "${meta//+/ }" "$end" > "$WORK/huge-size.paktxt"
+    for strict in "" --strict-parse; do
+        status=0
+        out=$("$WORK/paktxt" unpack $strict -w "$WORK/dst-truncated" -i "$WORK/huge-size.paktxt" 2>&1) || status=$?
+        if [ "$status" != 1 ] || ! grep -q 'exceeds the archive' <<< "$out"; then
+            echo "huge size: '$meta' $strict exited $status instead of reporting the size"
+            exit 1
+        fi
+    done
+done <<'CASES'
+filename:+big.txt\nexecutable:+false\ntrailing_newline:+true\nsize:+9223372036854775800
+meta:+filename=big.txt;executable=false;trailing_newline=true;size=9223372036854775800
+CASES
+echo "huge size: OK"
+
+# --only-ext: extensions match case-insensitively and add to --filter.
+mkdir -p "$WORK/only-ext/pkg"
+printf 'package a\n' > "$WORK/only-ext/pkg/a.go"
+printf 'package b\n' > "$WORK/only-ext/B.GO"
+printf '# doc\n'     > "$WORK/only-ext/doc.md"
+printf 'go\n'        > "$WORK/only-ext/notes.txt"
+printf 'go\n'        > "$WORK/only-ext/go"
+while read -r expected flags; do
+    read -ra args <<< "$flags"
+    "$WORK/paktxt" pack "${args[@]}" -w "$WORK/only-ext" -o "$WORK/only-ext.paktxt" > /dev/null
+    actual="$(sed -n "/^$start$/,$ s/^filename: //p" "$WORK/only-ext.paktxt" | sort | paste -sd, -)"
+    if [ "$actual" != "$expected" ]; then
+        echo "only-ext: '$flags' packed '$actual', expected '$expected'"
+        exit 1
+    fi
+done <<'CASES'
+B.GO,pkg/a.go --only-ext go
+B.GO,doc.md,pkg/a.go --only-ext .GO,md
+B.GO,notes.txt,pkg/a.go --only-ext go -f *.txt
+CASES
+echo "only-ext: OK"
+
+# pack --dry-run: lists the files a pack would include, in the same order, and writes nothing.
+"$WORK/paktxt" pack --dry-run -w "$WORK/src-nested" -o "$WORK/dry-run.paktxt" > "$WORK/dry-run.out"
+"$WORK/paktxt" pack -w "$WORK/src-nested" -o "$WORK/not-dry-run.paktxt" > /dev/null
+diff <(sed -n 's/^ *[0-9.]* [KMG]*i*B  //p' "$WORK/dry-run.out") \
+    <(sed -n "/^$start$/,$ s/^filename: //p" "$WORK/not-dry-run.paktxt")
+if [ -e "$WORK/dry-run.paktxt" ]; then
+    echo "dry-run: an archive was written"
+    exit 1
+fi
+echo "dry-run: OK"
+
+# --max-total-bytes: the archive never exceeds the limit, omitted files are listed, and what
+# was packed still restores.
+for limit in 1600 2300 4000; do
+    rm -rf "$WORK/dst-budget"
+    mkdir -p "$WORK/dst-budget"
+    "$WORK/paktxt" pack --max-total-bytes "$limit" -w "$WORK/src-edge_cases" -o "$WORK/budget.paktxt" > "$WORK/budget.out"
+    if [ "$(wc -c < "$WORK/budget.paktxt")" -gt "$limit" ]; then
+        echo "max-total-bytes: archive is larger than $limit bytes"
+        exit 1
+    fi
+    "$WORK/paktxt" unpack --strict-parse -w "$WORK/dst-budget" -i "$WORK/budget.paktxt" > /dev/null
+    packed=$(ls -A "$WORK/dst-budget" | wc -l)
+    omitted=$(sed -n 's/^Omitted \([0-9]*\) file(s).*/\1/p' "$WORK/budget.out")
+    if [ $(( packed + ${omitted:-0} )) -ne "$(ls -A "$WORK/src-edge_cases" | wc -l)" ]; then
+        echo "max-total-bytes: $packed packed and ${omitted:-0} omitted files do not add up"
+        exit 1
+    fi
+done
+echo "max-total-bytes: OK"
+
+# --follow-gitignore-in-subdirs: outside a repository, nested .gitignore files (negation,
+# directory-only and anchored patterns, "**") select the same files as git itself.
+if command -v git > /dev/null; then
+    ign="$WORK/src-gitignore"
+    mkdir -p "$ign/sub/deeper" "$ign/sub/secret" "$ign/build-out" "$ign/ignored-dir" "$ign/docs/a/b"
+    printf '*.gen\n!keep.gen\nbuild-out/\n/top-only.txt\ndocs/**/draft.md\nignored-dir/\n!ignored-dir/inner.txt\n' > "$ign/.gitignore"
+    printf '!*.gen\nsecret/\n*.scratch\n' > "$ign/sub/.gitignore"
+    printf '!c.scratch\n' > "$ign/sub/deeper/.gitignore"
+    for f in main.txt top-only.txt a.gen keep.gen sub/top-only.txt sub/b.gen sub/c.scratch \
+        sub/build-out sub/secret/x.txt sub/deeper/c.scratch sub/deeper/d.gen build-out/x.txt \
+        ignored-dir/inner.txt docs/draft.md docs/a/b/draft.md docs/final.md; do
+        echo "$f" > "$ign/$f"
+    done
+    "$WORK/paktxt" pack --follow-gitignore-in-subdirs -w "$ign" -o "$WORK/gitignore.paktxt" > /dev/null
+    cp -r "$ign" "$WORK/gitignore-repo"
+    git -C "$WORK/gitignore-repo" init -q
+    if ! diff <(git -C "$WORK/gitignore-repo" ls-files --cached --others --exclude-standard | sort) \
+        <(sed -n "/^$start$/,$ s/^filename: //p" "$WORK/gitignore.paktxt" | sort); then
+        echo "follow-gitignore-in-subdirs: packed files differ from git ls-files"
+        exit 1
+    fi
+    echo "follow-gitignore-in-subdirs: OK"
+fi
+
+# unpack --git-commit of an archive whose files already match HEAD reports that there is
+# nothing to commit instead of failing.
+if command -v git > /dev/null; then
+    mkdir -p "$WORK/src-gitcommit" "$WORK/gitcommit-repo"
+    printf 'hello\n' > "$WORK/src-gitcommit/a.txt"
+    "$WORK/paktxt" pack -w "$WORK/src-gitcommit" -o "$WORK/gitcommit.paktxt" > /dev/null
+    git -C "$WORK/gitcommit-repo" init -q
+    export GIT_AUTHOR_NAME=test GIT_AUTHOR_EMAIL=test@example.com GIT_COMMITTER_NAME=test GIT_COMMITTER_EMAIL=test@example.com
+    "$WORK/paktxt" unpack --git-commit 'Apply' -w "$WORK/gitcommit-repo" -i "$WORK/gitcommit.paktxt" > /dev/null
+    if ! "$WORK/paktxt" unpack --force --git-commit 'Apply again' -w "$WORK/gitcommit-repo" -i "$WORK/gitcommit.paktxt" > "$WORK/gitcommit.out" ||
+        ! grep -q 'nothing to commit' "$WORK/gitcommit.out" || [ "$(git -C "$WORK/gitcommit-repo" rev-list --count HEAD)" != 1 ]; then
+        echo "git-commit: restoring files that match HEAD did not report nothing to commit"
+        exit 1
+    fi
+    echo "git-commit: OK"
+fi
+
+# FIFOs are skipped with a warning instead of blocking the pack forever (Unix only).
+if command -v mkfifo > /dev/null; then
+    mkdir -p "$WORK/src-fifo"
+    echo "regular" > "$WORK/src-fifo/regular.txt"
+    mkfifo "$WORK/src-fifo/pipe.txt"
+    if ! timeout 20 "$WORK/paktxt" pack -w "$WORK/src-fifo" -o "$WORK/fifo.paktxt" > "$WORK/fifo.out" 2>&1; then
+        echo "fifo: pack failed or hung"
+        exit 1
+    fi
+    if ! grep -q "Skipping FIFO: pipe.txt" "$WORK/fifo.out" || grep -q "^filename: pipe.txt$" "$WORK/fifo.paktxt" \
+        || ! grep -q "^filename: regular.txt$" "$WORK/fifo.paktxt"; then
+        echo "fifo: expected pipe.txt to be skipped with a warning and regular.txt to be packed"
+        exit 1
+    fi
+    echo "fifo: OK"
+fi
+
+# --compact-metadata: one metadata line per block, smaller than the labeled form, detected on
+# unpack, and kept when appending to or updating the archive.
+"$WORK/paktxt" pack --compact-metadata --modtime -w "$WORK/src-edge_cases" -o "$WORK/compact.paktxt" > /dev/null
+"$WORK/paktxt" pack --modtime -w "$WORK/src-edge_cases" -o "$WORK/labeled.paktxt" > /dev/null
+if [ "$(wc -c < "$WORK/compact.paktxt")" -ge "$(wc -c < "$WORK/labeled.paktxt")" ] \
+    || sed -n "/^$start$/,$ p" "$WORK/compact.paktxt" | grep -q '^filename: ' \
+    || ! grep -q '^meta: filename=a.txt;.*;modtime=2024-01-02T03:04:05Z$' "$WORK/compact.paktxt"; then
+    echo "compact-metadata: expected single-line metadata in a smaller archive"
+    exit 1
+fi
+mkdir -p "$WORK/src-compact-append"
+echo "appended" > "$WORK/src-compact-append/appended.txt"
+"$WORK/paktxt" pack --append -w "$WORK/src-compact-append" -o "$WORK/compact.paktxt" > /dev/null
+grep -q '^meta: filename=appended.txt;' "$WORK/compact.paktxt"
+mkdir -p "$WORK/dst-compact"
+"$WORK/paktxt" unpack --strict-parse -w "$WORK/dst-compact" -i "$WORK/compact.paktxt" > /dev/null
+cmp "$WORK/src-compact-append/appended.txt" "$WORK/dst-compact/appended.txt"
+rm "$WORK/dst-compact/appended.txt"
+diff -r "$WORK/src-edge_cases" "$WORK/dst-compact"
+echo "compact-metadata: OK"
+
+# Files are restored one at a time in archive order, or in reverse with --reverse-restore.
+sed -n "/^$start$/,$ s/^filename: //p" "$WORK/nested-v1.paktxt" > "$WORK/archive-order.txt"
+for order in forward reverse; do
+    rm -rf "$WORK/dst-order"
+    mkdir -p "$WORK/dst-order"
+    order_flags=()
+    expected=(cat "$WORK/archive-order.txt")
+    if [ "$order" = reverse ]; then
+        order_flags=(--reverse-restore)
+        expected=(tac "$WORK/archive-order.txt")
+    fi
+    "$WORK/paktxt" unpack "${order_flags[@]}" -w "$WORK/dst-order" -i "$WORK/nested-v1.paktxt" > "$WORK/order.out"
+    if ! diff <("${expected[@]}") <(sed -n 's/^Restored: //p' "$WORK/order.out"); then
+        echo "restore order ($order): files were not written in the expected order"
+        exit 1
+    fi
+done
+echo "restore order: OK"
+
+# --jobs: for a name archived twice the later block still wins.
+mkdir -p "$WORK/src-jobs-first" "$WORK/src-jobs-second" "$WORK/dst-jobs-twice"
+for i in $(seq 1 20); do
+    echo "first $i" > "$WORK/src-jobs-first/f$i.txt"
+    echo "second $i" > "$WORK/src-jobs-second/f$i.txt"
+done
+"$WORK/paktxt" pack -w "$WORK/src-jobs-first" -o "$WORK/jobs-first.paktxt" > /dev/null
+"$WORK/paktxt" pack -w "$WORK/src-jobs-second" -o "$WORK/jobs-second.paktxt" > /dev/null
+cat "$WORK/jobs-first.paktxt" "$WORK/jobs-second.paktxt" > "$WORK/jobs-twice.paktxt"
+"$WORK/paktxt" unpack -j 4 -w "$WORK/dst-jobs-twice" -i "$WORK/jobs-twice.paktxt" > /dev/null
+diff -r "$WORK/src-jobs-second" "$WORK/dst-jobs-twice"
+echo "jobs: OK"
+
+# list --by-ext: per-extension counts, extensions folded to lower case, largest total first,
+# and names without an extension (including dotfiles) under "(none)".
+mkdir -p "$WORK/src-by-ext"
+printf 'aaaaaaaaaa' > "$WORK/src-by-ext/big.JS"
+printf 'aaaaa'      > "$WORK/src-by-ext/small.js"
+printf 'aaaaaaa'    > "$WORK/src-by-ext/Makefile"
+printf 'aa'         > "$WORK/src-by-ext/.env"
+printf 'aaa'        > "$WORK/src-by-ext/doc.md"
+"$WORK/paktxt" pack -w "$WORK/src-by-ext" -o "$WORK/by-ext.paktxt" > /dev/null
+expected=$'.js 2 15\n(none) 2 9\n.md 1 3'
+actual=$("$WORK/paktxt" list --by-ext "$WORK/by-ext.paktxt" | sed -n '/^EXTENSION/,$ { /^EXTENSION/d; s/^\([^ ]*\) *\([0-9]*\) *\([0-9]*\) B .*/\1 \2 \3/p }')
+if [ "$actual" != "$expected" ]; then
+    echo "list --by-ext: got '$actual', expected '$expected'"
+    exit 1
+fi
+echo "list --by-ext: OK"
+
+# --read-retries: a file that only becomes readable after the walk (here a link whose target
+# appears a moment later) is packed after a retry instead of being skipped.
+mkdir -p "$WORK/src-retry"
+ln -s target.txt "$WORK/src-retry/late.txt"
+(sleep 0.5 && echo "late content" > "$WORK/src-retry/target.txt") &
+"$WORK/paktxt" pack --read-retries 6 --read-retry-delay 50ms -w "$WORK/src-retry" -o "$WORK/retry.paktxt" > "$WORK/retry.out"
+wait
+if ! grep -q '^Retrying read of late.txt' "$WORK/retry.out" || ! grep -q '^filename: late.txt$' "$WORK/retry.paktxt"; then
+    echo "read-retries: late.txt was not packed after retrying"
+    exit 1
+fi
+grep -q '^late content$' "$WORK/retry.paktxt"
+echo "read-retries: OK"
+
+# --output-mode: the archive gets exactly the requested permissions, whatever the umask;
+# without it, 0644 less the umask, and so does a --report file.
+(umask 022 && "$WORK/paktxt" pack -w "$WORK/src-edge_cases" -o "$WORK/mode-default.paktxt" > /dev/null)
+(umask 077 && "$WORK/paktxt" pack --report "$WORK/mode-report.json" -w "$WORK/src-edge_cases" -o "$WORK/mode-umask.paktxt" > /dev/null)
+(umask 0 && "$WORK/paktxt" pack --output-mode 0600 -w "$WORK/src-edge_cases" -o "$WORK/mode-0600.paktxt" > /dev/null)
+(umask 077 && "$WORK/paktxt" pack --output-mode 0640 -w "$WORK/src-edge_cases" -o "$WORK/mode-0640.paktxt" > /dev/null)
+for expected in default.paktxt:644 umask.paktxt:600 report.json:600 0600.paktxt:600 0640.paktxt:640; do
+    actual=$(stat -c '%a' "$WORK/mode-${expected%%:*}")
+    if [ "$actual" != "${expected#*:}" ]; then
+        echo "output-mode: mode-${expected%%:*} has mode $actual, expected ${expected#*:}"
+        exit 1
+    fi
+done
+if "$WORK/paktxt" pack --output-mode 0999 -w "$WORK/src-edge_cases" -o "$WORK/mode-bad.paktxt" > /dev/null 2>&1; then
+    echo "output-mode: invalid mode was accepted"
+    exit 1
+fi
+echo "output-mode: OK"
+
+# --select: refuses to run without a terminal; on one (emulated with script(1)), toggled
+# files are left out.
+if "$WORK/paktxt" pack --select -w "$WORK/src-by-ext" -o "$WORK/select.paktxt" < /dev/null > /dev/null 2>&1; then
+    echo "select: ran without a terminal"
+    exit 1
+fi
+if command -v script > /dev/null; then
+    (sleep 1 && printf '1-2\n\n') | script -qec "'$WORK/paktxt' pack --select -w '$WORK/src-by-ext' -o '$WORK/select.paktxt'" /dev/null > /dev/null
+    expected=$(sed -n "/^$start$/,$ s/^filename: //p" "$WORK/by-ext.paktxt" | tail -n +3)
+    if [ "$(sed -n "/^$start$/,$ s/^filename: //p" "$WORK/select.paktxt")" != "$expected" ]; then
+        echo "select: the packed files do not match the selection"
+        exit 1
+    fi
+fi
+echo "select: OK"
+
+# unpack --to-tar: the stream keeps modification times, and stdout carries nothing but the
+# stream. TestRoundTrip checks that it extracts to the same trees as a restore.
+"$WORK/paktxt" unpack --to-tar -i "$WORK/tz-utc.paktxt" 2> /dev/null | tar -tv --utc | grep -q ' 2024-01-02 03:04 a.txt$'
+# Names go through the same transforms as a restore, and options about existing files are
+# refused rather than ignored.
+mkdir -p "$WORK/src-tar-case"
+printf 'upper\n' > "$WORK/src-tar-case/Upper.TXT"
+"$WORK/paktxt" pack -w "$WORK/src-tar-case" -o "$WORK/tar-case.paktxt" > /dev/null
+if [ "$("$WORK/paktxt" unpack --to-tar --ignore-case-filenames -i "$WORK/tar-case.paktxt" 2> /dev/null | tar -t)" != "upper.txt" ]; then
+    echo "to-tar: --ignore-case-filenames did not lower the entry name"
+    exit 1
+fi
+for option in --relocate-on-collision -n --touch-only; do
+    if "$WORK/paktxt" unpack --to-tar "$option" -i "$WORK/tar-case.paktxt" > /dev/null 2>&1; then
+        echo "to-tar: $option was accepted"
+        exit 1
+    fi
+done
+echo "to-tar: OK"
+
+# A working directory that is gone or unreadable before the scan, or removed while packing,
+# fails with a specific error and leaves no archive behind.
+mkdir -p "$WORK/gone"
+out=$(cd "$WORK/gone" && rm -rf "$WORK/gone" && "$WORK/paktxt" pack -o "$WORK/gone.paktxt" 2>&1) || true
+if ! grep -q "working directory no longer exists" <<< "$out" || [ -e "$WORK/gone.paktxt" ]; then
+    echo "vanished root: expected a specific error before scanning, got: $out"
+    exit 1
+fi
+mkdir -p "$WORK/removed-mid-run"
+echo "kept" > "$WORK/removed-mid-run/a.txt"
+ln -s missing.txt "$WORK/removed-mid-run/late.txt"
+(sleep 0.5 && rm -rf "$WORK/removed-mid-run") &
+out=$("$WORK/paktxt" pack --read-retries 5 --read-retry-delay 100ms -w "$WORK/removed-mid-run" -o "$WORK/removed.paktxt" 2>&1) || true
+wait
+if ! grep -q "was removed while packing; nothing was written" <<< "$out" || [ -e "$WORK/removed.paktxt" ]; then
+    echo "vanished root: expected a specific error when the root is removed mid-run, got: $out"
+    exit 1
+fi
+if [ "$(id -u)" -ne 0 ]; then
+    mkdir -p "$WORK/unreadable"
+    chmod 300 "$WORK/unreadable" # Can enter, cannot list
+    out=$("$WORK/paktxt" pack -w "$WORK/unreadable" -o "$WORK/unreadable.paktxt" 2>&1) || true
+    chmod 755 "$WORK/unreadable"
+    if ! grep -q "is not readable" <<< "$out"; then
+        echo "unreadable root: expected a specific error, got: $out"
+        exit 1
+    fi
+fi
+echo "vanished root: OK"
+
+# --min-file-size/--max-file-size: bounds are inclusive, files just outside are skipped, and
+# both combine into a size band.
+mkdir -p "$WORK/src-size"
+for size in 9 10 11 19 20 21; do
+    head -c "$size" /dev/zero | tr '\0' 'x' > "$WORK/src-size/$size.txt"
+done
+while read -r expected flags; do
+    read -ra args <<< "$flags"
+    "$WORK/paktxt" pack "${args[@]}" -w "$WORK/src-size" -o "$WORK/size.paktxt" > /dev/null
+    actual=$(sed -n "/^$start$/,$ s/^filename: \(.*\)\.txt$/\1/p" "$WORK/size.paktxt" | sort -n | paste -sd,)
+    if [ "$actual" != "$expected" ]; then
+        echo "file size band: '$flags' packed '$actual', expected '$expected'"
+        exit 1
+    fi
+done <<'CASES'
+10,11,19,20,21 --min-file-size 10
+9,10,11,19,20 --max-file-size 20
+10,11,19,20 --min-file-size 10 --max-file-size 20
+CASES
+echo "file size band: OK"
+
+# unpack --line-ending: preserve keeps the stored bytes; lf and crlf convert every line ending
+# of mixed content (a lone '\r' is not one), keeping the BOM and a missing final newline.
+mkdir -p "$WORK/src-eol"
+printf 'a\r\nb\nc\rd\r\n' > "$WORK/src-eol/mixed.txt"
+printf '\xef\xbb\xbfx\ny'   > "$WORK/src-eol/bom-no-newline.txt"
+"$WORK/paktxt" pack -w "$WORK/src-eol" -o "$WORK/eol.paktxt" > /dev/null
+while read -r mode mixed bom; do
+    rm -rf "$WORK/dst-eol"
+    mkdir -p "$WORK/dst-eol"
+    "$WORK/paktxt" unpack --line-ending "$mode" -w "$WORK/dst-eol" -i "$WORK/eol.paktxt" > /dev/null
+    if ! cmp -s <(printf "$mixed") "$WORK/dst-eol/mixed.txt" || ! cmp -s <(printf "$bom") "$WORK/dst-eol/bom-no-newline.txt"; then
+        echo "line-ending: --line-ending $mode restored unexpected bytes"
+        exit 1
+    fi
+done <<'CASES'
+preserve a\r\nb\nc\rd\r\n \xef\xbb\xbfx\ny
+lf a\nb\nc\rd\n \xef\xbb\xbfx\ny
+crlf a\r\nb\r\nc\rd\r\n \xef\xbb\xbfx\r\ny
+CASES
+echo "line-ending: OK"
+
+# A v1 archive whose final newline was lost still restores every block and warns about it;
+# pack --append onto such an archive adds the newline back before the new block.
+for format in v1 v1-compact; do
+    flags=(--format v1)
+    [ "$format" = v1-compact ] && flags+=(--compact-metadata)
+    "$WORK/paktxt" pack "${flags[@]}" -w "$WORK/src-edge_cases" -o "$WORK/full-$format.paktxt" > /dev/null
+    head -c -1 "$WORK/full-$format.paktxt" > "$WORK/no-eol-$format.paktxt"
+    rm -rf "$WORK/dst-no-eol-$format"
+    mkdir -p "$WORK/dst-no-eol-$format"
+    out=$("$WORK/paktxt" unpack --strict-parse -w "$WORK/dst-no-eol-$format" -i "$WORK/no-eol-$format.paktxt" 2>&1)
+    if ! grep -q 'does not end with a newline' <<< "$out"; then
+        echo "missing final newline: $format archive restored without a warning"
+        exit 1
+    fi
+    diff -r "$WORK/src-edge_cases" "$WORK/dst-no-eol-$format"
+done
+mkdir -p "$WORK/src-no-eol-append"
+echo appended > "$WORK/src-no-eol-append/appended.txt"
+"$WORK/paktxt" pack --append -w "$WORK/src-no-eol-append" -o "$WORK/no-eol-v1.paktxt" > /dev/null
+mkdir -p "$WORK/dst-no-eol-append"
+"$WORK/paktxt" unpack --strict-parse -w "$WORK/dst-no-eol-append" -i "$WORK/no-eol-v1.paktxt" > /dev/null
+if [ "$(cat "$WORK/dst-no-eol-append/appended.txt")" != appended ] || [ "$(tail -c 1 "$WORK/no-eol-v1.paktxt" | od -An -c | tr -d ' ')" != '\n' ]; then
+    echo "missing final newline: append did not produce a well-formed archive"
+    exit 1
+fi
+echo "missing final newline: OK"
+
+# --path-prefix scopes pack and unpack to a subtree by whole path segments: 'a/b' takes
+# a/b and everything below it, but neither a/bc nor files directly in a.
+mkdir -p "$WORK/src-prefix/a/b/c/d" "$WORK/src-prefix/a/bc"
+for f in top a/x a/b/y a/b/c/z a/b/c/d/w a/bc/v; do
+    echo "$f" > "$WORK/src-prefix/$f.txt"
+done
+"$WORK/paktxt" pack -w "$WORK/src-prefix" -o "$WORK/prefix-all.paktxt" > /dev/null
+while read -r expected prefix; do
+    "$WORK/paktxt" pack --path-prefix "$prefix" -w "$WORK/src-prefix" -o "$WORK/prefix.paktxt" > /dev/null
+    packed=$(sed -n "/^$start$/,$ s/^filename: \(.*\)\.txt$/\1/p" "$WORK/prefix.paktxt" | sort | paste -sd,)
+    rm -rf "$WORK/dst-prefix"
+    mkdir -p "$WORK/dst-prefix"
+    "$WORK/paktxt" unpack --path-prefix "$prefix" -w "$WORK/dst-prefix" -i "$WORK/prefix-all.paktxt" > /dev/null
+    restored=$(cd "$WORK/dst-prefix" && find . -type f -name '*.txt' | sed 's|^\./||; s|\.txt$||' | sort | paste -sd,)
+    if [ "$packed" != "$expected" ] || [ "$restored" != "$expected" ]; then
+        echo "path-prefix: '$prefix' packed '$packed' and restored '$restored', expected '$expected'"
+        exit 1
+    fi
+done <<'CASES'
+a/b/c/d/w,a/b/c/z,a/b/y,a/bc/v,a/x a
+a/b/c/d/w,a/b/c/z,a/b/y a/b
+a/b/c/d/w,a/b/c/z ./a/b/c/
+a/b/c/d/w a/b/c/d
+CASES
+if "$WORK/paktxt" pack --path-prefix ../src-prefix -w "$WORK/src-prefix" -o "$WORK/prefix.paktxt" > /dev/null 2>&1; then
+    echo "path-prefix: a prefix leaving the root was accepted"
+    exit 1
+fi
+echo "path-prefix: OK"
+
+# pack --store keeps each distinct content once (4 objects for 2 snapshots of 4 files each) in a content store shared by snapshots;
+# unpack --store restores from it, and store-gc drops the objects of deleted snapshots.
+mkdir -p "$WORK/src-store/sub"
+printf 'same\n' > "$WORK/src-store/a.txt"
+printf 'same\n' > "$WORK/src-store/sub/b.txt"
+printf 'no newline' > "$WORK/src-store/c.txt"
+: > "$WORK/src-store/empty.txt"
+cp -r "$WORK/src-store" "$WORK/src-store-v1"
+count_objects() { find "$WORK/store/objects" -type f | wc -l | tr -d ' '; }
+for format in v1 v2; do
+    rm -rf "$WORK/store"
+    "$WORK/paktxt" pack --format "$format" --store "$WORK/store" -w "$WORK/src-store-v1" -o "$WORK/snap1.paktxt" > /dev/null
+    printf 'changed\n' | tee "$WORK/src-store/a.txt" > "$WORK/src-store/sub/b.txt"
+    "$WORK/paktxt" pack --format "$format" --store "$WORK/store" -w "$WORK/src-store" -o "$WORK/snap2.paktxt" > /dev/null
+    if [ "$(count_objects)" != 4 ] || grep -q '^same$' "$WORK/snap1.paktxt"; then
+        echo "store: $format snapshots stored $(count_objects) objects (expected 4) or kept content inline"
+        exit 1
+    fi
+    for snap in 1 2; do
+        rm -rf "$WORK/dst-store"
+        mkdir -p "$WORK/dst-store"
+        "$WORK/paktxt" unpack --strict-parse --store "$WORK/store" -w "$WORK/dst-store" -i "$WORK/snap$snap.paktxt" > /dev/null
+        expected="$WORK/src-store"
+        [ "$snap" = 1 ] && expected="$WORK/src-store-v1"
+        diff -r "$expected" "$WORK/dst-store"
+    done
+    if "$WORK/paktxt" unpack -w "$WORK/dst-store" -i "$WORK/snap2.paktxt" > /dev/null 2>&1; then
+        echo "store: $format snapshot restored without --store"
+        exit 1
+    fi
+    "$WORK/paktxt" store-gc --store "$WORK/store" "$WORK/snap1.paktxt" "$WORK/snap2.paktxt" > /dev/null
+    [ "$(count_objects)" = 4 ]
+    rm "$WORK/snap1.paktxt"
+    "$WORK/paktxt" store-gc --store "$WORK/store" "$WORK/snap*.paktxt" > /dev/null
+    if [ "$(count_objects)" != 3 ]; then
+        echo "store: store-gc left $(count_objects) objects, expected 3"
+        exit 1
+    fi
+    rm -rf "$WORK/src-store"
+    cp -r "$WORK/src-store-v1" "$WORK/src-store"
+done
+printf 'tampered\n' > "$(find "$WORK/store/objects" -type f | head -1)"
+if "$WORK/paktxt" unpack --store "$WORK/store" -w "$WORK/dst-store" -i "$WORK/snap2.paktxt" > /dev/null 2>&1; then
+    echo "store: a damaged object was restored"
+    exit 1
+fi
+# A large object damaged only in its last bytes is caught by the digest computed while it is
+# copied to the restored file, and leaves neither that file nor a temporary file behind.
+rm -rf "$WORK/store" "$WORK/src-store-large"
+mkdir -p "$WORK/src-store-large"
+head -c 8000000 /dev/zero | tr '\0' 'x' > "$WORK/src-store-large/big.txt"
+"$WORK/paktxt" pack --store "$WORK/store" -w "$WORK/src-store-large" -o "$WORK/large.paktxt" > /dev/null
+printf 'yz' | dd of="$(find "$WORK/store/objects" -type f)" bs=1 seek=7999998 conv=notrunc 2> /dev/null
+out=$("$WORK/paktxt" unpack --store "$WORK/store" -w "$WORK/dst-store" -i "$WORK/large.paktxt" 2>&1 || true)
+if ! grep -q 'does not match its digest' <<< "$out" || [ -n "$(ls -A "$WORK/dst-store" | grep big)" ]; then
+    echo "store: a large object damaged at its end was restored"
+    exit 1
+fi
+# Object references are prefixed with their algorithm, and unpack verifies each object with
+# the algorithm it names.
+"$WORK/paktxt" pack --hash-algo sha256 --store "$WORK/store" -w "$WORK/src-store" -o "$WORK/sha256.paktxt" > /dev/null
+if ! grep -q '^object: sha256:[0-9a-f]\{64\} [0-9]*$' "$WORK/sha256.paktxt"; then
+    echo "store: --hash-algo did not prefix the object references with their algorithm"
+    exit 1
+fi
+rm -rf "$WORK/dst-store"
+mkdir -p "$WORK/dst-store"
+"$WORK/paktxt" unpack --store "$WORK/store" -w "$WORK/dst-store" -i "$WORK/sha256.paktxt" > /dev/null
+diff -r "$WORK/src-store" "$WORK/dst-store"
+# The object size is recorded with each reference, so listings show real sizes without the
+# store; with --store they also read the content.
+if ! "$WORK/paktxt" list --long "$WORK/sha256.paktxt" | grep -q '^c.txt  *10 '; then
+    echo "store: list --long did not show the recorded size of a store block"
+    exit 1
+fi
+if ! "$WORK/paktxt" list --preview 1 -f c.txt --store "$WORK/store" "$WORK/sha256.paktxt" | grep -q '^no newline$'; then
+    echo "store: list --preview --store did not read the object"
+    exit 1
+fi
+if ! "$WORK/paktxt" list --preview 1 -f c.txt "$WORK/sha256.paktxt" | grep -q 'content in store'; then
+    echo "store: list --preview without --store did not mark the content as in the store"
+    exit 1
+fi
+for algo in sha1 blake3; do
+    if "$WORK/paktxt" pack --hash-algo "$algo" --store "$WORK/store" -w "$WORK/src-store" -o "$WORK/$algo.paktxt" > /dev/null 2>&1; then
+        echo "store: --hash-algo $algo was accepted"
+        exit 1
+    fi
+done
+# A file omitted by --max-total-bytes leaves no object behind and is not counted as stored.
+rm -rf "$WORK/store-budget" "$WORK/src-store-budget"
+mkdir -p "$WORK/src-store-budget"
+printf 'first\n' > "$WORK/src-store-budget/a.txt"
+printf 'second\n' > "$WORK/src-store-budget/b.txt"
+"$WORK/paktxt" pack --store "$WORK/store-budget" -f a.txt -w "$WORK/src-store-budget" -o "$WORK/store-budget.paktxt" > /dev/null
+limit=$(wc -c < "$WORK/store-budget.paktxt")
+rm -rf "$WORK/store-budget"
+"$WORK/paktxt" pack --store "$WORK/store-budget" --max-total-bytes "$limit" -w "$WORK/src-store-budget" -o "$WORK/store-budget.paktxt" > "$WORK/store-budget.out"
+if [ "$(find "$WORK/store-budget/objects" -type f | wc -l)" != 1 ] || ! grep -q '1 new object(s)' "$WORK/store-budget.out"; then
+    echo "store: a file omitted by --max-total-bytes left an object in the store"
+    exit 1
+fi
+echo "store: OK"
+
+# Restored permissions are clamped by the process umask, which chmod would otherwise bypass
+# for executables, and by --umask on top of it; --to-tar entries get the same modes.
+mkdir -p "$WORK/src-umask/bin"
+printf '#!/bin/sh\n' > "$WORK/src-umask/bin/run.sh"
+chmod 755 "$WORK/src-umask/bin/run.sh"
+echo data > "$WORK/src-umask/data.txt"
+"$WORK/paktxt" pack -w "$WORK/src-umask" -o "$WORK/umask.paktxt" > /dev/null
+while read -r process flags expected; do
+    read -ra args <<< "$flags"
+    rm -rf "$WORK/dst-umask"
+    mkdir -p "$WORK/dst-umask"
+    (umask "$process" && "$WORK/paktxt" unpack "${args[@]}" -w "$WORK/dst-umask" -i "$WORK/umask.paktxt" > /dev/null)
+    actual=$(cd "$WORK/dst-umask" && stat -c %a data.txt bin bin/run.sh | paste -sd,)
+    if [ "$actual" != "$expected" ]; then
+        echo "umask: umask $process with '$flags' restored modes $actual, expected $expected"
+        exit 1
+    fi
+done <<'CASES'
+022 --umask=0 644,755,755
+077 --umask=0 600,700,700
+022 --umask=027 640,750,750
+027 --umask=002 640,750,750
+CASES
+tarred=$("$WORK/paktxt" unpack --umask 077 --to-tar -i "$WORK/umask.paktxt" 2>/dev/null | tar tvf - | awk '{print $1}' | paste -sd,)
+if [ "$tarred" != "drwx------,-rwx------,-rw-------" ]; then
+    echo "umask: --to-tar --umask 077 wrote modes $tarred"
+    exit 1
+fi
+echo "umask: OK"
+
+# info --tokens counts the whole archive and lists files biggest first: the estimate is one
+# token per started 4 characters of each word, and --tokenizer can be any counting command.
+mkdir -p "$WORK/src-tokens"
+printf 'abcd efghi\n' > "$WORK/src-tokens/small.txt"            # 1 + 2
+printf 'one two three four five six\n' > "$WORK/src-tokens/big.txt" # 1 + 1 + 2 + 1 + 1 + 1
+printf 'x\n' > "$WORK/src-tokens/tiny.txt"
+"$WORK/paktxt" pack -w "$WORK/src-tokens" -o "$WORK/tokens.paktxt" > /dev/null
+while read -r expected flags; do
+    read -ra args <<< "$flags"
+    actual=$("$WORK/paktxt" info -i "$WORK/tokens.paktxt" --tokens "${args[@]}" | awk -F '  +' 'NR > 2 { gsub(/ /, "_", $1); print $1 "=" $2 }' | paste -sd,)
+    if [ "$actual" != "$expected" ]; then
+        echo "info --tokens: '$flags' listed '$actual', expected '$expected'"
+        exit 1
+    fi
+done <<'CASES'
+big.txt=7,small.txt=3,tiny.txt=1
+big.txt=7,small.txt=3,(1_more_files)=1 --top 2
+CASES
+summary=$("$WORK/paktxt" info -i "$WORK/tokens.paktxt" --tokens --tokenizer 'wc -w' | sed -n 1p)
+if ! grep -q 'file contents 9,' <<< "$summary"; then
+    echo "info --tokens: --tokenizer 'wc -w' reported: $summary"
+    exit 1
+fi
+echo "info --tokens: OK"
+
+# The header names the delimiter set with format_version. Archives written before that line
+# existed still parse, alone and concatenated with new ones, and are still recognized as
+# archives when packed; an unknown version is reported rather than misparsed.
+"$WORK/paktxt" pack -w "$WORK/src-edge_cases" -o "$WORK/versioned.paktxt" > /dev/null
+if [ "$(sed -n 2p "$WORK/versioned.paktxt")" != "format_version: 1" ]; then
+    echo "format_version: missing from the header"
+    exit 1
+fi
+sed '/^format_version: /d' "$WORK/versioned.paktxt" > "$WORK/unversioned.paktxt"
+cat "$WORK/unversioned.paktxt" "$WORK/versioned.paktxt" > "$WORK/mixed-versions.paktxt"
+for archive in unversioned mixed-versions; do
+    rm -rf "$WORK/dst-$archive"
+    mkdir -p "$WORK/dst-$archive"
+    "$WORK/paktxt" unpack --strict-parse -w "$WORK/dst-$archive" -i "$WORK/$archive.paktxt" > /dev/null
+    diff -r "$WORK/src-edge_cases" "$WORK/dst-$archive"
+done
+sed 's/^format_version: 1$/format_version: 99/' "$WORK/versioned.paktxt" > "$WORK/future.paktxt"
+out=$("$WORK/paktxt" unpack -w "$WORK/dst-unversioned" -i "$WORK/future.paktxt" 2>&1 || true)
+if ! grep -q 'format_version 99.*upgrade' <<< "$out"; then
+    echo "format_version: an unknown version was not reported"
+    exit 1
+fi
+mkdir -p "$WORK/src-old-archive"
+cp "$WORK/unversioned.paktxt" "$WORK/src-old-archive/notes.txt"
+echo keep > "$WORK/src-old-archive/keep.txt"
+"$WORK/paktxt" pack -w "$WORK/src-old-archive" -o "$WORK/old-archive.paktxt" > /dev/null
+if [ "$(sed -n "/^$start$/,$ s/^filename: //p" "$WORK/old-archive.paktxt")" != keep.txt ]; then
+    echo "format_version: an archive without the line was packed as a regular file"
+    exit 1
+fi
+echo "format_version: OK"
+
+# --exclude-test-files and --only-test-files: test file conventions of several languages split
+# the tree into production code and tests, and --test-patterns replaces the built-in rules.
+mkdir -p "$WORK/src-tests/pkg" "$WORK/src-tests/app/tests" "$WORK/src-tests/web/__tests__" \
+    "$WORK/src-tests/java" "$WORK/src-tests/it"
+for f in pkg/util.go pkg/util_test.go app/main.py app/test_main.py app/tests/conftest.py \
+    web/button.tsx web/button.spec.ts web/__tests__/form.js java/Parser.java java/ParserTest.java \
+    it/smoke.sh; do
+    echo "content of $f" > "$WORK/src-tests/$f"
+done
+while read -r expected flags; do
+    read -ra args <<< "$flags"
+    "$WORK/paktxt" pack -w "$WORK/src-tests" -o "$WORK/tests.paktxt" "${args[@]}" > /dev/null
+    got=$(sed -n "/^$start$/,$ s/^filename: //p" "$WORK/tests.paktxt" | sort | paste -sd, -)
+    if [ "$got" != "$expected" ]; then
+        echo "test-files: $flags packed $got, expected $expected"
+        exit 1
+    fi
+done <<'CASES'
+app/main.py,it/smoke.sh,java/Parser.java,pkg/util.go,web/button.tsx --exclude-test-files
+app/test_main.py,app/tests/conftest.py,java/ParserTest.java,pkg/util_test.go,web/__tests__/form.js,web/button.spec.ts --only-test-files
+it/smoke.sh,pkg/util_test.go --only-test-files --test-patterns=*_test.go,it/
+CASES
+if "$WORK/paktxt" pack -w "$WORK/src-tests" -o "$WORK/tests.paktxt" --exclude-test-files --only-test-files > /dev/null 2>&1; then
+    echo "test-files: --exclude-test-files with --only-test-files was accepted"
+    exit 1
+fi
+echo "test-files: OK"
+
+# --report: a JSON or CSV log of the run lists each file with what happened to it, the totals,
+# and a failed status when the run fails.
+mkdir -p "$WORK/src-report/sub" "$WORK/dst-report"
+echo kept > "$WORK/src-report/a.txt"
+echo test > "$WORK/src-report/sub/a_test.go"
+: > "$WORK/src-report/empty.txt"
+"$WORK/paktxt" pack -w "$WORK/src-report" -o "$WORK/report.paktxt" --exclude-if-empty --report "$WORK/pack-report.json" > /dev/null
+out=$(cat "$WORK/pack-report.json")
+if ! grep -q '"status": "ok"' <<< "$out" || ! grep -q '"packed": 2' <<< "$out" ||
+    ! grep -q '"path": "empty.txt"' <<< "$out"; then
+    echo "report: the pack report misses the packed or skipped files"
+    exit 1
+fi
+echo old > "$WORK/dst-report/a.txt"
+"$WORK/paktxt" unpack -w "$WORK/dst-report" -i "$WORK/report.paktxt" -e 'sub/*' --report "$WORK/unpack-report.csv" > /dev/null
+rows=$(tr ' ' _ < "$WORK/unpack-report.csv")
+while read -r expected; do
+    if ! grep -qx "[^,]*,$expected" <<< "$rows"; then
+        echo "report: no '$expected' row in the CSV unpack report"
+        exit 1
+    fi
+done <<'CASES'
+overwritten,a.txt,5_bytes
+skipped,sub/a_test.go,matches_--exclude
+total,overwritten,1
+total,skipped,1
+CASES
+"$WORK/paktxt" unpack -w "$WORK/dst-report" -i "$WORK/missing.paktxt" --report "$WORK/failed-report.json" > /dev/null 2>&1 || true
+if ! grep -q '"status": "failed"' "$WORK/failed-report.json" 2> /dev/null; then
+    echo "report: a failed unpack was not reported"
+    exit 1
+fi
+echo "report: OK"
+
+# pack --from-tar and --from-zip: a tar (plain or gzip) or zip with text, binary and executable
+# entries packs like the same tree on disk, so the archive restores to its text files only.
+mkdir -p "$WORK/src-from/tree/bin" "$WORK/src-from/tree/src" "$WORK/src-from/text/bin" "$WORK/src-from/text/src"
+printf 'hello\n' > "$WORK/src-from/text/src/a.txt"
+printf '#!/bin/sh\necho run\n' > "$WORK/src-from/text/bin/run.sh"
+chmod 755 "$WORK/src-from/text/bin/run.sh"
+cp -p "$WORK/src-from/text/src/a.txt" "$WORK/src-from/tree/src/"
+cp -p "$WORK/src-from/text/bin/run.sh" "$WORK/src-from/tree/bin/"
+printf '\x89PNG\r\n\x1a\n\0\0\0\rIHDR' > "$WORK/src-from/tree/src/logo"
+head -c 512 /dev/urandom > "$WORK/src-from/tree/src/data.bin"
+tar -cf "$WORK/from.tar" -C "$WORK/src-from/tree" .
+tar -czf "$WORK/from.tgz" -C "$WORK/src-from/tree" .
+inputs=(--from-tar "$WORK/from.tar" --from-tar "$WORK/from.tgz")
+if command -v zip > /dev/null; then
+    (cd "$WORK/src-from/tree" && zip -qr "$WORK/from.zip" .)
+    inputs+=(--from-zip "$WORK/from.zip")
+fi
+for ((i = 0; i < ${#inputs[@]}; i += 2)); do
+    rm -rf "$WORK/dst-from"
+    mkdir -p "$WORK/dst-from"
+    "$WORK/paktxt" pack "${inputs[i]}" "${inputs[i+1]}" -o "$WORK/from.paktxt" > /dev/null
+    "$WORK/paktxt" unpack --strict-parse -w "$WORK/dst-from" -i "$WORK/from.paktxt" > /dev/null
+    if ! diff -r "$WORK/src-from/text" "$WORK/dst-from" || [ ! -x "$WORK/dst-from/bin/run.sh" ]; then
+        echo "from-archive: ${inputs[i]} $(basename "${inputs[i+1]}") did not pack the text entries with their modes"
+        exit 1
+    fi
+done
+echo "from-archive: OK"
+
+# update keeps the --since-archive base trailer, re-signs with --sign and otherwise warns that
+# the signature it cannot carry over was removed.
+mkdir -p "$WORK/src-upsig" "$WORK/dst-upsig"
+printf 'one\n' > "$WORK/src-upsig/a.txt"
+"$WORK/paktxt" keygen -o "$WORK/upsig" > /dev/null
+"$WORK/paktxt" pack --modtime -w "$WORK/src-upsig" -o "$WORK/upsig-base.paktxt" > /dev/null
+printf 'two\n' > "$WORK/src-upsig/b.txt"
+"$WORK/paktxt" pack --modtime --since-archive "$WORK/upsig-base.paktxt" --sign "$WORK/upsig.key" -w "$WORK/src-upsig" -o "$WORK/upsig.paktxt" > /dev/null
+printf 'three\n' > "$WORK/src-upsig/b.txt"
+"$WORK/paktxt" update --sign "$WORK/upsig.key" -w "$WORK/src-upsig" -i "$WORK/upsig.paktxt" -o "$WORK/upsig-signed.paktxt" > /dev/null
+if ! grep -q '^PAKTXT-BASE ' "$WORK/upsig-signed.paktxt" ||
+    ! "$WORK/paktxt" unpack --verify-sig "$WORK/upsig.pub" -w "$WORK/dst-upsig" -i "$WORK/upsig-signed.paktxt" > /dev/null ||
+    [ "$(cat "$WORK/dst-upsig/b.txt")" != three ]; then
+    echo "update trailers: --sign did not produce a verifiable archive that keeps its base"
+    exit 1
+fi
+"$WORK/paktxt" update -w "$WORK/src-upsig" -i "$WORK/upsig.paktxt" -o "$WORK/upsig-plain.paktxt" > "$WORK/upsig.out"
+if ! grep -q 'Removing the signature' "$WORK/upsig.out" || grep -q '^PAKTXT-SIGNATURE' "$WORK/upsig-plain.paktxt" ||
+    ! grep -q '^PAKTXT-BASE ' "$WORK/upsig-plain.paktxt"; then
+    echo "update trailers: an unsigned update did not warn about the removed signature"
+    exit 1
+fi
+echo "update trailers: OK"
+
+# Symlink blocks cannot make unpack write outside the working directory: targets that are
+# absolute, unclean or outside are skipped, nothing is written below a symlinked directory
+# (created by the archive or already on disk), and a symlink at a restored path is replaced.
+mkdir -p "$WORK/src-symesc/real" "$WORK/src-symesc/zz"
+echo x > "$WORK/src-symesc/real/x.txt"
+echo pwned > "$WORK/src-symesc/zz/pwned.txt"
+ln -s real "$WORK/src-symesc/link"
+"$WORK/paktxt" pack --resolve-relative-symlinks -w "$WORK/src-symesc" -o "$WORK/symesc.paktxt" > /dev/null
+while read -r target name jobs; do
+    sed -e "s#^symlink: real\$#symlink: $target#" -e "s#^filename: zz/pwned.txt\$#filename: $name#" \
+        "$WORK/symesc.paktxt" > "$WORK/symesc-case.paktxt"
+    rm -rf "$WORK/symesc-sandbox"
+    mkdir -p "$WORK/symesc-sandbox/target"
+    "$WORK/paktxt" unpack --jobs "$jobs" -w "$WORK/symesc-sandbox/target" -i "$WORK/symesc-case.paktxt" > /dev/null
+    if [ "$(ls -A "$WORK/symesc-sandbox")" != target ] || [ -e "$WORK/pwned.txt" ]; then
+        echo "symlink escape: 'link -> $target' with '$name' (--jobs $jobs) wrote outside the target"
+        exit 1
+    fi
+done <<CASES
+../outside link/pwned.txt 1
+../outside link/pwned.txt 4
+. link/pwned.txt 1
+$WORK link/pwned.txt 1
+real/../.. link/pwned.txt 1
+real ../pwned.txt 1
+CASES
+rm -rf "$WORK/symesc-sandbox"
+mkdir -p "$WORK/symesc-sandbox/target" "$WORK/symesc-sandbox/outside"
+ln -s ../outside "$WORK/symesc-sandbox/target/zz"
+echo keep > "$WORK/symesc-sandbox/outside/x.txt"
+ln -s ../outside/x.txt "$WORK/symesc-sandbox/target/real"
+"$WORK/paktxt" pack -w "$WORK/src-symesc" -o "$WORK/symesc-plain.paktxt" > /dev/null
+sed 's#^filename: real/x.txt$#filename: real#' "$WORK/symesc-plain.paktxt" > "$WORK/symesc-case.paktxt"
+"$WORK/paktxt" unpack -w "$WORK/symesc-sandbox/target" -i "$WORK/symesc-case.paktxt" > /dev/null
+if [ -n "$(ls -A "$WORK/symesc-sandbox/outside" | grep -vx x.txt)" ] || [ "$(cat "$WORK/symesc-sandbox/outside/x.txt")" != keep ] ||
+    [ -L "$WORK/symesc-sandbox/target/real" ]; then
+    echo "symlink escape: a symlink already on disk was written through"
+    exit 1
+fi
+# --touch-only treats a symlink at the restored path as a mismatch even when its target holds
+# the same content, so the executable bit and modification time never reach the target.
+rm -rf "$WORK/symesc-sandbox" "$WORK/src-touch-link"
+mkdir -p "$WORK/src-touch-link" "$WORK/symesc-sandbox/target" "$WORK/symesc-sandbox/outside"
+printf '#!/bin/sh\n' > "$WORK/src-touch-link/run.sh"
+chmod 755 "$WORK/src-touch-link/run.sh"
+touch -d 2001-01-01 "$WORK/src-touch-link/run.sh"
+"$WORK/paktxt" pack --modtime -w "$WORK/src-touch-link" -o "$WORK/touch-link.paktxt" > /dev/null
+printf '#!/bin/sh\n' > "$WORK/symesc-sandbox/outside/run.sh"
+chmod 600 "$WORK/symesc-sandbox/outside/run.sh"
+ln -s ../outside/run.sh "$WORK/symesc-sandbox/target/run.sh"
+"$WORK/paktxt" unpack --touch-only -w "$WORK/symesc-sandbox/target" -i "$WORK/touch-link.paktxt" > /dev/null
+if [ "$(stat -c %a "$WORK/symesc-sandbox/outside/run.sh")" != 600 ] || [ "$(date -r "$WORK/symesc-sandbox/outside/run.sh" +%Y)" = 2001 ] ||
+    [ -L "$WORK/symesc-sandbox/target/run.sh" ]; then
+    echo "symlink escape: --touch-only synced metadata through a symlink at the restored path"
+    exit 1
+fi
+echo "symlink escape: OK"
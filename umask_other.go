@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "io/fs"
+
+// processUmask returns 0, as this platform has no umask.
+func processUmask() fs.FileMode {
+	return 0
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package main
+
+import (
+	"io/fs"
+	"sync"
+	"syscall"
+)
+
+// processUmask returns the umask of the process. Reading it means setting it, so it is set
+// to 0 and straight back once per run, before any files are written.
+var processUmask = sync.OnceValue(func() fs.FileMode {
+	umask := syscall.Umask(0)
+	syscall.Umask(umask)
+	return fs.FileMode(umask)
+})